@@ -163,6 +163,7 @@ func (g *Gossiper) SendTLC(tx message.TxPublish, round int) {
 	}
 
 	// Store new tlc message into rumor buffer
+	g.StoreRumor(wrappedMessage)
 	g.RumorBuffer.Rumors[g.Name] = append(g.RumorBuffer.Rumors[g.Name], &message.WrappedRumorTLCMessage{
 		TLCMessage: tlc,
 	})
@@ -255,6 +256,7 @@ func (g *Gossiper) SendTLC(tx message.TxPublish, round int) {
 	}
 
 	// Store new tlc message into rumor buffer
+	g.StoreRumor(wrappedMessage)
 	g.RumorBuffer.Rumors[g.Name] = append(g.RumorBuffer.Rumors[g.Name], &message.WrappedRumorTLCMessage{
 		TLCMessage: tlc,
 	})
@@ -47,6 +47,7 @@ func (g *Gossiper) HandleClient(msg *message.Message) {
 		// Store rumor
 		wrappedMessage := &message.WrappedRumorTLCMessage{
 			RumorMessage: rumor}
+		g.StoreRumor(wrappedMessage)
 		g.RumorBuffer.Rumors[g.Name] = append(g.RumorBuffer.Rumors[g.Name], wrappedMessage)
 
 		// Step 2. Update status
@@ -0,0 +1,691 @@
+package gossiper
+
+// Ordering of the blocks of an election among its trustees with PBFT. The
+// leader of a view proposes the next block, a transition of the election or a
+// batch of ballots, in a pre-prepare. The trustees that find it valid vote to
+// prepare it, once a quorum of them prepared it they vote to commit it, and
+// they append it once a quorum committed it. A trustee that waits too long for
+// the next block asks to move to the next view, whose leader proposes again
+// the block a quorum may have prepared in an earlier view, so that a crashed
+// or lying leader only delays the blockchain. The votes are signed with the
+// shares of the election key and gossiped like the other rumors.
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
+)
+
+const (
+	// ConsensusTimeout is how long a trustee waits for the next block before
+	// it moves to the next view, doubled for each view that fails
+	ConsensusTimeout = 5 * time.Second
+
+	ConsensusTick        = 50 * time.Millisecond
+	ConsensusChannelSize = 1024
+)
+
+type voteKey struct {
+	Type   string
+	View   int
+	Seq    int
+	Digest string
+}
+
+type viewSeq struct {
+	View int
+	Seq  int
+}
+
+type viewChange struct {
+	Vote     *message.ConsensusVote
+	Prepares []*message.ConsensusVote
+}
+
+// pbft is the state of the ordering of the blocks of a blockchain, owned by
+// its HandleRound. Everything kept for a round is dropped once its block is
+// committed.
+type pbft struct {
+	bc *Blockchain
+
+	// Election, and the trustee of this peer, once the election is frozen
+	elec    *message.Election
+	trustee *message.Trustee
+	share   *big.Int
+	n       int
+	quorum  int
+
+	// View of this trustee, and whether it waits for its new view
+	view         int
+	viewChanging bool
+	timeout      time.Duration
+	deadline     time.Time
+
+	// Votes and blocks received, by round
+	votes       map[voteKey]map[int]*message.ConsensusVote
+	blocks      map[string]*message.Block // by digest
+	proposals   map[viewSeq]string        // digest proposed by the leader of the view
+	viewChanges map[viewSeq]map[int]*viewChange
+	newViews    map[viewSeq]*message.ConsensusMessage
+
+	// Views of the current round in which this trustee checked the proposal,
+	// and whether it was valid, committed it or started the view
+	checked    map[int]bool
+	committing map[int]bool
+	started    map[int]bool
+
+	// Block of the current round prepared in the latest view, and the
+	// prepare votes proving it
+	prepared       int
+	preparedDigest string
+	preparedVotes  []*message.ConsensusVote
+
+	// record keys of the ballots in the blockchain
+	recorded map[string]bool
+
+	// When the leader found the first ballot of the block it proposes next
+	batchStart time.Time
+
+	// Messages received before the election is frozen, and messages of this
+	// trustee to handle
+	pending []*message.ConsensusMessage
+	inbox   []*message.ConsensusMessage
+}
+
+func (bc *Blockchain) HandleRound() {
+	/*
+		This function orders the blocks of the election with the other
+		trustees, it handles their messages and the timeout of the
+		current view
+		The blocks of an election that is not frozen are not ordered,
+		it has no trustees yet
+	*/
+
+	p := &pbft{
+		bc:          bc,
+		timeout:     ConsensusTimeout,
+		votes:       make(map[voteKey]map[int]*message.ConsensusVote),
+		blocks:      make(map[string]*message.Block),
+		proposals:   make(map[viewSeq]string),
+		viewChanges: make(map[viewSeq]map[int]*viewChange),
+		newViews:    make(map[viewSeq]*message.ConsensusMessage),
+		recorded:    bc.RecordedKeys(),
+		pending:     make([]*message.ConsensusMessage, 0),
+	}
+	p.resetRound()
+
+	ticker := time.NewTicker(ConsensusTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-bc.ConsensusCh:
+			if p.elec == nil {
+				if len(p.pending) < ConsensusChannelSize {
+					p.pending = append(p.pending, m)
+				}
+				continue
+			}
+			p.handle(m)
+		case <-ticker.C:
+			p.tick()
+		}
+
+		// Handle the messages this trustee sent in turn
+		for len(p.inbox) > 0 {
+			m := p.inbox[0]
+			p.inbox = p.inbox[1:]
+			p.handle(m)
+		}
+	}
+}
+
+func (p *pbft) resetRound() {
+	p.checked = make(map[int]bool)
+	p.committing = make(map[int]bool)
+	p.started = make(map[int]bool)
+	p.prepared = -1
+	p.preparedDigest = ""
+	p.preparedVotes = nil
+	p.viewChanging = false
+	p.timeout = ConsensusTimeout
+	p.deadline = time.Time{}
+}
+
+func (p *pbft) tick() {
+	/*
+		This func starts the ordering once the election is frozen, lets
+		the leader propose, and moves to the next view once the timeout of
+		the current one expires while a block is waited for
+	*/
+
+	bc := p.bc
+	if p.elec == nil {
+		bc.BlockMux.Lock()
+		elec, trustee, share := bc.Election, bc.Trustee, bc.Share
+		bc.BlockMux.Unlock()
+		if elec == nil || trustee == nil || share == nil {
+			return
+		}
+
+		p.elec, p.trustee, p.share = elec, trustee, share
+		p.n = len(elec.Trustees)
+		p.quorum = message.ConsensusQuorum(p.n)
+		// The revote policy of the election picks the record keys
+		p.recorded = bc.RecordedKeys()
+		fmt.Printf("%s ORDERING ELECTION %s AS TRUSTEE %d OF %d\n", bc.Prefix, bc.ElectionName, trustee.Index, p.n)
+
+		pending := p.pending
+		p.pending = nil
+		for _, m := range pending {
+			p.handle(m)
+		}
+	}
+
+	p.progress()
+
+	// A block is waited for if the leader proposed one, or if there is one
+	// to propose
+	next, _ := bc.NextProposal(p.recorded)
+	waiting := p.viewChanging || p.proposals[viewSeq{p.view, bc.NextId}] != "" || next != nil
+	if !waiting {
+		p.deadline = time.Time{}
+		return
+	}
+
+	now := time.Now()
+	if p.deadline.IsZero() {
+		p.deadline = now.Add(p.timeout)
+	} else if now.After(p.deadline) {
+		fmt.Printf("%s VIEW %d OF ELECTION %s TIMED OUT\n", bc.Prefix, p.view, bc.ElectionName)
+		p.startViewChange(p.view + 1)
+	}
+}
+
+func (p *pbft) send(m *message.ConsensusMessage) {
+	/*
+		This func signs the vote of the message and sends it to the other
+		trustees, this trustee handles it as well
+	*/
+
+	m.ElectionName = p.bc.ElectionName
+	if err := m.Vote.Sign(m.ElectionName, p.trustee, p.share); err != nil {
+		fmt.Printf("%s CANNOT SIGN %s: %s\n", p.bc.Prefix, m.Vote.Type, err)
+		return
+	}
+
+	p.bc.ConsensusSendCh <- m
+	p.inbox = append(p.inbox, m)
+}
+
+func newVote(voteType string, view int, seq int, digest string) *message.ConsensusMessage {
+	return &message.ConsensusMessage{
+		Vote: &message.ConsensusVote{
+			Type:     voteType,
+			View:     view,
+			Seq:      seq,
+			Digest:   digest,
+			Prepared: -1,
+		},
+	}
+}
+
+func (p *pbft) handle(m *message.ConsensusMessage) {
+	/*
+		This func handles a message of a trustee
+		Step 0. Check that the vote is signed by a trustee of the election
+		        and is not for a round already committed
+		Step 1. Store the vote, the block or the view change
+		Step 2. Make progress with it
+	*/
+
+	bc := p.bc
+
+	/* Step 0 */
+	v := m.Vote
+	if m.ElectionName != bc.ElectionName || v == nil || v.Seq < bc.NextId {
+		return
+	}
+	if err := p.elec.VerifyConsensusVote(bc.ElectionName, v); err != nil {
+		fmt.Printf("%s REJECTING %s FROM %s: %s\n", bc.Prefix, v.Type, m.Origin, err)
+		return
+	}
+
+	/* Step 1 */
+	key := viewSeq{v.View, v.Seq}
+	switch v.Type {
+	case message.ConsensusPrePrepare:
+		b := m.Block
+		if v.Index != message.ConsensusLeader(v.View, p.n) || b == nil || b.Round != v.Seq ||
+			b.CurrentHash != b.Hash() || hex.EncodeToString(b.CurrentHash[:]) != v.Digest || b.CheckBallots() != nil {
+			fmt.Printf("%s REJECTING PRE-PREPARE OF TRUSTEE %d FOR VIEW %d\n", bc.Prefix, v.Index, v.View)
+			return
+		}
+
+		p.blocks[v.Digest] = b
+		if digest, ok := p.proposals[key]; !ok {
+			p.proposals[key] = v.Digest
+		} else if digest != v.Digest {
+			fmt.Printf("%s LEADER %d PROPOSES TWO BLOCKS IN VIEW %d\n", bc.Prefix, v.Index, v.View)
+		}
+
+	case message.ConsensusPrepare, message.ConsensusCommit:
+		vk := voteKey{v.Type, v.View, v.Seq, v.Digest}
+		if _, ok := p.votes[vk]; !ok {
+			p.votes[vk] = make(map[int]*message.ConsensusVote)
+		}
+		p.votes[vk][v.Index] = v
+
+	case message.ConsensusViewChange:
+		if err := p.elec.VerifyPrepared(bc.ElectionName, v, m.Prepares); err != nil {
+			fmt.Printf("%s REJECTING VIEW CHANGE OF TRUSTEE %d: %s\n", bc.Prefix, v.Index, err)
+			return
+		}
+		if _, ok := p.viewChanges[key]; !ok {
+			p.viewChanges[key] = make(map[int]*viewChange)
+		}
+		p.viewChanges[key][v.Index] = &viewChange{v, m.Prepares}
+
+	case message.ConsensusNewView:
+		if err := p.checkNewView(m); err != nil {
+			fmt.Printf("%s REJECTING NEW VIEW OF TRUSTEE %d: %s\n", bc.Prefix, v.Index, err)
+			return
+		}
+		p.newViews[key] = m
+
+	default:
+		return
+	}
+
+	/* Step 2 */
+	p.progress()
+}
+
+func (p *pbft) checkNewView(m *message.ConsensusMessage) error {
+	/*
+		This func checks that the new view is started by its leader with
+		the view changes of a quorum of trustees, and that it proposes the
+		block prepared in the latest view among them, if any
+	*/
+
+	v := m.Vote
+	if v.Index != message.ConsensusLeader(v.View, p.n) {
+		return fmt.Errorf("trustee %d doesn't lead view %d", v.Index, v.View)
+	}
+
+	voted := make(map[int]bool)
+	latest := -1
+	digests := make(map[string]bool)
+	for _, vc := range m.ViewChanges {
+		if vc == nil || vc.Type != message.ConsensusViewChange || vc.View != v.View || vc.Seq != v.Seq {
+			return fmt.Errorf("view change for another view")
+		}
+		if err := p.elec.VerifyConsensusVote(p.bc.ElectionName, vc); err != nil {
+			return err
+		}
+		voted[vc.Index] = true
+
+		if vc.Prepared > latest {
+			latest = vc.Prepared
+			digests = make(map[string]bool)
+		}
+		if vc.Prepared == latest && latest >= 0 {
+			digests[vc.Digest] = true
+		}
+	}
+	if len(voted) < p.quorum {
+		return fmt.Errorf("not enough view changes")
+	}
+
+	if v.Prepared != latest || (latest >= 0 && !digests[v.Digest]) {
+		return fmt.Errorf("new view doesn't propose the latest prepared block")
+	}
+	return p.elec.VerifyPrepared(p.bc.ElectionName, v, m.Prepares)
+}
+
+func (p *pbft) progress() {
+	/*
+		This func makes progress with the votes received so far
+		Step 0. Append the blocks committed by a quorum
+		Step 1. Move to a later view if enough trustees ask to, or if its
+		        leader started it
+		Step 2. Propose the next block if this trustee leads the view
+		Step 3. Prepare the block of the view if it is valid, and commit it
+		        once a quorum prepared it
+	*/
+
+	bc := p.bc
+
+	/* Step 0 */
+	for p.commitNext() {
+	}
+
+	/* Step 1 */
+	p.followViewChanges()
+	if p.viewChanging {
+		return
+	}
+
+	/* Step 2 */
+	seq := bc.NextId
+	key := viewSeq{p.view, seq}
+	if _, ok := p.proposals[key]; !ok && message.ConsensusLeader(p.view, p.n) == p.trustee.Index {
+		if b := p.nextBlock(); b != nil {
+			digest := hex.EncodeToString(b.CurrentHash[:])
+			p.proposals[key] = digest
+			p.blocks[digest] = b
+			fmt.Printf("%s PROPOSING %s IN VIEW %d\n", bc.Prefix, b.ToString(), p.view)
+
+			m := newVote(message.ConsensusPrePrepare, p.view, seq, digest)
+			m.Block = b
+			p.send(m)
+		}
+	}
+
+	/* Step 3 */
+	digest, ok := p.proposals[key]
+	b := p.blocks[digest]
+	if !ok || b == nil {
+		return
+	}
+
+	if _, ok := p.checked[p.view]; !ok {
+		err := bc.CheckCandidate(b, p.recorded)
+		p.checked[p.view] = err == nil
+		if err != nil {
+			fmt.Printf("%s NOT PREPARING %s: %s\n", bc.Prefix, b.ToString(), err)
+		} else {
+			p.send(newVote(message.ConsensusPrepare, p.view, seq, digest))
+		}
+	}
+
+	prepares := p.votes[voteKey{message.ConsensusPrepare, p.view, seq, digest}]
+	if p.checked[p.view] && !p.committing[p.view] && len(prepares) >= p.quorum {
+		p.committing[p.view] = true
+		p.prepared = p.view
+		p.preparedDigest = digest
+		p.preparedVotes = make([]*message.ConsensusVote, 0, len(prepares))
+		for _, v := range prepares {
+			p.preparedVotes = append(p.preparedVotes, v)
+		}
+
+		p.send(newVote(message.ConsensusCommit, p.view, seq, digest))
+	}
+}
+
+func (p *pbft) nextBlock() *message.Block {
+	/*
+		This func returns the block the leader proposes now, if any: a
+		transition or a full block at once, or else the ballots that
+		arrived within BlockTimeSlice of the first one
+	*/
+
+	b, full := p.bc.NextProposal(p.recorded)
+	if b == nil {
+		p.batchStart = time.Time{}
+		return nil
+	}
+
+	if !full {
+		if p.batchStart.IsZero() {
+			p.batchStart = time.Now()
+		}
+		if time.Since(p.batchStart) < BlockTimeSlice {
+			return nil
+		}
+	}
+
+	p.batchStart = time.Time{}
+	return b
+}
+
+func (p *pbft) commitNext() bool {
+	/*
+		This func appends the next block if a quorum committed it, in any
+		view, and returns true if it did
+	*/
+
+	bc := p.bc
+	seq := bc.NextId
+
+	var block *message.Block
+	view := 0
+	for vk, votes := range p.votes {
+		if vk.Type == message.ConsensusCommit && vk.Seq == seq && len(votes) >= p.quorum && p.blocks[vk.Digest] != nil {
+			block, view = p.blocks[vk.Digest], vk.View
+			break
+		}
+	}
+	if block == nil {
+		return false
+	}
+
+	bc.BlockMux.Lock()
+	if !bc.CheckBlockValidty(block) {
+		// Can't be committed by a quorum with an honest trustee
+		bc.BlockMux.Unlock()
+		fmt.Printf("%s COMMITTED BLOCK %s DOESN'T FOLLOW THE HEAD\n", bc.Prefix, block.ToString())
+		delete(p.blocks, hex.EncodeToString(block.CurrentHash[:]))
+		return false
+	}
+	// Appended once it is stored, a restarted trustee resumes after it
+	bc.StoreBlock(block)
+	bc.Blocks = append(bc.Blocks, block)
+	bc.Records = append(bc.Records, block.ToString())
+	if block.Transition != nil {
+		bc.State = block.Transition.To
+	}
+	bc.BlockMux.Unlock()
+
+	for _, cb := range block.CastBallots {
+		p.recorded[bc.RecordKey(cb)] = true
+	}
+
+	fmt.Printf("%s    APPENDING BLOCK %s\n", bc.Prefix, block.ToString())
+	bc.NextId += 1
+	fmt.Printf("%s ENTERING ROUND %d FOR ELECTION %s\n\n", bc.Prefix, bc.NextId, bc.ElectionName)
+
+	// The next round starts in the view the block was committed in
+	p.resetRound()
+	p.view = view
+	for vk := range p.votes {
+		if vk.Seq < bc.NextId {
+			delete(p.votes, vk)
+		}
+	}
+	for key := range p.proposals {
+		if key.Seq < bc.NextId {
+			delete(p.proposals, key)
+		}
+	}
+	for key := range p.viewChanges {
+		if key.Seq < bc.NextId {
+			delete(p.viewChanges, key)
+		}
+	}
+	for key := range p.newViews {
+		if key.Seq < bc.NextId {
+			delete(p.newViews, key)
+		}
+	}
+	for digest, b := range p.blocks {
+		if b.Round < bc.NextId {
+			delete(p.blocks, digest)
+		}
+	}
+	return true
+}
+
+func (p *pbft) startViewChange(view int) {
+	/*
+		This func stops taking part in the current view and asks to move
+		to the given one, with the block this trustee prepared, if any
+	*/
+
+	bc := p.bc
+	p.view = view
+	p.viewChanging = true
+	p.timeout *= 2
+	p.deadline = time.Now().Add(p.timeout)
+	fmt.Printf("%s ASKING FOR VIEW %d OF ELECTION %s\n", bc.Prefix, view, bc.ElectionName)
+
+	m := newVote(message.ConsensusViewChange, view, bc.NextId, p.preparedDigest)
+	m.Vote.Prepared = p.prepared
+	m.Prepares = p.preparedVotes
+	p.send(m)
+}
+
+func (p *pbft) followViewChanges() {
+	/*
+		This func moves to a later view
+		Step 0. Ask for it if more trustees than can be faulty ask for
+		        later views than ours
+		Step 1. Start it with a quorum of view changes if this trustee
+		        leads it
+		Step 2. Enter it if its leader started it
+	*/
+
+	bc := p.bc
+	seq := bc.NextId
+
+	/* Step 0 */
+	asking := make(map[int]int)
+	for key, vcs := range p.viewChanges {
+		if key.Seq != seq || key.View <= p.view {
+			continue
+		}
+		for index := range vcs {
+			if view, ok := asking[index]; !ok || key.View < view {
+				asking[index] = key.View
+			}
+		}
+	}
+	if len(asking) > message.FaultyTrustees(p.n) {
+		next := -1
+		for _, view := range asking {
+			if next < 0 || view < next {
+				next = view
+			}
+		}
+		p.startViewChange(next)
+	}
+
+	/* Step 1 */
+	key := viewSeq{p.view, seq}
+	vcs := p.viewChanges[key]
+	if p.viewChanging && !p.started[p.view] && len(vcs) >= p.quorum &&
+		message.ConsensusLeader(p.view, p.n) == p.trustee.Index {
+		p.started[p.view] = true
+
+		// Propose again the block prepared in the latest view
+		var latest *viewChange
+		views := make([]*message.ConsensusVote, 0, len(vcs))
+		for _, vc := range vcs {
+			views = append(views, vc.Vote)
+			if latest == nil || vc.Vote.Prepared > latest.Vote.Prepared {
+				latest = vc
+			}
+		}
+
+		m := newVote(message.ConsensusNewView, p.view, seq, latest.Vote.Digest)
+		m.Vote.Prepared = latest.Vote.Prepared
+		m.ViewChanges = views
+		m.Prepares = latest.Prepares
+		fmt.Printf("%s STARTING VIEW %d OF ELECTION %s\n", bc.Prefix, p.view, bc.ElectionName)
+		p.send(m)
+	}
+
+	/* Step 2 */
+	for key, m := range p.newViews {
+		if key.Seq != seq || key.View < p.view || (key.View == p.view && !p.viewChanging) {
+			continue
+		}
+
+		p.view = key.View
+		p.viewChanging = false
+		p.deadline = time.Now().Add(p.timeout)
+		if m.Vote.Digest != "" {
+			p.proposals[key] = m.Vote.Digest
+		}
+		fmt.Printf("%s ENTERING VIEW %d OF ELECTION %s\n", bc.Prefix, p.view, bc.ElectionName)
+	}
+}
+
+func (g *Gossiper) HandleSendingConsensus(sendCh chan *message.ConsensusMessage) {
+	/*
+		This func receives the messages of this trustee from underlying
+		blockchain layer and send them using gossiper's rumor mongering
+	*/
+
+	for m := range sendCh {
+		g.RumorBuffer.Mux.Lock()
+		m.Origin = g.Name
+		m.ID = uint32(len(g.RumorBuffer.Rumors[g.Name]) + 1)
+		if g.Auth != nil {
+			m.Proof = g.Auth.Provide()
+		}
+
+		wrappedMessage := &message.WrappedRumorTLCMessage{
+			ConsensusMessage: m,
+		}
+
+		// Store msg
+		g.StoreRumor(wrappedMessage)
+		g.RumorBuffer.Rumors[g.Name] = append(g.RumorBuffer.Rumors[g.Name], wrappedMessage)
+		g.RumorBuffer.Mux.Unlock()
+
+		// Update status
+		g.StatusBuffer.Mux.Lock()
+		if _, ok := g.StatusBuffer.Status[g.Name]; !ok {
+
+			g.StatusBuffer.Status[g.Name] = 2
+		} else {
+
+			g.StatusBuffer.Status[g.Name] += 1
+		}
+		g.StatusBuffer.Mux.Unlock()
+
+		g.MongerRumor(wrappedMessage, "", []string{})
+	}
+}
+
+func (g *Gossiper) HandleReceivingConsensus(wrapped_pkt *message.PacketIncome) {
+	/*
+		This func receive the messages of the trustees ordering the blocks
+		from communication layer
+		Step 0. Check validty of the message by authenticate the origin
+		Step 1. Monger the message if it is new
+		Step 2. Deliver it to the blockchain of its election
+	*/
+
+	sender, m := wrapped_pkt.Sender, wrapped_pkt.Packet.ConsensusMessage
+
+	/* Step 0 */
+	if g.Auth != nil && !g.Auth.Verify(m.Proof) {
+		fmt.Printf("REJECT CONSENSUS MESSAGE FROM %s: INVALID PROOF\n", m.Origin)
+		return
+	}
+
+	if m.Origin == g.Name {
+		return
+	}
+
+	/* Step 1 */
+	wrappedMessage := &message.WrappedRumorTLCMessage{
+		ConsensusMessage: m,
+	}
+	updated := g.Update(wrappedMessage, sender)
+
+	defer g.N.Send(&message.GossipPacket{
+		Status: g.StatusBuffer.ToStatusPacket(),
+	}, sender)
+
+	if !updated {
+		return
+	}
+	g.MongerRumor(wrappedMessage, "", []string{sender})
+
+	/* Step 2 */
+	g.GetOrCreateBlockchain(m.ElectionName).ConsensusCh <- m
+}
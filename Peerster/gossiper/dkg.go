@@ -0,0 +1,749 @@
+package gossiper
+
+// Distributed key generation among the trustees of an election, following
+// Pedersen's protocol with Feldman commitments and public complaints. No party
+// ever holds the election secret: each trustee ends up with a Shamir share of
+// it and the joint public key is reported back to the election server. The
+// trustees agree on the qualified dealers before combining their shares, so
+// that they all end up with shares of the same key.
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
+)
+
+const (
+	DKGPhaseTimeout     = 10 * time.Second
+	DKGComplaintTimeout = 5 * time.Second
+
+	// DefaultDKGResultAddress is where the key is reported when the
+	// election server doesn't say where.
+	DefaultDKGResultAddress = "http://127.0.0.1:8081/dkgresult"
+)
+
+type DKG struct {
+	Name    string
+	Started bool
+	Index   int          // index of this trustee, 1..N
+	N       int          // number of trustees
+	T       int          // threshold, degree of the polynomials plus one
+	Key     *message.Key // group parameters
+
+	// Questions is the JSON of the questions of the election the key is
+	// generated for.
+	Questions []byte
+
+	encSecret *big.Int   // secret of the ephemeral encryption key
+	poly      []*big.Int // coefficients of the polynomial of this dealer
+
+	Origins      map[int]string       // gossip origin of each trustee index
+	EncKeys      map[int]*big.Int     // ephemeral encryption keys by trustee
+	Commitments  map[int][]*big.Int   // Feldman commitments by dealer
+	Dealt        map[int]bool         // dealers whose deal was received
+	Shares       map[int]*big.Int     // valid shares for this trustee by dealer
+	Complaints   map[int]map[int]bool // accused dealer -> complaining trustees
+	Justified    map[int]map[int]bool // dealer -> complaints answered publicly
+	Disqualified map[int]bool
+	Proposals    map[int][]int // qualified dealers proposed by each trustee
+
+	// ResultAddress is where the generated key is reported.
+	ResultAddress string
+
+	Result *DKGResult // set once the key is generated
+
+	Pending []*message.DKGMessage // received before the DKG was started
+	Mux     sync.Mutex
+}
+
+// DKGResult is reported to the election server once the key is generated.
+type DKGResult struct {
+	Name      string       `json:"name"`
+	Index     int          `json:"index"`
+	PublicKey *message.Key `json:"public_key"`
+
+	// Trustees[i] is the public value g^x of the share of trustee i+1.
+	Trustees []*big.Int `json:"trustees"`
+
+	Qualified []int `json:"qualified"`
+
+	// PoK proves that the reporting trustee knows its share.
+	PoK *message.SchnorrProof `json:"pok"`
+}
+
+func (g *Gossiper) GetOrCreateDKG(electionName string) (dkg *DKG) {
+	/*
+		This function get or create the key generation state of an election
+	*/
+
+	g.DKGsMux.Lock()
+	if _, ok := g.DKGs[electionName]; !ok {
+		g.DKGs[electionName] = &DKG{
+			Name:         electionName,
+			Origins:      make(map[int]string),
+			EncKeys:      make(map[int]*big.Int),
+			Commitments:  make(map[int][]*big.Int),
+			Dealt:        make(map[int]bool),
+			Shares:       make(map[int]*big.Int),
+			Complaints:   make(map[int]map[int]bool),
+			Justified:    make(map[int]map[int]bool),
+			Disqualified: make(map[int]bool),
+			Proposals:    make(map[int][]int),
+			Pending:      make([]*message.DKGMessage, 0),
+		}
+	}
+	dkg = g.DKGs[electionName]
+	g.DKGsMux.Unlock()
+	return
+}
+
+func (g *Gossiper) StartDKG(elec message.Election, trustee *message.Trustee, resultAddress string) error {
+	/*
+		This func starts the key generation of this trustee for an election
+		and reports the key to resultAddress, or to DefaultDKGResultAddress if empty
+		Step 1. Check the parameters sent by the election server
+		Step 2. Draw the ephemeral key and the polynomial of this dealer
+		Step 3. Replay the messages received before the start
+	*/
+
+	/* Step 1 */
+	if err := elec.PublicKey.ValidateGroup(); err != nil {
+		return fmt.Errorf("invalid group parameters: %v", err)
+	}
+	if err := elec.ValidateQuestions(); err != nil {
+		return fmt.Errorf("invalid questions: %v", err)
+	}
+	questions, err := json.Marshal(elec.Questions)
+	if err != nil {
+		return err
+	}
+
+	n := len(elec.Trustees)
+	t := elec.ComputeThreshold()
+	if trustee == nil || trustee.Index < 1 || trustee.Index > n {
+		return errors.New("invalid trustee index")
+	}
+	if err := elec.CheckThreshold(); err != nil {
+		return err
+	}
+	if resultAddress == "" {
+		resultAddress = DefaultDKGResultAddress
+	}
+
+	dkg := g.GetOrCreateDKG(elec.Name)
+	dkg.Mux.Lock()
+	if dkg.Started {
+		dkg.Mux.Unlock()
+		return fmt.Errorf("key generation for election %s already started", elec.Name)
+	}
+
+	/* Step 2 */
+	key := elec.PublicKey.WithPublicValue(nil)
+
+	encSecret, err := rand.Int(rand.Reader, key.ExponentPrime)
+	if err != nil {
+		dkg.Mux.Unlock()
+		return err
+	}
+
+	poly := make([]*big.Int, t)
+	for k := range poly {
+		poly[k], err = rand.Int(rand.Reader, key.ExponentPrime)
+		if err != nil {
+			dkg.Mux.Unlock()
+			return err
+		}
+	}
+
+	dkg.Started = true
+	dkg.Index, dkg.N, dkg.T, dkg.Key = trustee.Index, n, t, key
+	dkg.encSecret, dkg.poly = encSecret, poly
+	dkg.Questions = questions
+	dkg.ResultAddress = resultAddress
+
+	/* Step 3 */
+	replies := make([]*message.DKGMessage, 0)
+	for _, m := range dkg.Pending {
+		if reply := dkg.handle(m); reply != nil {
+			replies = append(replies, reply)
+		}
+	}
+	dkg.Pending = nil
+	dkg.Mux.Unlock()
+
+	for _, reply := range replies {
+		g.SendDKGMessage(reply)
+	}
+
+	go g.RunDKG(dkg)
+	return nil
+}
+
+func (g *Gossiper) RunDKG(dkg *DKG) {
+	/*
+		This func drives the phases of the key generation
+		Step 1. Publish the ephemeral key and the commitments
+		Step 2. Wait for the keys of the other trustees
+		Step 3. Deal one encrypted share to every trustee
+		Step 4. Wait for the deals of the other trustees
+		Step 5. Complain against dealers without a valid share for us
+		Step 6. Let the accused dealers answer publicly
+		Step 7. Propose the dealers we found qualified
+		Step 8. Wait for enough trustees to decrypt to propose the same dealers
+		Step 9. Combine the shares of the agreed dealers, store our share and report
+	*/
+
+	/* Step 1 */
+	dkg.Mux.Lock()
+	group := dkg.Key.Group()
+	commitments := make([]string, len(dkg.poly))
+	for k, a := range dkg.poly {
+		commitments[k] = group.Exp(dkg.Key.Generator, a).String()
+	}
+	pok, err := message.NewSchnorrProof(dkg.poly[0], dkg.Key)
+	if err != nil {
+		dkg.Mux.Unlock()
+		fmt.Printf("DKG %s FAILED: %s\n", dkg.Name, err)
+		return
+	}
+	keyMsg := &message.DKGMessage{
+		ElectionName: dkg.Name,
+		Index:        dkg.Index,
+		Type:         message.DKGKey,
+		EncKey:       group.Exp(dkg.Key.Generator, dkg.encSecret).String(),
+		Commitments:  commitments,
+		PoK:          pok.BigInt2Str(),
+	}
+	dkg.Mux.Unlock()
+	g.SendDKGMessage(keyMsg)
+
+	/* Step 2 */
+	dkg.wait(func() bool { return len(dkg.EncKeys) == dkg.N }, DKGPhaseTimeout)
+
+	/* Step 3 */
+	dkg.Mux.Lock()
+	shares := make([]*message.EncryptedShare, 0)
+	for j, h := range dkg.EncKeys {
+		c1, c2, err := encryptShare(dkg.evalAt(j), h, dkg.Key)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		shares = append(shares, &message.EncryptedShare{
+			Index: j,
+			C1:    c1.String(),
+			C2:    c2.String(),
+		})
+	}
+	dealMsg := &message.DKGMessage{
+		ElectionName: dkg.Name,
+		Index:        dkg.Index,
+		Type:         message.DKGDeal,
+		Shares:       shares,
+	}
+	dkg.Mux.Unlock()
+	g.SendDKGMessage(dealMsg)
+
+	/* Step 4 */
+	dkg.wait(func() bool { return len(dkg.Dealt) == len(dkg.Commitments) }, DKGPhaseTimeout)
+
+	/* Step 5 */
+	dkg.Mux.Lock()
+	complaints := make([]*message.DKGMessage, 0)
+	for i := range dkg.Commitments {
+		if _, ok := dkg.Shares[i]; !ok {
+			complaints = append(complaints, &message.DKGMessage{
+				ElectionName: dkg.Name,
+				Index:        dkg.Index,
+				Type:         message.DKGComplaint,
+				Accused:      i,
+			})
+		}
+	}
+	dkg.Mux.Unlock()
+	for _, complaint := range complaints {
+		fmt.Printf("DKG %s COMPLAINT AGAINST TRUSTEE %d\n", dkg.Name, complaint.Accused)
+		g.SendDKGMessage(complaint)
+	}
+
+	/* Step 6 */
+	time.Sleep(DKGComplaintTimeout)
+
+	/* Step 7 */
+	dkg.Mux.Lock()
+	proposal := &message.DKGMessage{
+		ElectionName: dkg.Name,
+		Index:        dkg.Index,
+		Type:         message.DKGQualified,
+		Qualified:    dkg.qualify(),
+	}
+	dkg.Mux.Unlock()
+	g.SendDKGMessage(proposal)
+
+	/* Step 8 */
+	dkg.wait(func() bool { return dkg.agreed() != nil }, DKGPhaseTimeout)
+
+	/* Step 9 */
+	dkg.Mux.Lock()
+	var share *big.Int
+	var result *DKGResult
+	if qualified := dkg.agreed(); qualified != nil {
+		share, result, err = dkg.finalize(qualified)
+	} else {
+		err = fmt.Errorf("no %d trustees agree on the qualified dealers", dkg.T)
+	}
+	dkg.Mux.Unlock()
+	if err == nil {
+		result.PoK, err = message.NewSchnorrProof(share, dkg.Key)
+	}
+	if err != nil {
+		fmt.Printf("DKG %s FAILED: %s\n", dkg.Name, err)
+		return
+	}
+
+	dkg.Mux.Lock()
+	dkg.Result = result
+	dkg.Mux.Unlock()
+
+	// The share is lost with a restart unless it is stored before the
+	// key is reported
+	if err := g.StoreKeyShare(dkg, share); err != nil {
+		fmt.Printf("DKG %s FAILED: %s\n", dkg.Name, err)
+		return
+	}
+
+	g.DKGsMux.Lock()
+	g.PartialKeyMap[dkg.Name] = share
+	g.DKGsMux.Unlock()
+
+	fmt.Printf("DKG %s DONE WITH QUALIFIED DEALERS %v\n", dkg.Name, result.Qualified)
+
+	values := map[string]*DKGResult{"result": result}
+	jsonValue, _ := json.Marshal(values)
+	if _, err := http.Post(dkg.ResultAddress, "application/json", bytes.NewBuffer(jsonValue)); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// CheckElection checks that a frozen election carries the keys generated with
+// the other trustees, so that ballots are only accepted under those keys, and
+// the questions and the threshold the keys were generated for.
+func (dkg *DKG) CheckElection(elec *message.Election) error {
+	dkg.Mux.Lock()
+	defer dkg.Mux.Unlock()
+
+	if dkg.Result == nil {
+		return errors.New("key generation not done")
+	}
+
+	pk := elec.PublicKey
+	if pk == nil || pk.PublicValue == nil || !pk.SameGroup(dkg.Key) ||
+		pk.PublicValue.Cmp(dkg.Result.PublicKey.PublicValue) != 0 {
+		return errors.New("election key differs from the generated key")
+	}
+
+	// the questions must be frozen as they were defined
+	questions, err := json.Marshal(elec.Questions)
+	if err != nil || !bytes.Equal(questions, dkg.Questions) {
+		return errors.New("election questions differ from the ones the key was generated for")
+	}
+
+	if len(elec.Trustees) != len(dkg.Result.Trustees) {
+		return errors.New("wrong number of trustees")
+	}
+	if elec.ComputeThreshold() != dkg.T {
+		return errors.New("election threshold differs from the one the key was generated for")
+	}
+	for i, t := range elec.Trustees {
+		if t.Index != i+1 || t.PublicKey == nil || t.PublicKey.PublicValue == nil || !t.PublicKey.SameGroup(dkg.Key) ||
+			t.PublicKey.PublicValue.Cmp(dkg.Result.Trustees[i]) != 0 {
+			return fmt.Errorf("key of trustee %d differs from the generated key", t.Index)
+		}
+	}
+
+	return nil
+}
+
+func (g *Gossiper) SendDKGMessage(m *message.DKGMessage) {
+	/*
+		This func gossips a key generation message of this trustee
+		and delivers it locally as well
+	*/
+
+	g.RumorBuffer.Mux.Lock()
+	m.Origin = g.Name
+	m.ID = uint32(len(g.RumorBuffer.Rumors[g.Name]) + 1)
+	if g.Auth != nil {
+		m.Proof = g.Auth.Provide()
+	}
+
+	wrappedMessage := &message.WrappedRumorTLCMessage{
+		DKGMessage: m,
+	}
+
+	// Store msg
+	g.StoreRumor(wrappedMessage)
+	g.RumorBuffer.Rumors[g.Name] = append(g.RumorBuffer.Rumors[g.Name], wrappedMessage)
+	g.RumorBuffer.Mux.Unlock()
+
+	// Update status
+	g.StatusBuffer.Mux.Lock()
+	if _, ok := g.StatusBuffer.Status[g.Name]; !ok {
+
+		g.StatusBuffer.Status[g.Name] = 2
+	} else {
+
+		g.StatusBuffer.Status[g.Name] += 1
+	}
+	g.StatusBuffer.Mux.Unlock()
+
+	g.MongerRumor(wrappedMessage, "", []string{})
+	g.DeliverDKG(m)
+}
+
+func (g *Gossiper) HandleReceivingDKG(wrapped_pkt *message.PacketIncome) {
+	/*
+		This func receive key generation messages from communication layer
+		Step 0. Check validty of the message by authenticate the origin
+		Step 1. Monger the message if it is new
+		Step 2. Deliver it to the key generation of its election
+	*/
+
+	sender, dkgMsg := wrapped_pkt.Sender, wrapped_pkt.Packet.DKGMessage
+
+	/* Step 0 */
+	if g.Auth != nil && !g.Auth.Verify(dkgMsg.Proof) {
+		fmt.Printf("REJECT DKG MESSAGE FROM %s: INVALID PROOF\n", dkgMsg.Origin)
+		return
+	}
+
+	if dkgMsg.Origin == g.Name {
+		return
+	}
+
+	/* Step 1 */
+	wrappedMessage := &message.WrappedRumorTLCMessage{
+		DKGMessage: dkgMsg,
+	}
+	updated := g.Update(wrappedMessage, sender)
+
+	defer g.N.Send(&message.GossipPacket{
+		Status: g.StatusBuffer.ToStatusPacket(),
+	}, sender)
+
+	if !updated {
+		return
+	}
+	g.MongerRumor(wrappedMessage, "", []string{sender})
+
+	/* Step 2 */
+	g.DeliverDKG(dkgMsg)
+}
+
+func (g *Gossiper) DeliverDKG(m *message.DKGMessage) {
+	dkg := g.GetOrCreateDKG(m.ElectionName)
+
+	dkg.Mux.Lock()
+	if !dkg.Started {
+		dkg.Pending = append(dkg.Pending, m)
+		dkg.Mux.Unlock()
+		return
+	}
+	reply := dkg.handle(m)
+	dkg.Mux.Unlock()
+
+	if reply != nil {
+		g.SendDKGMessage(reply)
+	}
+}
+
+// handle updates the state with a message and returns the justification to
+// publish if the message is a complaint against this trustee. The caller must
+// hold dkg.Mux.
+func (dkg *DKG) handle(m *message.DKGMessage) *message.DKGMessage {
+	if m.Index < 1 || m.Index > dkg.N {
+		return nil
+	}
+
+	// A trustee index is bound to the first origin that used it.
+	if origin, ok := dkg.Origins[m.Index]; ok && origin != m.Origin {
+		fmt.Printf("DKG %s: %s IMPERSONATES TRUSTEE %d\n", dkg.Name, m.Origin, m.Index)
+		return nil
+	}
+	dkg.Origins[m.Index] = m.Origin
+
+	switch m.Type {
+	case message.DKGKey:
+		if _, ok := dkg.EncKeys[m.Index]; ok {
+			return nil
+		}
+
+		h := str2BigInt(m.EncKey)
+		if !dkg.Key.IsMember(h) || len(m.Commitments) != dkg.T {
+			dkg.Disqualified[m.Index] = true
+			return nil
+		}
+		commitments := make([]*big.Int, dkg.T)
+		for k, s := range m.Commitments {
+			commitments[k] = str2BigInt(s)
+			if !dkg.Key.IsMember(commitments[k]) {
+				dkg.Disqualified[m.Index] = true
+				return nil
+			}
+		}
+
+		if !m.PoK.Str2BigInt().Verify(commitments[0], dkg.Key) {
+			fmt.Printf("DKG %s: INVALID PROOF OF KNOWLEDGE FROM TRUSTEE %d\n", dkg.Name, m.Index)
+			dkg.Disqualified[m.Index] = true
+			return nil
+		}
+
+		dkg.EncKeys[m.Index] = h
+		dkg.Commitments[m.Index] = commitments
+
+	case message.DKGDeal:
+		commitments, ok := dkg.Commitments[m.Index]
+		if !ok || dkg.Dealt[m.Index] {
+			return nil
+		}
+		dkg.Dealt[m.Index] = true
+
+		for _, es := range m.Shares {
+			if es == nil || es.Index != dkg.Index {
+				continue
+			}
+			s := decryptShare(str2BigInt(es.C1), str2BigInt(es.C2), dkg.encSecret, dkg.Key)
+			if s != nil && verifyShare(s, commitments, dkg.Index, dkg.Key) {
+				dkg.Shares[m.Index] = s
+			}
+		}
+
+	case message.DKGComplaint:
+		if m.Accused < 1 || m.Accused > dkg.N {
+			return nil
+		}
+		if _, ok := dkg.Complaints[m.Accused]; !ok {
+			dkg.Complaints[m.Accused] = make(map[int]bool)
+		}
+		dkg.Complaints[m.Accused][m.Index] = true
+
+		// Answer a complaint against us by revealing the share publicly.
+		if m.Accused == dkg.Index && !dkg.Justified[dkg.Index][m.Index] {
+			return &message.DKGMessage{
+				ElectionName: dkg.Name,
+				Index:        dkg.Index,
+				Type:         message.DKGJustification,
+				Target:       m.Index,
+				Share:        dkg.evalAt(m.Index).String(),
+			}
+		}
+
+	case message.DKGJustification:
+		commitments, ok := dkg.Commitments[m.Index]
+		if !ok || m.Target < 1 || m.Target > dkg.N {
+			return nil
+		}
+
+		s := str2BigInt(m.Share)
+		if s == nil || !verifyShare(s, commitments, m.Target, dkg.Key) {
+			dkg.Disqualified[m.Index] = true
+			return nil
+		}
+
+		if _, ok := dkg.Justified[m.Index]; !ok {
+			dkg.Justified[m.Index] = make(map[int]bool)
+		}
+		dkg.Justified[m.Index][m.Target] = true
+		if m.Target == dkg.Index {
+			dkg.Shares[m.Index] = s
+		}
+
+	case message.DKGQualified:
+		if _, ok := dkg.Proposals[m.Index]; ok {
+			return nil
+		}
+
+		qualified := append([]int{}, m.Qualified...)
+		sort.Ints(qualified)
+		for k, i := range qualified {
+			if i < 1 || i > dkg.N || (k > 0 && qualified[k-1] == i) {
+				return nil
+			}
+		}
+		dkg.Proposals[m.Index] = qualified
+	}
+
+	return nil
+}
+
+// qualify returns the dealers this trustee found qualified, sorted: the
+// ones that published valid commitments and answered every complaint. The
+// caller must hold dkg.Mux.
+func (dkg *DKG) qualify() []int {
+	// A complaint that was not answered disqualifies the dealer.
+	for i, complainers := range dkg.Complaints {
+		for j := range complainers {
+			if !dkg.Justified[i][j] {
+				dkg.Disqualified[i] = true
+			}
+		}
+	}
+
+	qualified := make([]int, 0)
+	for i := range dkg.Commitments {
+		if !dkg.Disqualified[i] {
+			qualified = append(qualified, i)
+		}
+	}
+	sort.Ints(qualified)
+	return qualified
+}
+
+// agreed returns the qualified dealers proposed by at least T trustees, or nil
+// if there are none yet. Since T is a majority of the trustees, at most one
+// set of dealers can be agreed on. The caller must hold dkg.Mux.
+func (dkg *DKG) agreed() []int {
+	count := make(map[string]int)
+	for _, qualified := range dkg.Proposals {
+		key := fmt.Sprint(qualified)
+		count[key]++
+		if count[key] >= dkg.T {
+			return qualified
+		}
+	}
+	return nil
+}
+
+// finalize computes the share of this trustee and the public keys from the
+// agreed qualified dealers. The caller must hold dkg.Mux.
+func (dkg *DKG) finalize(qualified []int) (*big.Int, *DKGResult, error) {
+	if len(qualified) < dkg.T {
+		return nil, nil, fmt.Errorf("only %d qualified dealers, need %d", len(qualified), dkg.T)
+	}
+
+	group := dkg.Key.Group()
+	share := big.NewInt(0)
+	y := group.Identity()
+	for _, i := range qualified {
+		s, ok := dkg.Shares[i]
+		if !ok {
+			return nil, nil, fmt.Errorf("missing share of qualified dealer %d", i)
+		}
+		share.Add(share, s)
+		y = group.Mul(y, dkg.Commitments[i][0])
+	}
+	share.Mod(share, dkg.Key.ExponentPrime)
+
+	trustees := make([]*big.Int, dkg.N)
+	for j := 1; j <= dkg.N; j++ {
+		yj := group.Identity()
+		for _, i := range qualified {
+			yj = group.Mul(yj, commitmentAt(dkg.Commitments[i], j, dkg.Key))
+		}
+		trustees[j-1] = yj
+	}
+
+	result := &DKGResult{
+		Name:      dkg.Name,
+		Index:     dkg.Index,
+		PublicKey: dkg.Key.WithPublicValue(y),
+		Trustees:  trustees,
+		Qualified: qualified,
+	}
+	return share, result, nil
+}
+
+// wait polls cond under dkg.Mux until it holds or the timeout expires.
+func (dkg *DKG) wait(cond func() bool, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		dkg.Mux.Lock()
+		done := cond()
+		dkg.Mux.Unlock()
+		if done || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// evalAt computes the share f(j) of this dealer for trustee j.
+func (dkg *DKG) evalAt(j int) *big.Int {
+	x := big.NewInt(int64(j))
+	result := big.NewInt(0)
+	for k := len(dkg.poly) - 1; k >= 0; k-- {
+		result.Mul(result, x)
+		result.Add(result, dkg.poly[k])
+		result.Mod(result, dkg.Key.ExponentPrime)
+	}
+	return result
+}
+
+// commitmentAt computes g^f(j) = prod_k C_k^(j^k) from the commitments of a
+// dealer.
+func commitmentAt(commitments []*big.Int, j int, key *message.Key) *big.Int {
+	group := key.Group()
+	x := big.NewInt(int64(j))
+	power := big.NewInt(1)
+	result := group.Identity()
+	for _, c := range commitments {
+		result = group.Mul(result, group.Exp(c, power))
+		power.Mul(power, x)
+		power.Mod(power, key.ExponentPrime)
+	}
+	return result
+}
+
+// verifyShare checks a share for trustee j against the commitments of its
+// dealer.
+func verifyShare(s *big.Int, commitments []*big.Int, j int, key *message.Key) bool {
+	gs := key.Group().Exp(key.Generator, s)
+	return gs.Cmp(commitmentAt(commitments, j, key)) == 0
+}
+
+// shareMask derives a mask in Z_q from a shared Diffie-Hellman value.
+func shareMask(k *big.Int, key *message.Key) *big.Int {
+	h := sha256.Sum256([]byte(k.String()))
+	mask := new(big.Int).SetBytes(h[:])
+	return mask.Mod(mask, key.ExponentPrime)
+}
+
+// encryptShare hides s under the ephemeral key h with hashed ElGamal:
+// (g^r, s + H(h^r) mod q).
+func encryptShare(s *big.Int, h *big.Int, key *message.Key) (*big.Int, *big.Int, error) {
+	r, err := rand.Int(rand.Reader, key.ExponentPrime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	group := key.Group()
+	c1 := group.Exp(key.Generator, r)
+	c2 := new(big.Int).Add(s, shareMask(group.Exp(h, r), key))
+	return c1, c2.Mod(c2, key.ExponentPrime), nil
+}
+
+func decryptShare(c1 *big.Int, c2 *big.Int, secret *big.Int, key *message.Key) *big.Int {
+	if c1 == nil || c2 == nil || !key.IsMember(c1) {
+		return nil
+	}
+
+	s := new(big.Int).Sub(c2, shareMask(key.Group().Exp(c1, secret), key))
+	return s.Mod(s, key.ExponentPrime)
+}
+
+func str2BigInt(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,186 @@
+package gossiper
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
+)
+
+// newTestDKG starts the key generation of trustee index without a gossiper.
+func newTestDKG(t *testing.T, index int, n int, threshold int, key *message.Key) *DKG {
+	dkg := &DKG{
+		Name:         "election",
+		Started:      true,
+		Index:        index,
+		N:            n,
+		T:            threshold,
+		Key:          key,
+		Origins:      make(map[int]string),
+		EncKeys:      make(map[int]*big.Int),
+		Commitments:  make(map[int][]*big.Int),
+		Dealt:        make(map[int]bool),
+		Shares:       make(map[int]*big.Int),
+		Complaints:   make(map[int]map[int]bool),
+		Justified:    make(map[int]map[int]bool),
+		Disqualified: make(map[int]bool),
+		Proposals:    make(map[int][]int),
+	}
+
+	var err error
+	if dkg.encSecret, err = rand.Int(rand.Reader, key.ExponentPrime); err != nil {
+		t.Fatal(err)
+	}
+	dkg.poly = make([]*big.Int, threshold)
+	for k := range dkg.poly {
+		if dkg.poly[k], err = rand.Int(rand.Reader, key.ExponentPrime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dkg
+}
+
+// testMessage is a message of trustee dkg, as gossiped.
+func testMessage(dkg *DKG, typ string) *message.DKGMessage {
+	return &message.DKGMessage{
+		Origin:       fmt.Sprintf("trustee%d", dkg.Index),
+		ElectionName: dkg.Name,
+		Index:        dkg.Index,
+		Type:         typ,
+	}
+}
+
+// deliver hands m to every trustee.
+func deliver(dkgs []*DKG, m *message.DKGMessage) {
+	for _, dkg := range dkgs {
+		dkg.handle(m)
+	}
+}
+
+// deal runs the key generation of the trustees up to their proposals.
+func deal(t *testing.T, n int, threshold int) []*DKG {
+	key := message.NewEd25519Parameters()
+	group := key.Group()
+
+	dkgs := make([]*DKG, n)
+	for i := range dkgs {
+		dkgs[i] = newTestDKG(t, i+1, n, threshold, key)
+	}
+
+	for _, dkg := range dkgs {
+		m := testMessage(dkg, message.DKGKey)
+		m.EncKey = group.Exp(key.Generator, dkg.encSecret).String()
+		for _, a := range dkg.poly {
+			m.Commitments = append(m.Commitments, group.Exp(key.Generator, a).String())
+		}
+		pok, err := message.NewSchnorrProof(dkg.poly[0], key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.PoK = pok.BigInt2Str()
+		deliver(dkgs, m)
+	}
+
+	for _, dkg := range dkgs {
+		m := testMessage(dkg, message.DKGDeal)
+		for j, h := range dkg.EncKeys {
+			c1, c2, err := encryptShare(dkg.evalAt(j), h, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Shares = append(m.Shares, &message.EncryptedShare{Index: j, C1: c1.String(), C2: c2.String()})
+		}
+		deliver(dkgs, m)
+	}
+
+	return dkgs
+}
+
+func TestDKGAgreesOnQualifiedDealers(t *testing.T) {
+	dkgs := deal(t, 3, 2)
+
+	// trustee 3 missed the justification of dealer 2, the others did not
+	dkgs[2].Disqualified[2] = true
+
+	for k, dkg := range dkgs {
+		m := testMessage(dkg, message.DKGQualified)
+		m.Qualified = dkg.qualify()
+		deliver(dkgs, m)
+
+		// a single trustee can't decide for the others
+		if k == 0 && dkgs[1].agreed() != nil {
+			t.Fatal("agreed on the proposal of a single trustee")
+		}
+	}
+
+	results := make([]*DKGResult, len(dkgs))
+	shares := make([]*big.Int, len(dkgs))
+	for k, dkg := range dkgs {
+		qualified := dkg.agreed()
+		if fmt.Sprint(qualified) != "[1 2 3]" {
+			t.Fatalf("trustee %d agreed on %v", dkg.Index, qualified)
+		}
+
+		var err error
+		if shares[k], results[k], err = dkg.finalize(qualified); err != nil {
+			t.Fatalf("trustee %d: %s", dkg.Index, err)
+		}
+	}
+
+	key := dkgs[0].Key
+	for k, result := range results {
+		if result.PublicKey.PublicValue.Cmp(results[0].PublicKey.PublicValue) != 0 {
+			t.Fatalf("trustee %d generated another key", k+1)
+		}
+		if key.Group().Exp(key.Generator, shares[k]).Cmp(results[0].Trustees[k]) != 0 {
+			t.Fatalf("share of trustee %d is not the one of its public key", k+1)
+		}
+	}
+
+	// the shares of any two trustees recover the joint key
+	indices := []int{1, 3}
+	secret := big.NewInt(0)
+	for _, index := range indices {
+		lambda := message.LagrangeCoefficient(index, indices, key.ExponentPrime)
+		secret.Add(secret, new(big.Int).Mul(lambda, shares[index-1]))
+	}
+	secret.Mod(secret, key.ExponentPrime)
+	if key.Group().Exp(key.Generator, secret).Cmp(results[0].PublicKey.PublicValue) != 0 {
+		t.Fatal("the shares don't recover the joint key")
+	}
+}
+
+func TestDKGIgnoresInvalidProposals(t *testing.T) {
+	dkgs := deal(t, 3, 2)
+
+	for _, qualified := range [][]int{{1, 1, 2}, {0, 1}, {1, 4}} {
+		m := testMessage(dkgs[1], message.DKGQualified)
+		m.Qualified = qualified
+		dkgs[0].handle(m)
+		if _, ok := dkgs[0].Proposals[2]; ok {
+			t.Fatalf("accepted the proposal %v", qualified)
+		}
+	}
+
+	// a trustee proposes once
+	m := testMessage(dkgs[1], message.DKGQualified)
+	m.Qualified = []int{1, 2, 3}
+	dkgs[0].handle(m)
+	m = testMessage(dkgs[1], message.DKGQualified)
+	m.Qualified = []int{1, 3}
+	dkgs[0].handle(m)
+	if fmt.Sprint(dkgs[0].Proposals[2]) != "[1 2 3]" {
+		t.Fatalf("proposal of trustee 2 replaced by %v", dkgs[0].Proposals[2])
+	}
+
+	// nor can it propose for another trustee
+	m = testMessage(dkgs[1], message.DKGQualified)
+	m.Index = 3
+	m.Qualified = []int{1, 2, 3}
+	dkgs[0].handle(m)
+	if dkgs[0].agreed() != nil {
+		t.Fatal("agreed on a proposal made twice by the same trustee")
+	}
+}
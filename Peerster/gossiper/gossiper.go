@@ -59,7 +59,7 @@ type Gossiper struct {
 	BlockchainsMux    sync.Mutex
 	Auth              *Auth
 
-	// partial key mapping
+	// partial key mapping, guarded by DKGsMux
 	PartialKeyMap map[string]*big.Int
 
 	// Trustee mapping
@@ -67,6 +67,17 @@ type Gossiper struct {
 
 	// Election Map
 	ElectionMap map[string]message.Election
+
+	// Guards TrusteeMap and ElectionMap, written once an election is frozen
+	// and read by the handlers and the lifecycles of the elections
+	ElectionMapMux sync.Mutex
+
+	// Distributed key generations by election name
+	DKGs    map[string]*DKG
+	DKGsMux sync.Mutex
+
+	// Local store of the state to reload on restart, nil to keep it in memory only
+	Store *Store
 }
 
 // Gossiper start working
@@ -224,6 +235,14 @@ func (gossiper *Gossiper) StartHandling() {
 				// Pass the block to blockchain handler
 				fmt.Println("RECEVING BLOCKS")
 				go gossiper.HandleReceivingBlock(pkt)
+
+			case pkt.Packet.DKGMessage != nil:
+				// Handle key generation among the trustees
+				go gossiper.HandleReceivingDKG(pkt)
+
+			case pkt.Packet.ConsensusMessage != nil:
+				// Handle the ordering of blocks among the trustees
+				go gossiper.HandleReceivingConsensus(pkt)
 			}
 
 		}
@@ -278,11 +297,13 @@ func (g *Gossiper) StartHeartbeat() {
 
 		g.StatusBuffer.Mux.Lock()
 		g.RumorBuffer.Mux.Lock()
-		g.StatusBuffer.Status[g.Name] = 2
+		// A restarted peer goes on from the rumors it reloaded
+		initID := uint32(len(g.RumorBuffer.Rumors[g.Name]) + 1)
+		g.StatusBuffer.Status[g.Name] = initID + 1
 
 		rumor := &message.RumorMessage{
 			Origin: g.Name,
-			ID:     uint32(1),
+			ID:     initID,
 			Text:   "",
 		}
 		wrappedMessage := &message.WrappedRumorTLCMessage{
@@ -290,6 +311,7 @@ func (g *Gossiper) StartHeartbeat() {
 		}
 		// fmt.Printf("Initial rumor is %d", 1)
 
+		g.StoreRumor(wrappedMessage)
 		g.RumorBuffer.Rumors[g.Name] = append(g.RumorBuffer.Rumors[g.Name], wrappedMessage)
 		g.RumorBuffer.Mux.Unlock()
 		g.StatusBuffer.Mux.Unlock()
@@ -316,6 +338,7 @@ func (g *Gossiper) StartHeartbeat() {
 			wrappedMessage := &message.WrappedRumorTLCMessage{
 				RumorMessage: rumor,
 			}
+			g.StoreRumor(wrappedMessage)
 			g.RumorBuffer.Rumors[g.Name] = append(g.RumorBuffer.Rumors[g.Name], wrappedMessage)
 			g.StatusBuffer.Mux.Unlock()
 			g.RumorBuffer.Mux.Unlock()
@@ -2,12 +2,10 @@ package gossiper
 
 // Implemented by Liangwei and Fengyu
 import (
-	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/big"
 	"net/http"
 	"os"
 	"strings"
@@ -53,6 +51,8 @@ func (g *Gossiper) HandleGUI() {
 			Methods("POST", "OPTIONS")
 		r.HandleFunc("/vote", g.VoteHandler).
 			Methods("POST", "OPTIONS")
+		r.HandleFunc("/dkg", g.DKGHandler).
+			Methods("POST", "OPTIONS")
 		r.HandleFunc("/partialkey", g.PartialKeyHandler).
 			Methods("POST", "OPTIONS")
 		r.HandleFunc("/endvote", g.EndVote).
@@ -61,6 +61,8 @@ func (g *Gossiper) HandleGUI() {
 			Methods("POST", "OPTIONS")
 		r.HandleFunc("/getblockchain", g.HandleGetBlockchain).
 			Methods("GET")
+		r.HandleFunc("/ballot", g.BallotLookupHandler).
+			Methods("POST", "OPTIONS")
 		r.HandleFunc("/postblockchain", g.TestVote).
 			Methods("POST", "OPTIONS")
 		r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("../web/peerster/dist/"))))
@@ -369,20 +371,62 @@ func (g *Gossiper) VoteHandler(w http.ResponseWriter, r *http.Request) {
 
 	voteRes := csContainer.Vote
 
-	fmt.Println(voteRes)
-
 	fmt.Printf("GET VOTE FROM %s VOTING FOR %s \n", voteRes.VoterUuid, voteRes.VoteHash)
 
+	// Only ciphertexts and proofs may be stored and gossiped
+	if err := voteRes.Vote.CheckSealed(); err != nil {
+		fmt.Printf("REFUSING VOTE FROM %s: %s\n", voteRes.VoterUuid, err)
+		g.AckPost(false, w)
+		return
+	}
+
+	// Ballots are only taken while the voting is open
+	if err := g.CheckVoting(g.GetElectionName(voteRes.Vote.ElectionUuid)); err != nil {
+		fmt.Printf("REFUSING VOTE FROM %s: %s\n", voteRes.VoterUuid, err)
+		g.AckPost(false, w)
+		return
+	}
+
 	go g.HandleReceivingVote(&voteRes)
 
 	g.AckPost(true, w)
 }
 
+type DKGContainer struct {
+	Name  string           `json:"name"`
+	Trust *message.Trustee `json:"trust"`
+	Elec  message.Election `json:"elec"`
+
+	// Result is where the trustee reports the generated key
+	Result string `json:"result"`
+}
+
+func (g *Gossiper) DKGHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("wrong method")
+	}
+
+	var comingDKG struct {
+		DKG DKGContainer `json:"dkg"`
+	}
+
+	json.NewDecoder(r.Body).Decode(&comingDKG)
+
+	fmt.Printf("START KEY GENERATION FOR ELECTION %s\n", comingDKG.DKG.Name)
+
+	if err := g.StartDKG(comingDKG.DKG.Elec, comingDKG.DKG.Trust, comingDKG.DKG.Result); err != nil {
+		fmt.Println(err)
+		g.AckPost(false, w)
+		return
+	}
+
+	g.AckPost(true, w)
+}
+
 type PartialKeyContainer struct {
-	Name       string           `json:"name"`
-	PartialKey *big.Int         `json:"partialkey"`
-	Trust      *message.Trustee `json:"trust"`
-	Elec       message.Election `json:"elec"`
+	Name  string           `json:"name"`
+	Trust *message.Trustee `json:"trust"`
+	Elec  message.Election `json:"elec"`
 }
 
 func (g *Gossiper) PartialKeyHandler(w http.ResponseWriter, r *http.Request) {
@@ -397,27 +441,115 @@ func (g *Gossiper) PartialKeyHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewDecoder(r.Body).Decode(&comingPartialK)
 
 	name := comingPartialK.Partial.Name
-	partialK := comingPartialK.Partial.PartialKey
 	trustee := comingPartialK.Partial.Trust
 	elec := comingPartialK.Partial.Elec
 
 	fmt.Println(name)
-	fmt.Println(partialK)
 	fmt.Println(trustee)
 	fmt.Println(elec.Questions)
 
-	_, ok1 := g.PartialKeyMap[name]
-	_, ok2 := g.TrusteeMap[name]
-
-	if ok1 && ok2 {
+	if _, _, ok := g.GetTrustee(name); ok {
 		fmt.Printf("The partial key for election %s has been existed", name)
 		g.AckPost(true, w)
 		return
 	}
 
-	g.PartialKeyMap[name] = partialK
-	g.TrusteeMap[name] = trustee
-	g.ElectionMap[name] = elec
+	// The share comes from the key generation, check that the frozen
+	// election agrees with it.
+	g.DKGsMux.Lock()
+	partialK, ok := g.PartialKeyMap[name]
+	dkg := g.DKGs[name]
+	g.DKGsMux.Unlock()
+
+	if !ok || dkg == nil {
+		fmt.Printf("No key generated for election %s\n", name)
+		g.AckPost(false, w)
+		return
+	}
+
+	if err := dkg.CheckElection(&elec); err != nil {
+		fmt.Printf("Frozen election %s rejected: %s\n", name, err)
+		g.AckPost(false, w)
+		return
+	}
+
+	if trustee == nil || trustee.PublicKey == nil || trustee.PublicKey.PublicValue == nil ||
+		!trustee.PublicKey.SameGroup(elec.PublicKey) ||
+		trustee.PublicKey.Group().Exp(trustee.PublicKey.Generator, partialK).Cmp(trustee.PublicKey.PublicValue) != 0 {
+		fmt.Printf("Trustee key of election %s does not match the generated share\n", name)
+		g.AckPost(false, w)
+		return
+	}
+
+	// Reject rogue keys: every trustee that proved its key must have proved
+	// it correctly, this trustee must have proved its own in the election,
+	// and the election is only frozen once a threshold of trustees did. The
+	// trustees that did not prove their key yet get it later, see indServer.
+	if trustee.PoK == nil {
+		fmt.Printf("Trustee %d of election %s has no proof of its key\n", trustee.Index, name)
+		g.AckPost(false, w)
+		return
+	}
+	if err := trustee.VerifyPoK(); err != nil {
+		fmt.Println(err)
+		g.AckPost(false, w)
+		return
+	}
+	proved := 0
+	provedSelf := false
+	for _, t := range elec.Trustees {
+		if t.PoK == nil {
+			fmt.Printf("Trustee %d of election %s has not proved its key yet\n", t.Index, name)
+			continue
+		}
+		if err := t.VerifyPoK(); err != nil {
+			fmt.Println(err)
+			g.AckPost(false, w)
+			return
+		}
+		proved++
+		provedSelf = provedSelf || t.Index == trustee.Index
+	}
+	if !provedSelf {
+		fmt.Printf("Election %s has no proof of the key of trustee %d\n", name, trustee.Index)
+		g.AckPost(false, w)
+		return
+	}
+	if proved < elec.Threshold {
+		fmt.Printf("Election %s is frozen with %d proofs of the keys of its trustees, %d needed\n", name, proved, elec.Threshold)
+		g.AckPost(false, w)
+		return
+	}
+
+	// the voting is opened and closed at the times of the frozen election
+	if err := elec.ValidateTimes(); err != nil {
+		fmt.Println(err)
+		g.AckPost(false, w)
+		return
+	}
+
+	// ballots are checked against the hash of the frozen election
+	if err := elec.ComputeHash(); err != nil {
+		fmt.Println(err)
+		g.AckPost(false, w)
+		return
+	}
+	fmt.Printf("ELECTION %s FROZEN WITH HASH %s\n", name, elec.ElectionHash)
+
+	// the election is acknowledged once it is stored
+	if err := g.StoreElection(name, elec, trustee); err != nil {
+		fmt.Println(err)
+		g.AckPost(false, w)
+		return
+	}
+
+	if !g.AddElection(name, elec, trustee) {
+		fmt.Printf("The partial key for election %s has been existed", name)
+		g.AckPost(true, w)
+		return
+	}
+	g.GetOrCreateBlockchain(name).SetElection(&elec, trustee, partialK)
+	go g.RunLifecycle(name)
 
 	g.AckPost(true, w)
 }
@@ -446,41 +578,26 @@ func (g *Gossiper) EndVote(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Println(electionToEnd)
 
-	CastMessage := g.Blockchains[electionToEnd].GetCastBallots()
-
-	fmt.Println(CastMessage)
-
-	Container := CastMessage
-	fmt.Println(Container)
-
-	// find election
-	elec, _ := g.ElectionMap[electionToEnd]
-
-	trustee, _ := g.TrusteeMap[electionToEnd]
+	g.BlockchainsMux.Lock()
+	bc, ok := g.Blockchains[electionToEnd]
+	g.BlockchainsMux.Unlock()
 
-	PartialKey, _ := g.PartialKeyMap[electionToEnd]
-
-	elec.Tally(Container, trustee, PartialKey)
-
-	trustee.Election = electionToEnd
-
-	// send it to the tallier
-	tallyAddress := "http://127.0.0.1:8082/tally"
-
-	tallycon := TallyContainer{
-		Src:     g.GuiPort,
-		Vote:    Container,
-		Trustee: trustee,
-		Elec:    elec,
+	if !ok {
+		g.AckPost(false, w)
+		return
 	}
 
-	fmt.Println(tallycon)
-
-	values := map[string]TallyContainer{"tally": tallycon}
-	jsonValue, _ := json.Marshal(values)
-	resp, _ := http.Post(tallyAddress, "application/json", bytes.NewBuffer(jsonValue))
-
-	fmt.Println(resp)
+	// the tally starts once the trustees agree to it, after they agreed
+	// that the voting is closed, see RunLifecycle
+	switch state, _ := bc.GetState(); state {
+	case message.StateClosed:
+		g.ProposeTransition(bc, message.NewTransition(state, time.Now()))
+	case message.StateTallying, message.StatePublished:
+	default:
+		fmt.Printf("ELECTION %s IS %s, NOT CLOSED\n", electionToEnd, state)
+		g.AckPost(false, w)
+		return
+	}
 
 	g.AckPost(true, w)
 }
@@ -540,6 +657,33 @@ func (g *Gossiper) HandleGetBlockchain(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(blocks)
 }
 
+// BallotLookupHandler looks a ballot up by its tracker in the blockchain of an
+// election, and returns a proof that it is included.
+func (g *Gossiper) BallotLookupHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+
+	var lookup struct {
+		Elec    string `json:"elec"`
+		Tracker string `json:"tracker"`
+	}
+	json.NewDecoder(r.Body).Decode(&lookup)
+
+	var response struct {
+		Found bool                    `json:"found"`
+		Proof *message.InclusionProof `json:"proof"`
+	}
+
+	g.BlockchainsMux.Lock()
+	bc, ok := g.Blockchains[lookup.Elec]
+	g.BlockchainsMux.Unlock()
+
+	if ok {
+		response.Proof, response.Found = bc.ProveInclusion(lookup.Tracker)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
 func (g *Gossiper) TestVote(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		panic("Wrong Methods")
@@ -0,0 +1,145 @@
+package gossiper
+
+// Lifecycle of a frozen election on a trustee. The trustee proposes each
+// transition of the election in its blockchain when it is due, and acts on
+// the state the transitions recorded in the blockchain move the election to,
+// so that all the trustees open, close and tally the election together.
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
+)
+
+const (
+	LifecyclePollInterval = time.Second
+	TallyAddress          = "http://127.0.0.1:8082/tally"
+)
+
+func (g *Gossiper) RunLifecycle(name string) {
+	/*
+		This func follows the election through its states
+		Frozen:   propose to open the voting once its window starts, or
+		          give up if it ended before the voting was opened
+		Open:     propose to close the voting once its window ends
+		Tallying: send our share of the tally, then propose to publish it,
+		          sending it again at the next poll if it failed
+		The election is closed until the tally is asked for, see EndVote
+	*/
+
+	elec, _ := g.GetElection(name)
+	start, end, err := elec.VotingWindow()
+	if err != nil {
+		fmt.Printf("ELECTION %s HAS NO VOTING WINDOW: %s\n", name, err)
+		return
+	}
+
+	bc := g.GetOrCreateBlockchain(name)
+	tallied := false
+	for {
+		now := time.Now()
+		state, _ := bc.GetState()
+		switch state {
+		case message.StateFrozen:
+			if !now.Before(end) {
+				fmt.Printf("ELECTION %s WAS NOT OPENED BEFORE ITS VOTING WINDOW ENDED\n", name)
+				return
+			}
+			if !now.Before(start) {
+				g.ProposeTransition(bc, message.NewTransition(state, now))
+			}
+		case message.StateOpen:
+			if !now.Before(end) {
+				g.ProposeTransition(bc, message.NewTransition(state, now))
+			}
+		case message.StateTallying:
+			if !tallied {
+				if err := g.SendTally(name); err != nil {
+					fmt.Printf("TALLY OF %s FAILED: %s\n", name, err)
+					break
+				}
+				tallied = true
+			}
+			g.ProposeTransition(bc, message.NewTransition(state, now))
+		case message.StatePublished:
+			fmt.Printf("ELECTION %s PUBLISHED\n", name)
+			return
+		}
+
+		time.Sleep(LifecyclePollInterval)
+	}
+}
+
+func (g *Gossiper) ProposeTransition(bc *Blockchain, t *message.Transition) {
+	/*
+		This func proposes a transition of the election, and forwards it
+		to the other trustees if it is new, so that the leader proposes it
+		even if its clock is late
+	*/
+
+	if bc.Propose(t) {
+		bc.SendCh <- &message.Block{
+			Origin:       g.Name,
+			ElectionName: bc.ElectionName,
+			Transition:   t,
+		}
+	}
+}
+
+func (g *Gossiper) SendTally(name string) error {
+	/*
+		This func tallies the ballots of the election recorded in our
+		blockchain and sends our share of the tally to the tallier
+		The ballots of the mixnet questions are mixed in turn, then
+		decrypted one by one
+	*/
+
+	elec, ok := g.GetElection(name)
+	if !ok {
+		return errors.New("unknown election")
+	}
+
+	CastMessage := g.GetOrCreateBlockchain(name).GetCastBallots(&elec)
+
+	Container := CastMessage
+
+	trusteeOf, PartialKey, ok := g.GetTrustee(name)
+	if !ok {
+		return errors.New("not a trustee of the election")
+	}
+
+	// the decryption factors are computed on our own copy of the trustee
+	trustee := &message.Trustee{}
+	*trustee = *trusteeOf
+
+	if err := elec.Tally(Container, trustee, PartialKey); err != nil {
+		return err
+	}
+
+	trustee.Election = name
+
+	tallycon := TallyContainer{
+		Src:     g.GuiPort,
+		Vote:    Container,
+		Trustee: trustee,
+		Elec:    elec,
+	}
+
+	values := map[string]TallyContainer{"tally": tallycon}
+	jsonValue, _ := json.Marshal(values)
+	resp, err := http.Post(TallyAddress, "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if elec.HasMixnet() {
+		go g.RunMix(elec, Container, trustee, PartialKey)
+	}
+
+	return nil
+}
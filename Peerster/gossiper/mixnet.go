@@ -0,0 +1,241 @@
+package gossiper
+
+// Mixing of the ballots for the mixnet questions of an election. The trustees
+// mix in the order of their indices on the board of the tallier, where every
+// mix is published with its shuffle proof, and each trustee checks the whole
+// board against its own blockchain before adding to it. A trustee only
+// decrypts a mix cascade that includes its own shuffle, so that the
+// decryption of a ballot can't be traced back to its voter.
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
+)
+
+const (
+	// MixTurnTimeout is how long a trustee waits for each trustee before it
+	// to mix, after which it mixes without them.
+	MixTurnTimeout    = 30 * time.Second
+	MixPollInterval   = time.Second
+	MixBoardAddress   = "http://127.0.0.1:8082/mixes"
+	MixAddress        = "http://127.0.0.1:8082/mix"
+	MixDecryptAddress = "http://127.0.0.1:8082/mixdecrypt"
+)
+
+// MixBoard is the state of the board of an election, as published by the
+// tallier.
+type MixBoard struct {
+	Input  [][]*message.Ciphertext `json:"input"`
+	Mixes  []*message.Mix          `json:"mixes"`
+	Closed bool                    `json:"closed"`
+}
+
+func (g *Gossiper) RunMix(elec message.Election, votes []*message.CastBallot, trustee *message.Trustee, secret *big.Int) {
+	/*
+		This func takes the turn of the trustee in the mix of an election
+		Step 1. Compute the ballots to mix from our blockchain
+		Step 2. Wait for the trustees before us to mix
+		Step 3. Mix the output of the last mix and publish it
+		Step 4. Wait for the trustees after us to mix
+		Step 5. Publish our decryption factors for the output of the last mix
+	*/
+
+	/* Step 1 */
+	input := elec.MixInput(votes)
+	n := len(elec.Trustees)
+
+	/* Step 2 */
+	// with no ballots, there is nothing to hide
+	mixed := len(input) == 0
+	deadline := time.Now().Add(time.Duration(trustee.Index-1) * MixTurnTimeout)
+	for !mixed {
+		board, last, err := g.FetchMixBoard(&elec, input)
+		if err != nil {
+			fmt.Printf("MIX %s FAILED: %s\n", elec.Name, err)
+			return
+		}
+		if board == nil {
+			// the tallier has not received the votes yet
+			if time.Now().After(deadline.Add(MixTurnTimeout)) {
+				fmt.Printf("MIX %s FAILED: NO BOARD\n", elec.Name)
+				return
+			}
+			time.Sleep(MixPollInterval)
+			continue
+		}
+		if board.Closed || mixedBy(board, trustee.Index) {
+			break
+		}
+
+		before := 0
+		for _, mix := range board.Mixes {
+			if mix.Index < trustee.Index {
+				before++
+			}
+		}
+		if before < trustee.Index-1 && time.Now().Before(deadline) {
+			time.Sleep(MixPollInterval)
+			continue
+		}
+
+		/* Step 3 */
+		mix, err := message.NewMix(trustee.Index, last, elec.PublicKey)
+		if err != nil {
+			fmt.Printf("MIX %s FAILED: %s\n", elec.Name, err)
+			return
+		}
+
+		values := map[string]interface{}{"elec": elec.Name, "mix": mix}
+		var ack struct {
+			Success bool `json:"success"`
+		}
+		if err := postJSON(MixAddress, values, &ack); err != nil {
+			fmt.Println(err)
+		}
+
+		// the board may have moved on while we were mixing, in which
+		// case we mix again
+		mixed = ack.Success
+		if mixed {
+			fmt.Printf("MIX %s PUBLISHED BY TRUSTEE %d\n", elec.Name, trustee.Index)
+		}
+	}
+
+	/* Step 4 */
+	deadline = time.Now().Add(time.Duration(n-trustee.Index) * MixTurnTimeout)
+	for {
+		board, last, err := g.FetchMixBoard(&elec, input)
+		if err != nil {
+			fmt.Printf("MIX %s FAILED: %s\n", elec.Name, err)
+			return
+		}
+
+		if board == nil {
+			if time.Now().After(deadline.Add(MixTurnTimeout)) {
+				fmt.Printf("MIX %s FAILED: NO BOARD\n", elec.Name)
+				return
+			}
+			time.Sleep(MixPollInterval)
+			continue
+		}
+
+		done := board.Closed || len(input) == 0 || len(board.Mixes) == n || time.Now().After(deadline)
+		if !done {
+			time.Sleep(MixPollInterval)
+			continue
+		}
+
+		/* Step 5 */
+		if len(input) > 0 && !mixedBy(board, trustee.Index) {
+			fmt.Printf("MIX %s IS NOT DECRYPTED: TRUSTEE %d DIDN'T MIX\n", elec.Name, trustee.Index)
+			return
+		}
+
+		decryptor := *trustee
+		if err := decryptor.ComputeDecryptionFactors(last, secret); err != nil {
+			fmt.Printf("MIX %s FAILED: %s\n", elec.Name, err)
+			return
+		}
+
+		values := map[string]interface{}{
+			"elec":    elec.Name,
+			"src":     g.GuiPort,
+			"round":   len(board.Mixes),
+			"trustee": &decryptor,
+		}
+		var ack struct {
+			Success bool `json:"success"`
+		}
+		if err := postJSON(MixDecryptAddress, values, &ack); err != nil {
+			fmt.Println(err)
+		}
+
+		// the board was closed on another round before ours arrived
+		if !ack.Success && !board.Closed && time.Now().Before(deadline.Add(MixTurnTimeout)) {
+			time.Sleep(MixPollInterval)
+			continue
+		}
+
+		fmt.Printf("MIX %s DECRYPTED BY TRUSTEE %d: %t\n", elec.Name, trustee.Index, ack.Success)
+		return
+	}
+}
+
+// FetchMixBoard gets the board of the election from the tallier and checks
+// it: its input must be the ballots of our blockchain and every mix must be a
+// valid shuffle. It returns a nil board if the tallier has none yet, and the
+// output of the last mix.
+func (g *Gossiper) FetchMixBoard(elec *message.Election, input [][]*message.Ciphertext) (*MixBoard, [][]*message.Ciphertext, error) {
+	var reply struct {
+		Exist bool      `json:"exist"`
+		Board *MixBoard `json:"board"`
+	}
+	if err := postJSON(MixBoardAddress, map[string]string{"elec": elec.Name}, &reply); err != nil {
+		// the tallier may not be up yet
+		fmt.Println(err)
+		return nil, nil, nil
+	}
+	if !reply.Exist || reply.Board == nil {
+		return nil, nil, nil
+	}
+
+	if !sameBallots(reply.Board.Input, input) {
+		return nil, nil, errors.New("the board doesn't mix the ballots of our blockchain")
+	}
+
+	last, err := elec.VerifyMixes(input, reply.Board.Mixes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return reply.Board, last, nil
+}
+
+func mixedBy(board *MixBoard, index int) bool {
+	for _, mix := range board.Mixes {
+		if mix.Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+func sameBallots(a [][]*message.Ciphertext, b [][]*message.Ciphertext) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for k := range a[i] {
+			if a[i][k] == nil || a[i][k].Alpha == nil || a[i][k].Beta == nil ||
+				a[i][k].Alpha.Cmp(b[i][k].Alpha) != 0 || a[i][k].Beta.Cmp(b[i][k].Beta) != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func postJSON(address string, values interface{}, reply interface{}) error {
+	jsonValue, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(address, "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
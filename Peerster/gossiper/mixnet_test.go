@@ -0,0 +1,98 @@
+package gossiper
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
+)
+
+// testBoard returns ballots to mix under an election of two trustees, and a
+// board where both mixed them, as the tallier publishes it.
+func testBoard(t *testing.T) (*message.Election, [][]*message.Ciphertext, *MixBoard) {
+	params := message.NewEd25519Parameters()
+	secret, err := rand.Int(rand.Reader, params.ExponentPrime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := params.WithPublicValue(params.Group().Exp(params.Generator, secret))
+	elec := &message.Election{
+		Name:      "election",
+		PublicKey: pk,
+		Trustees:  []*message.Trustee{{Index: 1}, {Index: 2}},
+	}
+
+	input := make([][]*message.Ciphertext, 3)
+	for i := range input {
+		c, _, _, err := message.Encrypt(i%2 == 0, pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input[i] = []*message.Ciphertext{c}
+	}
+
+	first, err := message.NewMix(1, input, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := message.NewMix(2, first.Output, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js, err := json.Marshal(&MixBoard{Input: input, Mixes: []*message.Mix{first, second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	board := &MixBoard{}
+	if err := json.Unmarshal(js, board); err != nil {
+		t.Fatal(err)
+	}
+
+	return elec, input, board
+}
+
+func TestMixBoardChecks(t *testing.T) {
+	elec, input, board := testBoard(t)
+
+	// the shuffle proofs survive the trip through the tallier
+	if !sameBallots(board.Input, input) {
+		t.Fatal("the board doesn't mix the ballots it was given")
+	}
+	last, err := elec.VerifyMixes(input, board.Mixes)
+	if err != nil {
+		t.Fatalf("honest board: %s", err)
+	}
+	if !sameBallots(last, board.Mixes[1].Output) {
+		t.Fatal("the output is not the one of the last mix")
+	}
+
+	if !mixedBy(board, 1) || !mixedBy(board, 2) || mixedBy(board, 3) {
+		t.Fatal("wrong trustees mixed the board")
+	}
+}
+
+func TestMixBoardTampered(t *testing.T) {
+	elec, input, board := testBoard(t)
+
+	// a board that drops or changes a ballot of our blockchain
+	if sameBallots(board.Input[1:], input) {
+		t.Error("a dropped ballot passes")
+	}
+	changed := append([][]*message.Ciphertext{}, board.Input...)
+	changed[0] = []*message.Ciphertext{{Alpha: changed[0][0].Alpha, Beta: big.NewInt(1)}}
+	if sameBallots(changed, input) {
+		t.Error("a changed ballot passes")
+	}
+	if sameBallots([][]*message.Ciphertext{{nil}, input[1], input[2]}, input) {
+		t.Error("a missing ciphertext passes")
+	}
+
+	// a mix whose output was replaced after its proof
+	board.Mixes[1].Output[0], board.Mixes[1].Output[1] = board.Mixes[1].Output[1], board.Mixes[1].Output[0]
+	if _, err := elec.VerifyMixes(input, board.Mixes); err == nil {
+		t.Error("a tampered mix passes")
+	}
+}
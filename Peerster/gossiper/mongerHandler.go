@@ -97,10 +97,18 @@ func (g *Gossiper) MongerRumor(wrappedMessage *message.WrappedRumorTLCMessage, t
 		toSendPkt = &message.GossipPacket{
 			TLCMessage: wrappedMessage.TLCMessage,
 		}
-	} else {
+	} else if wrappedMessage.BlockRumorMessage != nil {
 		toSendPkt = &message.GossipPacket{
 			BlockRumorMessage: wrappedMessage.BlockRumorMessage,
 		}
+	} else if wrappedMessage.DKGMessage != nil {
+		toSendPkt = &message.GossipPacket{
+			DKGMessage: wrappedMessage.DKGMessage,
+		}
+	} else {
+		toSendPkt = &message.GossipPacket{
+			ConsensusMessage: wrappedMessage.ConsensusMessage,
+		}
 	}
 	g.N.Send(toSendPkt, peerAddr)
 }
@@ -4,23 +4,35 @@ package gossiper
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"math/rand"
+	"math/big"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/TRUMANCFY/DSEProject/Peerster/message"
 )
 
+const (
+	// MaxBlockBallots is the most ballots a block holds, and MaxBlockBytes
+	// about the most bytes they take, so that a block fits in a packet
+	MaxBlockBallots = 32
+	MaxBlockBytes   = 12 * 1024
+
+	// BlockTimeSlice is how long the leader waits for more ballots before
+	// it proposes a block that is not full
+	BlockTimeSlice = 500 * time.Millisecond
+)
+
 type Blockchain struct {
 
 	// Blocks
 	Blocks   []*message.Block
 	BlockMux sync.Mutex
 
-	// Number of Peers
+	// Number of trustees ordering the blocks
 	N int
 
 	// Next index of block to be added
@@ -36,20 +48,34 @@ type Blockchain struct {
 	// Send channel for candidate blocks
 	SendCh chan *message.Block
 
-	// Receive channel for candidate blocks
-	ReceiveCh chan *message.Block
+	// Channels of the messages of the trustees ordering the blocks,
+	// received from and sent to the other trustees
+	ConsensusCh     chan *message.ConsensusMessage
+	ConsensusSendCh chan *message.ConsensusMessage
 
 	// Origin
 	Origin string
 
-	// Round map
-	Map    map[string]map[int]bool
-	MapMux sync.Mutex
-
-	// Voter map
+	// Ballots seen in blocks of peers, by record key
 	VoterMap    map[string]string
 	VoterMapMux sync.Mutex
 
+	// Revote policy of the election, first-wins until the election is known
+	Revote string
+
+	// Election once it is frozen, and its state, which the transitions
+	// recorded in the blockchain move it from
+	Election *message.Election
+	State    string
+
+	// Transitions of the election to propose, ahead of the ballots
+	Transitions []*message.Transition
+
+	// Trustee of this peer and its share of the election key, which it
+	// signs its votes on the blocks with
+	Trustee *message.Trustee
+	Share   *big.Int
+
 	// Election Name
 	ElectionName string
 
@@ -58,12 +84,9 @@ type Blockchain struct {
 
 	// String record of blocks
 	Records []string
-}
 
-func Rand() uint64 {
-	buf := make([]byte, 8)
-	rand.Read(buf) // Always succeeds, no need to check error
-	return binary.LittleEndian.Uint64(buf)
+	// Store of the blocks and the buffered ballots, nil to keep them in memory only
+	Store *Store
 }
 
 func (g *Gossiper) NewBlockchain(electionName string) (bc *Blockchain) {
@@ -72,25 +95,27 @@ func (g *Gossiper) NewBlockchain(electionName string) (bc *Blockchain) {
 	*/
 	// Create the channel
 	bc = &Blockchain{
-		Blocks:       make([]*message.Block, 0),
-		NextId:       0,
-		Buffer:       make([]*message.CastBallot, 0),
-		InputCh:      make(chan *message.CastBallot, 0),
-		SendCh:       make(chan *message.Block, 0),
-		ReceiveCh:    make(chan *message.Block, 0),
-		N:            g.NumPeers,
-		Origin:       g.Name,
-		Map:          make(map[string]map[int]bool),
-		VoterMap:     make(map[string]string),
-		ElectionName: electionName,
-		Records:      make([]string, 0),
+		Blocks:          make([]*message.Block, 0),
+		NextId:          0,
+		Buffer:          make([]*message.CastBallot, 0),
+		InputCh:         make(chan *message.CastBallot, 0),
+		SendCh:          make(chan *message.Block, 0),
+		ConsensusCh:     make(chan *message.ConsensusMessage, ConsensusChannelSize),
+		ConsensusSendCh: make(chan *message.ConsensusMessage, 0),
+		N:               g.NumPeers,
+		Origin:          g.Name,
+		VoterMap:        make(map[string]string),
+		Revote:          message.RevoteFirst,
+		State:           message.StateDraft,
+		ElectionName:    electionName,
+		Records:         make([]string, 0),
+		Store:           g.Store,
 	}
 
 	// Add genesis block
 	genesisBlock := &message.Block{
 		PrevHash:     sha256.Sum256(make([]byte, 0)),
 		CurrentHash:  sha256.Sum256(make([]byte, 0)),
-		CastBallot:   nil,
 		ElectionName: bc.ElectionName,
 	}
 	bc.BlockMux.Lock()
@@ -98,10 +123,10 @@ func (g *Gossiper) NewBlockchain(electionName string) (bc *Blockchain) {
 	bc.BlockMux.Unlock()
 	bc.NextId = 1
 
-	// Set random seed
-	seedHash := sha256.Sum256([]byte(g.Name))
-	seed := binary.BigEndian.Uint64(seedHash[:])
-	rand.Seed(int64(seed))
+	// Reload the blocks and the ballots stored before a restart
+	if err := bc.Load(); err != nil {
+		panic(fmt.Sprintf("cannot load blockchain of election %s: %s", electionName, err))
+	}
 
 	// Start working
 	go bc.HandleRound()
@@ -115,107 +140,273 @@ func (bc *Blockchain) CheckBlockValidty(b *message.Block) bool {
 	return bytes.Compare(b.PrevHash[:], bc.Blocks[len(bc.Blocks)-1].CurrentHash[:]) == 0
 }
 
-func (bc *Blockchain) HandleRound() {
+func (bc *Blockchain) SetElection(elec *message.Election, trustee *message.Trustee, share *big.Int) {
 	/*
-		This function handle rounds of adding blocks into the blockchain
+		This func sets the election of the blockchain once it is frozen:
+		its revote policy, its trustees and the key this peer signs its
+		votes with, and its state, from which it moves by the transitions
+		recorded in the blockchain
 	*/
 
-	voters := make(map[string]bool)
-	for {
-		bc.BufferMux.Lock()
-		if len(bc.Buffer) > 0 {
-			// Get the first Vote that has not been recorded in the blockchain to propagate
-			var currentVote *message.CastBallot
-			nextBufferIndex := 0
-			var valid bool
-
-			// Check whether there is valid vote to propogate
-			for _, currentVote = range bc.Buffer {
-				valid = true
-				if _, ok := voters[currentVote.VoterUuid]; ok {
-					valid = false
-				}
-				if valid {
-					break
-				} else {
-					nextBufferIndex += 1
-				}
-			}
-			if nextBufferIndex > len(bc.Buffer) {
-				bc.Buffer = bc.Buffer[0:0]
-			} else {
-				bc.Buffer = bc.Buffer[nextBufferIndex:]
-			}
-			if !valid {
-				// No valid block vote to propose
-				bc.BufferMux.Unlock()
-				time.Sleep(50 * time.Millisecond)
-				continue
-			}
-			bc.BufferMux.Unlock()
-			fmt.Printf("%s THE RECORD TO BE PROPOSED HAS VOTERID %s\n", bc.Prefix, currentVote.VoterUuid)
-
-			// Create the block
-			currentBlock := &message.Block{
-				CastBallot:   currentVote,
-				PrevHash:     bc.Blocks[len(bc.Blocks)-1].CurrentHash,
-				Fitness:      Rand(),
-				Round:        bc.NextId,
-				Origin:       bc.Origin,
-				ElectionName: bc.ElectionName,
-			}
-			currentBlock.CurrentHash = currentBlock.Hash()
-
-			// Ask the gossiper to send the block
-			bc.SendCh <- currentBlock
-
-			// Wait for all peers' proposals
-			count := 1
-			// fmt.Printf("OUR FITNESS IS %d\n", currentBlock.Fitness)
-			receivedMap := make(map[string]bool)
-			for {
-				// Update self's block if peer's block is valid and has higher fitness value
-				peerBlock := <-bc.ReceiveCh
-				if _, ok := receivedMap[peerBlock.Origin]; !ok {
-					receivedMap[peerBlock.Origin] = true
-				} else {
-					continue
-				}
-				// fmt.Printf("Peer fitness is %d for round %d\n", peerBlock.Fitness, peerBlock.Round)
-				if bc.CheckBlockValidty(peerBlock) && peerBlock.Fitness > currentBlock.Fitness {
-					currentBlock = peerBlock
-				}
-				count += 1
-				fmt.Printf("%s RECEIVED %d proposals\n", bc.Prefix, count)
-				if count == bc.N {
-					break
-				}
-			}
+	bc.VoterMapMux.Lock()
+	bc.Revote = elec.ComputeRevote()
+	bc.VoterMapMux.Unlock()
 
-			// Add the consensus block to the blockchain
-			if _, ok := voters[currentBlock.CastBallot.VoterUuid]; ok {
-				continue
-			} else {
-				voters[currentBlock.CastBallot.VoterUuid] = true
-			}
+	bc.BlockMux.Lock()
+	bc.Election = elec
+	bc.N = len(elec.Trustees)
+	bc.Trustee = trustee
+	bc.Share = share
+	if bc.State == message.StateDraft {
+		bc.State = message.StateFrozen
+	}
+	bc.BlockMux.Unlock()
+}
 
-			bc.BlockMux.Lock()
-			bc.Blocks = append(bc.Blocks, currentBlock)
-			bc.Records = append(bc.Records, currentBlock.ToString())
-			bc.BlockMux.Unlock()
-
-			fmt.Printf("%s    APPENDING BLOCK WITH VOTER UID %s, VOTE HASH %s FOR ELECTION %s\n",
-				bc.Prefix,
-				currentBlock.CastBallot.VoterUuid,
-				currentBlock.CastBallot.VoteHash,
-				currentBlock.ElectionName)
-			bc.NextId += 1
-			fmt.Printf("%s ENTERING ROUND %d FOR ELECTION %s\n\n", bc.Prefix, bc.NextId, bc.ElectionName)
-		} else {
-			bc.BufferMux.Unlock()
-			time.Sleep(50 * time.Millisecond)
+func (bc *Blockchain) GetState() (state string, elec *message.Election) {
+	/*
+		This func returns the state of the election and the election,
+		nil if it is not frozen yet
+	*/
+
+	bc.BlockMux.Lock()
+	defer bc.BlockMux.Unlock()
+	return bc.State, bc.Election
+}
+
+func (bc *Blockchain) TakesBallots() bool {
+	/*
+		This func returns true if ballots can be recorded: while the
+		election is open, or at any time for test votes of elections
+		that are not frozen
+	*/
+
+	state, elec := bc.GetState()
+	return elec == nil || state == message.StateOpen
+}
+
+func (bc *Blockchain) Propose(t *message.Transition) bool {
+	/*
+		This func adds a transition of the election to propose,
+		unless it is already pending, and returns true if it is added
+	*/
+
+	bc.BufferMux.Lock()
+	defer bc.BufferMux.Unlock()
+
+	for _, pending := range bc.Transitions {
+		if pending.From == t.From && pending.To == t.To {
+			return false
+		}
+	}
+	bc.Transitions = append(bc.Transitions, t)
+	return true
+}
+
+func (bc *Blockchain) CheckProposal(b *message.Block) error {
+	/*
+		This func checks that the block proposed by a peer can be
+		recorded in the current state of the election
+	*/
+
+	state, elec := bc.GetState()
+	if b.Transition != nil {
+		if elec == nil {
+			return fmt.Errorf("election %s is not frozen", bc.ElectionName)
+		}
+		return elec.CheckTransition(b.Transition, state, time.Now())
+	}
+
+	if !bc.TakesBallots() {
+		return fmt.Errorf("election %s is %s", bc.ElectionName, state)
+	}
+	return nil
+}
+
+func (bc *Blockchain) CheckBallot(cb *message.CastBallot, recorded map[string]bool) error {
+	/*
+		This func checks that a ballot can be recorded in the blockchain:
+		it doesn't reveal the vote, it is the vote its tracker is computed
+		on, its voter is on the roll of the election and it is not recorded
+		yet
+	*/
+
+	if cb == nil || cb.Vote == nil {
+		return fmt.Errorf("missing ballot")
+	}
+	if err := cb.Vote.CheckSealed(); err != nil {
+		return err
+	}
+	if err := cb.CheckTrackerStr(); err != nil {
+		return err
+	}
+
+	if _, elec := bc.GetState(); elec != nil {
+		if err := elec.CheckEligibility(cb); err != nil {
+			return err
+		}
+	}
+
+	if recorded[bc.RecordKey(cb)] {
+		return fmt.Errorf("ballot of voter %s already recorded", cb.VoterUuid)
+	}
+	return nil
+}
+
+func (bc *Blockchain) CheckCandidate(b *message.Block, recorded map[string]bool) error {
+	/*
+		This func checks that a block proposed by the leader can be
+		appended to the blockchain: it follows the head, its hash is
+		computed from its content, and its transition or its ballot can be
+		recorded in the current state of the election
+	*/
+
+	if b.ElectionName != bc.ElectionName {
+		return fmt.Errorf("block of election %s", b.ElectionName)
+	}
+
+	bc.BlockMux.Lock()
+	valid := bc.CheckBlockValidty(b)
+	bc.BlockMux.Unlock()
+	if !valid || b.CurrentHash != b.Hash() {
+		return fmt.Errorf("block doesn't follow the head of the blockchain")
+	}
+
+	if (b.Transition == nil) == (len(b.CastBallots) == 0) {
+		return fmt.Errorf("block must hold either a transition or ballots")
+	}
+	if len(b.CastBallots) > MaxBlockBallots {
+		return fmt.Errorf("block holds more than %d ballots", MaxBlockBallots)
+	}
+	if err := bc.CheckProposal(b); err != nil {
+		return err
+	}
+
+	keys := make(map[string]bool)
+	for _, cb := range b.CastBallots {
+		if err := bc.CheckBallot(cb, recorded); err != nil {
+			return err
+		}
+		key := bc.RecordKey(cb)
+		if keys[key] {
+			return fmt.Errorf("ballot of voter %s recorded twice in the block", cb.VoterUuid)
+		}
+		keys[key] = true
+	}
+	return nil
+}
+
+func (bc *Blockchain) RecordKey(cb *message.CastBallot) string {
+	/*
+		This func returns the key under which a ballot is recorded once:
+		its voter if only the first ballot of a voter is recorded, or the
+		ballot itself if every ballot of a voter is recorded
+	*/
+
+	bc.VoterMapMux.Lock()
+	defer bc.VoterMapMux.Unlock()
+
+	if bc.Revote == message.RevoteFirst {
+		return cb.VoterUuid
+	}
+	return cb.VoteHash
+}
+
+func (bc *Blockchain) RecordedKeys() map[string]bool {
+	/*
+		This func returns the record keys of the ballots in the blockchain
+	*/
+
+	bc.BlockMux.Lock()
+	defer bc.BlockMux.Unlock()
+
+	recorded := make(map[string]bool)
+	for _, b := range bc.Blocks {
+		for _, cb := range b.CastBallots {
+			recorded[bc.RecordKey(cb)] = true
+		}
+	}
+	return recorded
+}
+
+func (bc *Blockchain) NextProposal(recorded map[string]bool) (*message.Block, bool) {
+	/*
+		This func returns the block to propose in this round, if any,
+		and whether it is full:
+		a pending transition of the election first, or else the ballots
+		of the buffer that can be recorded, in order, up to MaxBlockBallots
+		of them taking up to MaxBlockBytes, if ballots can be recorded
+		The ballots that can't be recorded are dropped from the buffer
+	*/
+
+	bc.BufferMux.Lock()
+	defer bc.BufferMux.Unlock()
+
+	bc.BlockMux.Lock()
+	head := bc.Blocks[len(bc.Blocks)-1].CurrentHash
+	bc.BlockMux.Unlock()
+
+	block := &message.Block{
+		PrevHash:     head,
+		Round:        bc.NextId,
+		Origin:       bc.Origin,
+		ElectionName: bc.ElectionName,
+	}
+
+	// Transitions from an earlier state are already recorded
+	state, _ := bc.GetState()
+	for len(bc.Transitions) > 0 && bc.Transitions[0].From != state {
+		bc.Transitions = bc.Transitions[1:]
+	}
+	if len(bc.Transitions) > 0 {
+		block.Transition = bc.Transitions[0]
+		block.CurrentHash = block.Hash()
+		return block, true
+	}
+
+	if !bc.TakesBallots() {
+		// Ballots of a closed election are never recorded
+		if state != message.StateFrozen {
+			bc.Buffer = bc.Buffer[0:0]
 		}
+		return nil, false
 	}
+
+	// Get the Votes that have not been recorded in the blockchain to propagate
+	remaining := make([]*message.CastBallot, 0, len(bc.Buffer))
+	keys := make(map[string]bool)
+	size := 0
+	full := false
+	for _, currentVote := range bc.Buffer {
+		if err := bc.CheckBallot(currentVote, recorded); err != nil {
+			continue
+		}
+		remaining = append(remaining, currentVote)
+
+		// A ballot under the same record key waits for a later block
+		recordKey := bc.RecordKey(currentVote)
+		if full || keys[recordKey] {
+			continue
+		}
+
+		js, _ := json.Marshal(currentVote)
+		if len(block.CastBallots) > 0 && size+len(js) > MaxBlockBytes {
+			full = true
+			continue
+		}
+		keys[recordKey] = true
+		size += len(js)
+		block.CastBallots = append(block.CastBallots, currentVote)
+		full = len(block.CastBallots) == MaxBlockBallots
+	}
+	bc.Buffer = remaining
+
+	if len(block.CastBallots) == 0 {
+		// No valid block vote to propose
+		return nil, false
+	}
+	block.CurrentHash = block.Hash()
+	return block, full
 }
 
 func (bc *Blockchain) CreateBallot(voterid, vote, electionName string) (v *message.CastBallot) {
@@ -246,6 +437,7 @@ func (g *Gossiper) GetOrCreateBlockchain(electionName string) (bc *Blockchain) {
 	if _, ok := g.Blockchains[electionName]; !ok {
 		bc = g.NewBlockchain(electionName)
 		go g.HandleSendingBlocks(bc.SendCh)
+		go g.HandleSendingConsensus(bc.ConsensusSendCh)
 		g.Blockchains[electionName] = bc
 	}
 	bc = g.Blockchains[electionName]
@@ -280,6 +472,7 @@ func (g *Gossiper) HandleSendingBlocks(sendCh chan *message.Block) {
 		}
 
 		// Store msg
+		g.StoreRumor(wrappedMessage)
 		g.RumorBuffer.Rumors[g.Name] = append(g.RumorBuffer.Rumors[g.Name], wrappedMessage)
 		g.RumorBuffer.Mux.Unlock()
 
@@ -296,23 +489,22 @@ func (g *Gossiper) HandleSendingBlocks(sendCh chan *message.Block) {
 		g.StatusBuffer.Mux.Unlock()
 
 		// Monger block
-		fmt.Printf("PROPOSING BLOCK WITH VOTER %s VOTE %s IN ROUND %d FOR ELECTION %s\n",
-			block.CastBallot.VoterUuid,
-			block.CastBallot.VoteHash,
-			block.Round,
-			block.ElectionName)
+		fmt.Printf("FORWARDING BLOCK %s\n", block.ToString())
 		g.MongerRumor(wrappedMessage, "", []string{})
 	}
 }
 
 func (g *Gossiper) HandleReceivingBlock(wrapped_pkt *message.PacketIncome) {
 	/*
-		This func receive blocks from communication layer
-		and inform blockchain layer with the right election name
-		Step 0. Check validty of the block by authenticate the origin
-		Step 1. Add the vote to corresponding blockchain buffer if it is empty
-		Step 2. Inform the blockchain of the vote
-		Step 3. Monger the block if necessary
+		This func receive candidate blocks from communication layer,
+		which trustees forward so that every trustee knows the ballots
+		and the transitions the leader has to propose
+		Step 0. Check validty of the block by authenticate the origin,
+		        and that its ballots don't reveal the vote and are the
+		        votes their trackers are computed on
+		Step 1. Monger the block if it is new
+		Step 2. Add the vote, or the transition of the election, to corresponding
+		        blockchain buffer if it is not there yet
 	*/
 
 	sender, blockRumor := wrapped_pkt.Sender, wrapped_pkt.Packet.BlockRumorMessage
@@ -325,23 +517,32 @@ func (g *Gossiper) HandleReceivingBlock(wrapped_pkt *message.PacketIncome) {
 			return
 		}
 	}
+	if blockRumor.Block == nil {
+		return
+	}
+	if (blockRumor.Block.Transition == nil) == (len(blockRumor.Block.CastBallots) == 0) {
+		return
+	}
+	if blockRumor.Block.CheckBallots() != nil {
+		return
+	}
+	for _, cb := range blockRumor.Block.CastBallots {
+		if cb.Vote.CheckSealed() != nil {
+			return
+		}
+	}
 
-	/* Step 1 */
 	b := blockRumor.Block
 	// Get or Create the corresponding blockchain
 	bc := g.GetOrCreateBlockchain(b.ElectionName)
 
-	// Reject block from future
-	if b.Round > bc.NextId {
-		return
-	}
-
 	// Reject block from self
 	peerOrigin := blockRumor.Origin
 	if peerOrigin == g.Name {
 		return
 	}
 
+	/* Step 1 */
 	// Check whether block has been seen before
 	updated := g.Update(&message.WrappedRumorTLCMessage{
 		BlockRumorMessage: blockRumor,
@@ -353,51 +554,67 @@ func (g *Gossiper) HandleReceivingBlock(wrapped_pkt *message.PacketIncome) {
 
 	if updated {
 
-		// Monger it to peer if the block is in last round or this round
-		if b.Round >= bc.NextId-1 {
-			wrappedMessage := &message.WrappedRumorTLCMessage{
-				BlockRumorMessage: blockRumor,
-			}
-			g.MongerRumor(wrappedMessage, "", []string{sender})
+		wrappedMessage := &message.WrappedRumorTLCMessage{
+			BlockRumorMessage: blockRumor,
 		}
+		g.MongerRumor(wrappedMessage, "", []string{sender})
 
-		// Not update blockchain buffer if the block is not for current round
-		if b.Round != bc.NextId {
+		/* Step 2 */
+		// Propose the transition as well if it is due
+		if b.Transition != nil {
+			if err := bc.CheckProposal(b); err != nil {
+				fmt.Printf("%s NOT PROPOSING TRANSITION TO %s: %s\n", b.ElectionName, b.Transition.To, err)
+			} else {
+				bc.Propose(b.Transition)
+			}
 			return
 		}
 
-		fmt.Printf("ACCEPT RECEVING BLOCK VOTER %s VOTING %s IN ELECTION %s FOR ROUND %d FROM PEER %s\n",
-			b.CastBallot.VoterUuid,
-			b.CastBallot.VoteHash,
-			b.ElectionName,
-			b.Round,
-			b.Origin)
-
-		// Check whether the record for the voter already existed in the blockchain
-		bc.VoterMapMux.Lock()
-		var existed bool
-		if _, ok := bc.VoterMap[b.CastBallot.VoterUuid]; !ok {
-			bc.VoterMap[b.CastBallot.VoterUuid] = b.CastBallot.VoteHash
-			existed = false
-		} else {
-			if bc.VoterMap[b.CastBallot.VoterUuid] != b.CastBallot.VoteHash {
-				// Find conflicting record for the same voter
-				fmt.Printf("ERROR: RECEIVE CONFLICTING VOTE FOR VOTER %s\n", b.CastBallot.VoterUuid)
-				g.LogConflict(b.CastBallot.VoterUuid)
+		for _, cb := range b.CastBallots {
+			fmt.Printf("ACCEPT RECEVING BLOCK VOTER %s VOTING %s IN ELECTION %s FROM PEER %s\n",
+				cb.VoterUuid,
+				cb.VoteHash,
+				b.ElectionName,
+				b.Origin)
+
+			// Check whether the record for the ballot already existed in the blockchain,
+			// a different ballot of the same voter is a revote if revotes are recorded
+			recordKey := bc.RecordKey(cb)
+			bc.VoterMapMux.Lock()
+			var existed bool
+			if _, ok := bc.VoterMap[recordKey]; !ok {
+				bc.VoterMap[recordKey] = cb.VoteHash
+				existed = false
+			} else {
+				if bc.VoterMap[recordKey] != cb.VoteHash {
+					// Find conflicting record for the same voter
+					fmt.Printf("ERROR: RECEIVE CONFLICTING VOTE FOR VOTER %s\n", cb.VoterUuid)
+					g.LogConflict(cb.VoterUuid)
+				}
+				existed = true
 			}
-			existed = true
-		}
-		bc.VoterMapMux.Unlock()
+			bc.VoterMapMux.Unlock()
 
-		// Add it to buffer if not existed
-		bc.BufferMux.Lock()
-		if !existed {
-			bc.Buffer = append(bc.Buffer, b.CastBallot)
-		}
-		bc.BufferMux.Unlock()
+			// Only buffer the ballots of voters on the roll, while the election is open
+			if !existed && !bc.TakesBallots() {
+				fmt.Printf("%s NOT BUFFERING VOTER %s: election is not open\n", b.ElectionName, cb.VoterUuid)
+				existed = true
+			}
+			if elec, ok := g.GetElection(g.GetElectionName(cb.Vote.ElectionUuid)); ok && !existed {
+				if err := elec.CheckEligibility(cb); err != nil {
+					fmt.Printf("%s NOT BUFFERING VOTER %s: %s\n", b.ElectionName, cb.VoterUuid, err)
+					existed = true
+				}
+			}
 
-		// Step 2
-		bc.ReceiveCh <- b
+			// Add it to buffer if not existed
+			bc.BufferMux.Lock()
+			if !existed {
+				bc.StoreBallot(cb)
+				bc.Buffer = append(bc.Buffer, cb)
+			}
+			bc.BufferMux.Unlock()
+		}
 	}
 
 	return
@@ -406,44 +623,219 @@ func (g *Gossiper) HandleReceivingBlock(wrapped_pkt *message.PacketIncome) {
 func (g *Gossiper) HandleReceivingVote(v *message.CastBallot) {
 	/*
 		This func add the vote to the corresponding blockchain's buffer
-		Step 0. Convert big int to string in cast ballot
-		Step 1. Get or Create the corresponding blockchain
-		Step 2. Add the vote to the blockchain's buffer
+		Step 0. Verify that the voting is open, the vote and the eligibility
+		        of its voter against the frozen election, if known
+		Step 1. Convert big int to string in cast ballot
+		Step 2. Get or Create the corresponding blockchain
+		Step 3. Add the vote to the blockchain's buffer, once it is stored
+		Step 4. Forward it to the other trustees, which hold the leader to
+		        propose it
 	*/
 
 	/* Step 0 */
-	v.BigInt2Str()
+	if v.Vote == nil {
+		return
+	}
+	electionName := g.GetElectionName(v.Vote.ElectionUuid)
+	if elec, ok := g.GetElection(electionName); ok {
+		if err := g.CheckVoting(electionName); err != nil {
+			fmt.Printf("%s REJECTING VOTER %s: %s\n", electionName, v.VoterUuid, err)
+			return
+		}
+
+		if err := elec.CheckEligibility(v); err != nil {
+			fmt.Printf("%s REJECTING VOTER %s: %s\n", electionName, v.VoterUuid, err)
+			return
+		}
+
+		if err := v.Vote.Verify(&elec); err != nil {
+			fmt.Printf("%s REJECTING VOTER %s: %s\n", electionName, v.VoterUuid, err)
+			return
+		}
+
+		// the vote hash is the tracker the voter will look the ballot up by
+		if tracker, err := v.Vote.Tracker(); err != nil || tracker != v.VoteHash {
+			fmt.Printf("%s REJECTING VOTER %s: wrong tracker\n", electionName, v.VoterUuid)
+			return
+		}
+	}
 
 	/* Step 1 */
-	electionName := v.Vote.ElectionUuid
-	bc := g.GetOrCreateBlockchain(electionName)
+	v.BigInt2Str()
 
 	/* Step 2 */
+	bc := g.GetOrCreateBlockchain(electionName)
+
+	/* Step 3 */
 	bc.BufferMux.Lock()
 	fmt.Printf("%s BUFFERING VOTER %s\n", bc.ElectionName, v.VoterUuid)
+	bc.StoreBallot(v)
 	bc.Buffer = append(bc.Buffer, v)
 	bc.BufferMux.Unlock()
+
+	/* Step 4 */
+	bc.SendCh <- &message.Block{
+		Origin:       g.Name,
+		ElectionName: bc.ElectionName,
+		CastBallots:  []*message.CastBallot{v},
+	}
 	return
 }
 
-func (bc *Blockchain) GetCastBallots() (castBallots []*message.CastBallot) {
+func (g *Gossiper) CheckVoting(electionName string) error {
 	/*
-		This func returns a slice of pointer to cast ballots
-		The string representation of big.Int in cast ballots are converted back to big.Int
+		This func checks that the voting of the election is open: it is in
+		its window, and the trustees agreed to open it and not to close it yet
+		Test votes of unknown elections are always taken
+	*/
+
+	elec, ok := g.GetElection(electionName)
+	if !ok {
+		return nil
+	}
+
+	if err := elec.CheckWindow(time.Now()); err != nil {
+		return err
+	}
+
+	bc := g.GetOrCreateBlockchain(electionName)
+	if state, _ := bc.GetState(); state != message.StateOpen {
+		return fmt.Errorf("election %s is %s", electionName, state)
+	}
+	return nil
+}
+
+func (g *Gossiper) GetElectionName(uuid string) string {
+	/*
+		This func returns the name of the election with the given uuid,
+		blockchains are indexed by election name.
+		Ballots for unknown elections (e.g. test votes) use the uuid as name
+	*/
+
+	g.ElectionMapMux.Lock()
+	defer g.ElectionMapMux.Unlock()
+
+	for name, elec := range g.ElectionMap {
+		if elec.Uuid == uuid {
+			return name
+		}
+	}
+	return uuid
+}
+
+func (g *Gossiper) GetElection(name string) (elec message.Election, ok bool) {
+	/*
+		This func returns the frozen election of the given name, if any
+	*/
+
+	g.ElectionMapMux.Lock()
+	defer g.ElectionMapMux.Unlock()
+
+	elec, ok = g.ElectionMap[name]
+	return
+}
+
+func (g *Gossiper) GetTrustee(name string) (trustee *message.Trustee, share *big.Int, ok bool) {
+	/*
+		This func returns the trustee of this peer in the frozen election of
+		the given name and its share of the election key, if any
+	*/
+
+	g.ElectionMapMux.Lock()
+	trustee = g.TrusteeMap[name]
+	g.ElectionMapMux.Unlock()
+
+	g.DKGsMux.Lock()
+	share = g.PartialKeyMap[name]
+	g.DKGsMux.Unlock()
+
+	return trustee, share, trustee != nil && share != nil
+}
+
+func (g *Gossiper) AddElection(name string, elec message.Election, trustee *message.Trustee) bool {
+	/*
+		This func records the frozen election of the given name and the
+		trustee of this peer in it, and returns false if it is already
+		recorded
+	*/
+
+	g.ElectionMapMux.Lock()
+	defer g.ElectionMapMux.Unlock()
+
+	if _, ok := g.TrusteeMap[name]; ok {
+		return false
+	}
+	g.TrusteeMap[name] = trustee
+	g.ElectionMap[name] = elec
+	return true
+}
+
+func (bc *Blockchain) ProveInclusion(tracker string) (*message.InclusionProof, bool) {
+	/*
+		This func looks for the ballot with the given tracker in the blockchain
+		and returns the audit path of the ballot in its block, and the digests
+		of all blocks, from which the chain up to the current head can be
+		recomputed
 	*/
 
-	castBallots = make([]*message.CastBallot, bc.NextId-1)
 	bc.BlockMux.Lock()
-	for i := 1; i < len(bc.Blocks); i += 1 {
+	defer bc.BlockMux.Unlock()
 
-		castBallots[i-1] = bc.Blocks[i].CastBallot
+	proof := &message.InclusionProof{
+		Election: bc.ElectionName,
+		Tracker:  tracker,
+		Links:    make([]string, 0, len(bc.Blocks)-1),
+	}
+	for i := 1; i < len(bc.Blocks); i += 1 {
+		digest := bc.Blocks[i].Digest()
+		proof.Links = append(proof.Links, hex.EncodeToString(digest[:]))
+		for j, cb := range bc.Blocks[i].CastBallots {
+			if cb.VoteHash == tracker && proof.Round == 0 {
+				proof.Round = i
+				proof.Index = j
+				proof.Size = len(bc.Blocks[i].CastBallots)
+				proof.Path = bc.Blocks[i].BallotPath(j)
+				proof.VoterHash = cb.VoterHash
+				proof.Signature = cb.Signature
+			}
+		}
 	}
-	for _, cb := range castBallots {
-		cb.Str2BigInt()
+
+	head := bc.Blocks[len(bc.Blocks)-1].CurrentHash
+	proof.Head = hex.EncodeToString(head[:])
+	return proof, proof.Round != 0
+}
+
+func (bc *Blockchain) GetCastBallots(elec *message.Election) (castBallots []*message.CastBallot) {
+	/*
+		This func returns a slice of pointer to the cast ballots that count
+		The string representation of big.Int in cast ballots are converted back to big.Int,
+		on copies of the ballots, so that the tally can be done again
+		Only the ballots recorded while the election was open count
+		Under last-wins only the latest valid ballot of each voter is returned,
+		the ones it superseded stay in the blockchain
+	*/
+
+	castBallots = make([]*message.CastBallot, 0, bc.NextId-1)
+	bc.BlockMux.Lock()
+	state := message.StateFrozen
+	for i := 1; i < len(bc.Blocks); i += 1 {
+		if t := bc.Blocks[i].Transition; t != nil {
+			state = t.To
+			continue
+		}
+		if bc.Election != nil && state != message.StateOpen {
+			continue
+		}
+		for _, cb := range bc.Blocks[i].CastBallots {
+			if copied, err := cb.CopyStr2BigInt(); err == nil {
+				castBallots = append(castBallots, copied)
+			}
+		}
 	}
 	bc.BlockMux.Unlock()
 
-	return
+	return elec.SelectBallots(castBallots, elec.VerifyBallots(castBallots))
 }
 
 func (g *Gossiper) LogAttack(blockRumor *message.BlockRumorMessage) {
@@ -451,11 +843,18 @@ func (g *Gossiper) LogAttack(blockRumor *message.BlockRumorMessage) {
 		This func log attacked in the block
 	*/
 
+	// a transition of the election has no voter
+	voters := make([]string, 0, len(blockRumor.Block.CastBallots))
+	for _, cb := range blockRumor.Block.CastBallots {
+		voters = append(voters, cb.VoterUuid)
+	}
+	voter := strings.Join(voters, " ")
+
 	errorPrefix := "ERROR: "
 	errorString := fmt.Sprintf("%s FAKE POST IN ELECTION %s FOR VOTER %s FROM %s \n",
 		errorPrefix,
 		blockRumor.Block.ElectionName,
-		blockRumor.Block.CastBallot.VoterUuid,
+		voter,
 		blockRumor.Block.Origin)
 
 	g.BlockAttackLog = append(g.BlockAttackLog, errorString)
@@ -0,0 +1,533 @@
+package gossiper
+
+// Local store of the state of a peer that a restart must not lose: the rumors
+// it originated, the key shares it generated, the elections it holds frozen,
+// and the blocks and the buffered ballots of their blockchains. Records are
+// appended to logs of JSON lines, or written to a new file renamed over the
+// old one, and synced to disk before the peer acts on them, so that a
+// restarted peer never contradicts what it sent before it crashed. A record
+// torn by a crash can only be the last one of its log, it is dropped when the
+// log is read back. A peer that can't write to its store stops, it couldn't
+// restart consistently.
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
+)
+
+// Layout of the store: the rumors of this peer, a record per key share and
+// per frozen election, and a directory per blockchain
+const (
+	StoreRumorLog  = "rumors.log"
+	StoreKeysDir   = "keys"
+	StoreElectDir  = "elections"
+	StoreChainsDir = "chains"
+	StoreBlockLog  = "blocks.log"
+	StoreBallotLog = "ballots.log"
+	StoreRecordExt = ".json"
+)
+
+type Store struct {
+	// Directory of the store
+	Dir string
+
+	// Logs opened for appending, by path
+	logs map[string]*os.File
+	Mux  sync.Mutex
+}
+
+// keyRecord is the key generated for an election, with the share of this
+// trustee.
+type keyRecord struct {
+	Name      string
+	Index     int
+	N         int
+	T         int
+	Key       *message.Key
+	Questions []byte
+	Result    *DKGResult
+	Share     *big.Int
+}
+
+// electionRecord is an election frozen on this trustee.
+type electionRecord struct {
+	Name     string
+	Election message.Election
+	Trustee  *message.Trustee
+}
+
+func OpenStore(dir string) (*Store, error) {
+	/*
+		This func opens the store in the given directory, which is
+		created if it doesn't exist
+	*/
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		Dir:  dir,
+		logs: make(map[string]*os.File),
+	}, nil
+}
+
+func storeName(name string) string {
+	// Election names are hex encoded to be used as file names
+	return hex.EncodeToString([]byte(name))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *Store) Append(path string, v interface{}) error {
+	/*
+		This func appends a record to the log at the given path in the
+		store, and returns once it is on disk
+	*/
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.Mux.Lock()
+	defer s.Mux.Unlock()
+
+	f, ok := s.logs[path]
+	if !ok {
+		full := filepath.Join(s.Dir, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0700); err != nil {
+			return err
+		}
+		f, err = os.OpenFile(full, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		// The log itself must survive a crash
+		if err := syncDir(filepath.Dir(full)); err != nil {
+			f.Close()
+			return err
+		}
+		s.logs[path] = f
+	}
+
+	if _, err := f.Write(append(js, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (s *Store) ReadLog(path string, read func([]byte) error) error {
+	/*
+		This func reads the records of the log at the given path in turn,
+		up to the first one that is torn or that read rejects, which is
+		cut off the log with the records after it
+		A log that doesn't exist is empty
+	*/
+
+	s.Mux.Lock()
+	defer s.Mux.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(s.Dir, path), os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF || read(line[:len(line)-1]) != nil {
+			break
+		}
+		offset += int64(len(line))
+	}
+
+	fmt.Printf("STORE DROPPING TORN RECORDS OF %s\n", path)
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (s *Store) WriteFile(path string, v interface{}) error {
+	/*
+		This func replaces the record at the given path in the store, by
+		renaming a new file over it once it is on disk, so that either
+		the old or the new record survives a crash
+	*/
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.Mux.Lock()
+	defer s.Mux.Unlock()
+
+	full := filepath.Join(s.Dir, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0700); err != nil {
+		return err
+	}
+
+	tmp := full + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(js); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, full); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(full))
+}
+
+func (s *Store) ReadFiles(dir string, read func([]byte) error) error {
+	/*
+		This func reads the records in the given directory of the store,
+		the new files of records that were not renamed yet are skipped
+	*/
+
+	entries, err := os.ReadDir(filepath.Join(s.Dir, dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != StoreRecordExt {
+			continue
+		}
+		js, err := os.ReadFile(filepath.Join(s.Dir, dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := read(js); err != nil {
+			return fmt.Errorf("%s: %s", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) Chains() ([]string, error) {
+	/*
+		This func returns the names of the elections whose blockchain is
+		in the store
+	*/
+
+	entries, err := os.ReadDir(filepath.Join(s.Dir, StoreChainsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name, err := hex.DecodeString(entry.Name())
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		names = append(names, string(name))
+	}
+	return names, nil
+}
+
+func (g *Gossiper) StoreRumor(wrappedMessage *message.WrappedRumorTLCMessage) {
+	/*
+		This func stores a rumor of this peer before it is sent, with the
+		rumor buffer locked, so that a restarted peer doesn't reuse its ID
+	*/
+
+	if g.Store == nil {
+		return
+	}
+	if err := g.Store.Append(StoreRumorLog, wrappedMessage); err != nil {
+		panic(fmt.Sprintf("cannot store rumor %d: %s", wrappedMessage.GetID(), err))
+	}
+}
+
+func (g *Gossiper) StoreKeyShare(dkg *DKG, share *big.Int) error {
+	/*
+		This func stores the key generated for an election and the share
+		of this trustee, before the key is reported
+	*/
+
+	if g.Store == nil {
+		return nil
+	}
+
+	dkg.Mux.Lock()
+	record := &keyRecord{
+		Name:      dkg.Name,
+		Index:     dkg.Index,
+		N:         dkg.N,
+		T:         dkg.T,
+		Key:       dkg.Key,
+		Questions: dkg.Questions,
+		Result:    dkg.Result,
+		Share:     share,
+	}
+	dkg.Mux.Unlock()
+
+	return g.Store.WriteFile(filepath.Join(StoreKeysDir, storeName(dkg.Name)+StoreRecordExt), record)
+}
+
+func (g *Gossiper) StoreElection(name string, elec message.Election, trustee *message.Trustee) error {
+	/*
+		This func stores an election frozen on this trustee, before the
+		freezing is acknowledged
+	*/
+
+	if g.Store == nil {
+		return nil
+	}
+
+	record := &electionRecord{
+		Name:     name,
+		Election: elec,
+		Trustee:  trustee,
+	}
+	return g.Store.WriteFile(filepath.Join(StoreElectDir, storeName(name)+StoreRecordExt), record)
+}
+
+func (bc *Blockchain) storePath(log string) string {
+	return filepath.Join(StoreChainsDir, storeName(bc.ElectionName), log)
+}
+
+func (bc *Blockchain) StoreBlock(b *message.Block) {
+	/*
+		This func stores a committed block before it is appended
+	*/
+
+	if bc.Store == nil {
+		return
+	}
+	if err := bc.Store.Append(bc.storePath(StoreBlockLog), b); err != nil {
+		panic(fmt.Sprintf("cannot store block %d of election %s: %s", b.Round, bc.ElectionName, err))
+	}
+}
+
+func (bc *Blockchain) StoreBallot(cb *message.CastBallot) {
+	/*
+		This func stores a ballot before it is buffered
+	*/
+
+	if bc.Store == nil {
+		return
+	}
+	if err := bc.Store.Append(bc.storePath(StoreBallotLog), cb); err != nil {
+		panic(fmt.Sprintf("cannot store ballot of voter %s in election %s: %s", cb.VoterUuid, bc.ElectionName, err))
+	}
+}
+
+func (bc *Blockchain) Load() error {
+	/*
+		This func loads the blocks and the buffered ballots of the
+		blockchain from the store, before the blockchain starts working
+		Step 0. Append the stored blocks that follow the head, and move
+		        the election by their transitions
+		Step 1. Buffer the stored ballots, the ones already recorded are
+		        dropped from the buffer by the next proposal
+	*/
+
+	if bc.Store == nil {
+		return nil
+	}
+
+	/* Step 0 */
+	bc.BlockMux.Lock()
+	err := bc.Store.ReadLog(bc.storePath(StoreBlockLog), func(js []byte) error {
+		b := &message.Block{}
+		if err := json.Unmarshal(js, b); err != nil {
+			return err
+		}
+		if b.Round != bc.NextId || !bc.CheckBlockValidty(b) || b.CurrentHash != b.Hash() || b.CheckBallots() != nil {
+			return fmt.Errorf("block %d doesn't follow the head", b.Round)
+		}
+
+		bc.Blocks = append(bc.Blocks, b)
+		bc.Records = append(bc.Records, b.ToString())
+		if b.Transition != nil {
+			bc.State = b.Transition.To
+		}
+		bc.NextId += 1
+		return nil
+	})
+	bc.BlockMux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	/* Step 1 */
+	bc.BufferMux.Lock()
+	defer bc.BufferMux.Unlock()
+	return bc.Store.ReadLog(bc.storePath(StoreBallotLog), func(js []byte) error {
+		cb := &message.CastBallot{}
+		if err := json.Unmarshal(js, cb); err != nil {
+			return err
+		}
+		bc.Buffer = append(bc.Buffer, cb)
+		return nil
+	})
+}
+
+func (g *Gossiper) Reload() error {
+	/*
+		This func reloads the state of this peer from its store when it
+		restarts, before it starts working
+		Step 0. Reload the rumors of this peer, so that its next rumor
+		        takes the next ID
+		Step 1. Reload the key shares, and the keys generated with them
+		Step 2. Reload the frozen elections and their blockchains, and
+		        follow them through their lifecycle again
+		Step 3. Reload the blockchains of the elections that are not
+		        frozen
+		Step 4. Hand the votes of this trustee for the current round of
+		        each blockchain back to it, so that it resumes the round
+		        without contradicting them
+	*/
+
+	if g.Store == nil {
+		return nil
+	}
+
+	/* Step 0 */
+	g.StatusBuffer.Mux.Lock()
+	g.RumorBuffer.Mux.Lock()
+	err := g.Store.ReadLog(StoreRumorLog, func(js []byte) error {
+		wrappedMessage := &message.WrappedRumorTLCMessage{}
+		if err := json.Unmarshal(js, wrappedMessage); err != nil {
+			return err
+		}
+		if wrappedMessage.GetID() != uint32(len(g.RumorBuffer.Rumors[g.Name])+1) {
+			return fmt.Errorf("rumor %d out of order", wrappedMessage.GetID())
+		}
+		g.RumorBuffer.Rumors[g.Name] = append(g.RumorBuffer.Rumors[g.Name], wrappedMessage)
+		return nil
+	})
+	rumors := g.RumorBuffer.Rumors[g.Name]
+	if len(rumors) > 0 {
+		g.StatusBuffer.Status[g.Name] = uint32(len(rumors) + 1)
+	}
+	g.RumorBuffer.Mux.Unlock()
+	g.StatusBuffer.Mux.Unlock()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("STORE RELOADED %d RUMORS\n", len(rumors))
+
+	/* Step 1 */
+	err = g.Store.ReadFiles(StoreKeysDir, func(js []byte) error {
+		record := &keyRecord{}
+		if err := json.Unmarshal(js, record); err != nil {
+			return err
+		}
+
+		dkg := g.GetOrCreateDKG(record.Name)
+		dkg.Mux.Lock()
+		dkg.Started = true
+		dkg.Index, dkg.N, dkg.T = record.Index, record.N, record.T
+		dkg.Key = record.Key
+		dkg.Questions = record.Questions
+		dkg.Result = record.Result
+		dkg.Mux.Unlock()
+
+		g.DKGsMux.Lock()
+		g.PartialKeyMap[record.Name] = record.Share
+		g.DKGsMux.Unlock()
+		fmt.Printf("STORE RELOADED KEY SHARE OF ELECTION %s\n", record.Name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	/* Step 2 */
+	err = g.Store.ReadFiles(StoreElectDir, func(js []byte) error {
+		record := &electionRecord{}
+		if err := json.Unmarshal(js, record); err != nil {
+			return err
+		}
+
+		name, elec := record.Name, record.Election
+		if err := elec.ComputeHash(); err != nil {
+			return err
+		}
+		g.DKGsMux.Lock()
+		share := g.PartialKeyMap[name]
+		g.DKGsMux.Unlock()
+
+		g.AddElection(name, elec, record.Trustee)
+		bc := g.GetOrCreateBlockchain(name)
+		bc.SetElection(&elec, record.Trustee, share)
+		go g.RunLifecycle(name)
+		fmt.Printf("STORE RELOADED ELECTION %s AT ROUND %d\n", name, bc.NextId)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	/* Step 3 */
+	names, err := g.Store.Chains()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		g.GetOrCreateBlockchain(name)
+	}
+
+	/* Step 4 */
+	for _, wrappedMessage := range rumors {
+		m := wrappedMessage.ConsensusMessage
+		if m == nil || m.Vote == nil {
+			continue
+		}
+		bc := g.GetOrCreateBlockchain(m.ElectionName)
+		if m.Vote.Seq >= bc.NextId {
+			bc.ConsensusCh <- m
+		}
+	}
+
+	return nil
+}
@@ -183,9 +183,15 @@ func (g *Gossiper) Update(wrappedMessage *message.WrappedRumorTLCMessage, sender
 	} else if wrappedMessage.TLCMessage != nil {
 		inputID = wrappedMessage.TLCMessage.ID
 		inputOrigin = wrappedMessage.TLCMessage.Origin
-	} else {
+	} else if wrappedMessage.BlockRumorMessage != nil {
 		inputID = wrappedMessage.BlockRumorMessage.ID
 		inputOrigin = wrappedMessage.BlockRumorMessage.Origin
+	} else if wrappedMessage.DKGMessage != nil {
+		inputID = wrappedMessage.DKGMessage.ID
+		inputOrigin = wrappedMessage.DKGMessage.Origin
+	} else {
+		inputID = wrappedMessage.ConsensusMessage.ID
+		inputOrigin = wrappedMessage.ConsensusMessage.Origin
 	}
 
 	for origin, nextID := range g.StatusBuffer.Status {
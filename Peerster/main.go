@@ -29,6 +29,7 @@ var numPeers int
 var hw3ex2 bool
 var hw3ex3 bool
 var ackAll bool
+var storeDir string
 
 func input() (UIPort string, GuiPort string, gossipAddr string, name string, peers []string, simple, hw3ex2, hw3ex3 bool, antiEntropy int, rtimer int, sharedFilePath string,
 	stubbornTimeout int, numPeers int, ackAll bool) {
@@ -64,6 +65,8 @@ func input() (UIPort string, GuiPort string, gossipAddr string, name string, pee
 
 	flag.BoolVar(&ackAll, "ackAll", false, "whether to ack all incoming tlc message")
 
+	flag.StringVar(&storeDir, "store", "", "directory of the store to reload state from on restart, none to keep it in memory")
+
 	// Conduct parameter retreival
 	flag.Parse()
 
@@ -232,6 +235,7 @@ func InitGossiper(UIPort, gossipAddr, name string, simple bool, peers []string,
 	}
 	g.Blockchains = make(map[string]*gossiper.Blockchain)
 	g.BlockAttackLog = make([]string, 0)
+	g.DKGs = make(map[string]*gossiper.DKG)
 	return
 }
 
@@ -243,6 +247,18 @@ func main() {
 	// Set up gossiper
 	g := InitGossiper(UIPort, gossipAddr, name, simple, peers, antiEntropy, rtimer, sharedFilePath)
 
+	// Reload gossiper's state from its store
+	if storeDir != "" {
+		store, err := gossiper.OpenStore(storeDir)
+		if err != nil {
+			panic(err)
+		}
+		g.Store = store
+		if err := g.Reload(); err != nil {
+			panic(err)
+		}
+	}
+
 	// Start gossiper's work
 	g.StartWorking()
 
@@ -0,0 +1,76 @@
+package message
+
+import (
+	"fmt"
+)
+
+// A ballot is prepared in two steps, following Benaloh: it is encrypted and
+// its tracker shown to the voter, who then either casts it or audits it. A
+// cast ballot is sealed first, so that only the ciphertexts and proofs leave
+// the voter service. An audited ballot is opened to the voter, who checks that
+// it encrypts the right choices, and is discarded: its randomness reveals the
+// vote.
+
+// Seal removes the plaintext answers and the randomness from the ballot, so
+// that it can be cast. The tracker of the ballot doesn't change.
+func (b *Ballot) Seal() {
+	for _, a := range b.Answers {
+		if a == nil {
+			continue
+		}
+		a.Answer = nil
+		a.Randomness = nil
+	}
+}
+
+// Audit checks an opened ballot: it must be a valid ballot for the election,
+// and each choice must be the encryption of the revealed selection with the
+// revealed randomness.
+func (b *Ballot) Audit(election *Election) error {
+	if err := b.Verify(election); err != nil {
+		return err
+	}
+
+	pk := election.PublicKey
+	for i, q := range election.Questions {
+		a := b.Answers[i]
+		if len(a.Randomness) != len(a.Choices) {
+			return fmt.Errorf("randomness of question %d is not revealed", i)
+		}
+
+		// the plaintext of each choice, whatever the tally type
+		plaintexts := make([]int64, len(a.Choices))
+		if q.IsMixnet() {
+			var err error
+			if plaintexts, err = q.EncodeMixed(a.Answer); err != nil {
+				return fmt.Errorf("invalid plaintext answer for question %d: %s", i, err)
+			}
+		} else if q.ChoiceType == ChoiceScore {
+			if err := q.checkScores(a.Answer); err != nil {
+				return fmt.Errorf("invalid plaintext answer for question %d: %s", i, err)
+			}
+			copy(plaintexts, a.Answer)
+		} else {
+			for _, index := range a.Answer {
+				if index < 0 || index >= int64(len(plaintexts)) || plaintexts[index] != 0 {
+					return fmt.Errorf("invalid plaintext answer for question %d", i)
+				}
+				plaintexts[index] = 1
+			}
+		}
+
+		for j, c := range a.Choices {
+			r := a.Randomness[j]
+			if r == nil {
+				return fmt.Errorf("randomness of choice %d of question %d is not revealed", j, i)
+			}
+
+			expected := encryptValue(plaintexts[j], r, pk)
+			if expected.Alpha.Cmp(c.Alpha) != 0 || expected.Beta.Cmp(c.Beta) != 0 {
+				return fmt.Errorf("choice %d of question %d does not encrypt the plaintext answer", j, i)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// canonicalElection is the part of an Election that its hash covers: what the
+// voters are asked and how their ballots are encrypted and decrypted. The
+// fields are serialized in this fixed order, and the secret, the addresses of
+// the trustees and their decryptions are left out.
+type canonicalElection struct {
+	Uuid            string              `json:"uuid"`
+	Name            string              `json:"name"`
+	ShortName       string              `json:"short_name"`
+	Description     string              `json:"description"`
+	CastURL         string              `json:"cast_url"`
+	FrozenAt        string              `json:"frozen_at"`
+	Openreg         bool                `json:"openreg"`
+	UseVoterAliases bool                `json:"use_voter_aliases"`
+	VotersHash      string              `json:"voters_hash"`
+	Weights         map[string]int64    `json:"weights,omitempty"`
+	Revote          string              `json:"revote,omitempty"`
+	VotingStartsAt  string              `json:"voting_starts_at"`
+	VotingEndsAt    string              `json:"voting_ends_at"`
+	PublicKey       *Key                `json:"public_key"`
+	Questions       []*Question         `json:"questions"`
+	Trustees        []*canonicalTrustee `json:"trustees"`
+	Threshold       int                 `json:"threshold"`
+}
+
+type canonicalTrustee struct {
+	Index     int  `json:"index"`
+	PublicKey *Key `json:"public_key"`
+}
+
+// CanonicalJSON returns the serialization of the election that its hash is
+// computed on. Two parties holding the same election get the same bytes,
+// whatever the JSON they received it in.
+func (e *Election) CanonicalJSON() ([]byte, error) {
+	c := canonicalElection{
+		Uuid:            e.Uuid,
+		Name:            e.Name,
+		ShortName:       e.ShortName,
+		Description:     e.Description,
+		CastURL:         e.CastURL,
+		FrozenAt:        e.FrozenAt,
+		Openreg:         e.Openreg,
+		UseVoterAliases: e.UseVoterAliases,
+		VotersHash:      e.VotersHash,
+		Weights:         e.Weights,
+		Revote:          e.Revote,
+		VotingStartsAt:  e.VotingStartsAt,
+		VotingEndsAt:    e.VotingEndsAt,
+		PublicKey:       e.PublicKey,
+		Questions:       e.Questions,
+		Trustees:        make([]*canonicalTrustee, len(e.Trustees)),
+		Threshold:       e.Threshold,
+	}
+
+	for i, t := range e.Trustees {
+		c.Trustees[i] = &canonicalTrustee{Index: t.Index, PublicKey: t.PublicKey}
+	}
+
+	return json.Marshal(c)
+}
+
+// Hash computes the hash of the election: the base64 encoding, without
+// padding, of the SHA-256 hash of its canonical JSON.
+func (e *Election) Hash() (string, error) {
+	js, err := e.CanonicalJSON()
+	if err != nil {
+		return "", err
+	}
+
+	return hashJSON(js), nil
+}
+
+// ComputeHash sets the JSON and the ElectionHash of the election.
+func (e *Election) ComputeHash() error {
+	js, err := e.CanonicalJSON()
+	if err != nil {
+		return err
+	}
+
+	e.JSON = js
+	e.ElectionHash = hashJSON(js)
+	return nil
+}
+
+func hashJSON(js []byte) string {
+	h := sha256.Sum256(js)
+	return base64.RawStdEncoding.EncodeToString(h[:])
+}
+
+// canonicalAnswer is the part of an EncryptedAnswer that is cast: the
+// plaintext and the randomness, if still attached, are left out. An answer
+// only has the proofs of its tally type, and the others are left out whether
+// they are nil or empty, as gossip doesn't tell them apart.
+type canonicalAnswer struct {
+	Choices          []*Ciphertext        `json:"choices"`
+	IndividualProofs []DisjunctiveZKProof `json:"individual_proofs,omitempty"`
+	OverallProof     DisjunctiveZKProof   `json:"overall_proof,omitempty"`
+	RandomnessProofs []*SchnorrProof      `json:"randomness_proofs,omitempty"`
+}
+
+type canonicalBallot struct {
+	ElectionUuid string             `json:"election_uuid"`
+	ElectionHash string             `json:"election_hash"`
+	Answers      []*canonicalAnswer `json:"answers"`
+}
+
+// CanonicalJSON returns the serialization of the ballot that its tracker is
+// computed on.
+func (b *Ballot) CanonicalJSON() ([]byte, error) {
+	c := canonicalBallot{
+		ElectionUuid: b.ElectionUuid,
+		ElectionHash: b.ElectionHash,
+		Answers:      make([]*canonicalAnswer, len(b.Answers)),
+	}
+
+	for i, a := range b.Answers {
+		if a == nil {
+			continue
+		}
+		c.Answers[i] = &canonicalAnswer{a.Choices, a.IndividualProofs, a.OverallProof, a.RandomnessProofs}
+	}
+
+	return json.Marshal(c)
+}
+
+// Tracker computes the tracking number of the ballot, the hash of its
+// canonical JSON. The voter keeps it to look the ballot up once it is cast.
+func (b *Ballot) Tracker() (string, error) {
+	js, err := b.CanonicalJSON()
+	if err != nil {
+		return "", err
+	}
+
+	return hashJSON(js), nil
+}
+
+// CheckTracker checks that the tracker of the cast ballot is the one of its
+// vote. The signature of the voter only covers the tracker, so a vote swapped
+// under a signed tracker is caught here.
+func (cb *CastBallot) CheckTracker() error {
+	if cb.Vote == nil {
+		return errors.New("missing ballot")
+	}
+
+	tracker, err := cb.Vote.Tracker()
+	if err != nil {
+		return err
+	}
+	if tracker != cb.VoteHash {
+		return errors.New("the tracker is not the one of the ballot")
+	}
+	return nil
+}
+
+// ComputeTracker sets the JSON of the cast ballot to the canonical JSON of its
+// vote, and its VoteHash to the tracker.
+func (cb *CastBallot) ComputeTracker() error {
+	if cb.Vote == nil {
+		return errors.New("missing ballot")
+	}
+
+	js, err := cb.Vote.CanonicalJSON()
+	if err != nil {
+		return err
+	}
+
+	cb.JSON = js
+	cb.VoteHash = hashJSON(js)
+	return nil
+}
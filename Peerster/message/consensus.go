@@ -0,0 +1,157 @@
+package message
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// The trustees of an election order the blocks of its blockchain with PBFT.
+// They sign their votes with their share of the election key, so a vote is
+// bound to the index of a trustee on the frozen election rather than to a
+// gossip origin. With N trustees up to f = (N-1)/3 of them may be faulty, and
+// a quorum of (N+f)/2+1 votes is needed to prepare or commit a block, so that
+// two quorums always share an honest trustee.
+
+// FaultyTrustees gets the number of faulty trustees tolerated among n.
+func FaultyTrustees(n int) int {
+	return (n - 1) / 3
+}
+
+// ConsensusQuorum gets the number of votes of n trustees needed to prepare or
+// commit a block, or to change the view.
+func ConsensusQuorum(n int) int {
+	return (n+FaultyTrustees(n))/2 + 1
+}
+
+// ConsensusLeader gets the index of the trustee leading the given view.
+func ConsensusLeader(view int, n int) int {
+	return view%n + 1
+}
+
+// signedChallenge hashes the public value and the commitment of a Schnorr
+// signature along with the signed data into a challenge in Z_q.
+func signedChallenge(y *big.Int, commitment *big.Int, pk *Key, data []byte) *big.Int {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s,%s,%s,%s,", pk.GroupName, pk.Generator, y, commitment)
+	h.Write(data)
+
+	challenge := new(big.Int).SetBytes(h.Sum(nil))
+	return challenge.Mod(challenge, pk.ExponentPrime)
+}
+
+// SignSchnorr signs data with secret, as a Schnorr proof of knowledge of the
+// secret behind g^secret whose challenge covers data.
+func SignSchnorr(secret *big.Int, pk *Key, data []byte) (*SchnorrProof, error) {
+	w, err := rand.Int(rand.Reader, pk.ExponentPrime)
+	if err != nil {
+		return nil, err
+	}
+
+	g := pk.Group()
+	y := g.Exp(pk.Generator, secret)
+	commitment := g.Exp(pk.Generator, w)
+	challenge := signedChallenge(y, commitment, pk, data)
+
+	// response = w + challenge * secret mod q
+	response := new(big.Int).Mul(challenge, secret)
+	response.Add(response, w)
+	response.Mod(response, pk.ExponentPrime)
+
+	return &SchnorrProof{commitment, challenge, response}, nil
+}
+
+// VerifySignature checks that data is signed with the secret behind y.
+func (p *SchnorrProof) VerifySignature(y *big.Int, pk *Key, data []byte) bool {
+	if p == nil || p.Commitment == nil || p.Challenge == nil || p.Response == nil {
+		return false
+	}
+
+	g := pk.Group()
+	if !g.IsMember(y) || !g.IsMember(p.Commitment) ||
+		p.Challenge.Cmp(signedChallenge(y, p.Commitment, pk, data)) != 0 {
+		return false
+	}
+
+	// g^response = commitment * y^challenge
+	lhs := g.Exp(pk.Generator, p.Response)
+	rhs := g.Mul(p.Commitment, g.Exp(y, p.Challenge))
+	return lhs.Cmp(rhs) == 0
+}
+
+// SignedData is what a trustee signs: the vote and the election it is cast in.
+func (v *ConsensusVote) SignedData(electionName string) []byte {
+	return []byte(fmt.Sprintf("%s,%s,%d,%d,%s,%d,%d", electionName, v.Type, v.View, v.Seq, v.Digest, v.Prepared, v.Index))
+}
+
+// Sign signs the vote with the share of the election key of the trustee.
+func (v *ConsensusVote) Sign(electionName string, trustee *Trustee, share *big.Int) error {
+	if trustee == nil || trustee.PublicKey == nil || share == nil {
+		return errors.New("missing trustee key")
+	}
+
+	v.Index = trustee.Index
+	sig, err := SignSchnorr(share, trustee.PublicKey, v.SignedData(electionName))
+	if err != nil {
+		return err
+	}
+
+	v.Signature = sig.BigInt2Str()
+	return nil
+}
+
+// VerifyConsensusVote checks that the vote is signed by the trustee of the
+// election at the index of the vote.
+func (e *Election) VerifyConsensusVote(electionName string, v *ConsensusVote) error {
+	if v == nil {
+		return errors.New("missing vote")
+	}
+
+	for _, t := range e.Trustees {
+		if t == nil || t.Index != v.Index {
+			continue
+		}
+		if t.PublicKey == nil || t.PublicKey.PublicValue == nil {
+			return fmt.Errorf("trustee %d has no public key", t.Index)
+		}
+		if !v.Signature.Str2BigInt().VerifySignature(t.PublicKey.PublicValue, t.PublicKey, v.SignedData(electionName)) {
+			return fmt.Errorf("invalid signature of trustee %d", t.Index)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown trustee %d", v.Index)
+}
+
+// VerifyPrepared checks that the prepare votes prove that the digest of the
+// vote was prepared in the view the vote says, before the view of the vote: a
+// quorum of trustees of the election voted to prepare it in that round.
+func (e *Election) VerifyPrepared(electionName string, v *ConsensusVote, prepares []*ConsensusVote) error {
+	if v.Prepared < 0 {
+		if v.Digest != "" {
+			return errors.New("digest of a block that is not prepared")
+		}
+		return nil
+	}
+	if v.Prepared >= v.View {
+		return errors.New("block prepared in a later view")
+	}
+
+	voted := make(map[int]bool)
+	for _, p := range prepares {
+		if p == nil || p.Type != ConsensusPrepare || p.View != v.Prepared || p.Seq != v.Seq || p.Digest != v.Digest {
+			return errors.New("prepare vote for another block")
+		}
+		if err := e.VerifyConsensusVote(electionName, p); err != nil {
+			return err
+		}
+		voted[p.Index] = true
+	}
+
+	if len(voted) < ConsensusQuorum(len(e.Trustees)) {
+		return errors.New("not enough prepare votes")
+	}
+	return nil
+}
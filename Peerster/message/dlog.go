@@ -0,0 +1,98 @@
+package message
+
+import (
+	"math/big"
+	"sync"
+)
+
+// A DiscreteLogTable finds v from g^v for 0 <= v <= Max with a baby-step
+// giant-step search, in O(sqrt(Max)) group operations instead of O(Max).
+type DiscreteLogTable struct {
+	// Max is the largest value the table can find.
+	Max int64
+
+	group Group
+
+	// step is m = ceil(sqrt(Max + 1)), the number of baby steps
+	step int64
+
+	// baby maps g^j to j for 0 <= j < m
+	baby map[string]int64
+
+	// giant is g^-m
+	giant *big.Int
+}
+
+// dlogTables caches the tables by group, so that they are shared by all the
+// questions and answers of a tally and across tallies.
+var (
+	dlogTables    = make(map[string]*DiscreteLogTable)
+	dlogTablesMux sync.Mutex
+)
+
+// NewDiscreteLogTable precomputes a table for the generator of pk, for values
+// up to max.
+func NewDiscreteLogTable(pk *Key, max int64) *DiscreteLogTable {
+	if max < 0 {
+		max = 0
+	}
+
+	step := new(big.Int).Sqrt(big.NewInt(max + 1)).Int64()
+	if step*step < max+1 {
+		step++
+	}
+
+	g := pk.Group()
+	baby := make(map[string]int64, step)
+	x := g.Identity()
+	for j := int64(0); j < step; j++ {
+		baby[string(x.Bytes())] = j
+		x = g.Mul(x, pk.Generator)
+	}
+
+	return &DiscreteLogTable{
+		Max:   max,
+		group: g,
+		step:  step,
+		baby:  baby,
+		giant: g.Inv(g.Exp(pk.Generator, big.NewInt(step))),
+	}
+}
+
+// GetDiscreteLogTable returns a cached table for the generator of pk that
+// covers values up to max, computing it if needed.
+func GetDiscreteLogTable(pk *Key, max int64) *DiscreteLogTable {
+	id := pk.groupID()
+
+	dlogTablesMux.Lock()
+	defer dlogTablesMux.Unlock()
+
+	table, ok := dlogTables[id]
+	if ok && table.Max >= max {
+		return table
+	}
+
+	// grow geometrically, so that a growing electorate doesn't rebuild the
+	// table on every tally
+	if ok && max < 2*table.Max {
+		max = 2 * table.Max
+	}
+
+	table = NewDiscreteLogTable(pk, max)
+	dlogTables[id] = table
+	return table
+}
+
+// Log returns v such that x = g^v, if 0 <= v <= Max.
+func (t *DiscreteLogTable) Log(x *big.Int) (int64, bool) {
+	gamma := x
+	for i := int64(0); i < t.step; i++ {
+		if j, ok := t.baby[string(gamma.Bytes())]; ok {
+			v := i*t.step + j
+			return v, v <= t.Max
+		}
+		gamma = t.group.Mul(gamma, t.giant)
+	}
+
+	return 0, false
+}
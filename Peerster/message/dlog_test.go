@@ -0,0 +1,74 @@
+package message
+
+import (
+	"math/big"
+	"testing"
+)
+
+// checkTable compares the table with a brute force search of every power of
+// the generator up to past the values the table can reach.
+func checkTable(t *testing.T, table *DiscreteLogTable, pk *Key) {
+	t.Helper()
+	g := pk.Group()
+	x := g.Identity()
+	for v := int64(0); v <= table.step*table.step+table.step; v++ {
+		got, ok := table.Log(x)
+		if v <= table.Max && (!ok || got != v) {
+			t.Fatalf("log of g^%d is %d, %v with max %d", v, got, ok, table.Max)
+		}
+		if v > table.Max && ok {
+			t.Fatalf("log of g^%d found as %d beyond max %d", v, got, table.Max)
+		}
+		x = g.Mul(x, pk.Generator)
+	}
+}
+
+func TestDiscreteLogTable(t *testing.T) {
+	pk := NewEd25519Parameters()
+
+	// the edges of the baby steps: max + 1 a square, and just around
+	for _, max := range []int64{-1, 0, 1, 2, 3, 8, 15, 16, 24, 25, 99, 100} {
+		table := NewDiscreteLogTable(pk, max)
+		if table.step*table.step < table.Max+1 {
+			t.Fatalf("%d steps can't reach %d", table.step, table.Max)
+		}
+		checkTable(t, table, pk)
+	}
+
+	// g^-1 is far from any small value
+	table := NewDiscreteLogTable(pk, 100)
+	if _, ok := table.Log(pk.Group().Inv(pk.Generator)); ok {
+		t.Fatal("found the log of g^-1")
+	}
+}
+
+func TestGetDiscreteLogTable(t *testing.T) {
+	// a small group of its own, so that no other tally shares its table
+	pk := &Key{Generator: big.NewInt(4), Prime: big.NewInt(2039), ExponentPrime: big.NewInt(1019)}
+
+	first := GetDiscreteLogTable(pk, 10)
+	if first.Max != 10 {
+		t.Fatalf("max %d for 10", first.Max)
+	}
+	if GetDiscreteLogTable(pk, 7) != first {
+		t.Fatal("a smaller tally rebuilt the table")
+	}
+
+	// a tally just past the table doubles it
+	grown := GetDiscreteLogTable(pk, 11)
+	if grown.Max != 20 {
+		t.Fatalf("max %d after growing from 10", grown.Max)
+	}
+	checkTable(t, grown, pk)
+
+	// and a tally past the double takes its own size
+	wide := GetDiscreteLogTable(pk, 50)
+	if wide.Max != 50 {
+		t.Fatalf("max %d for 50", wide.Max)
+	}
+	checkTable(t, wide, pk)
+
+	if _, ok := wide.Log(pk.Group().Exp(pk.Generator, big.NewInt(51))); ok {
+		t.Fatal("found a value past the table")
+	}
+}
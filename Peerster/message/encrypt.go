@@ -0,0 +1,120 @@
+package message
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// encryptValue encrypts g^value with the given randomness.
+func encryptValue(value int64, randomness *big.Int, pk *Key) *Ciphertext {
+	g := pk.Group()
+
+	a := g.Exp(pk.Generator, randomness)
+	b := g.Mul(g.Exp(pk.PublicValue, randomness), g.Exp(pk.Generator, big.NewInt(value)))
+	return &Ciphertext{a, b}
+}
+
+// Encrypt encrypts the selection for an answer: either this value is
+// selected or not. It also generates a DisjunctiveZKProof to show that
+// the value is either selected or not. It returns the randomness it
+// generated; this is useful for computing the OverallProof for a Question.
+func Encrypt(selected bool, pk *Key) (*Ciphertext, DisjunctiveZKProof, *big.Int, error) {
+	// If this value is selected, then use g^1; otherwise, use g^0.
+	if selected {
+		return EncryptScore(1, 1, pk)
+	}
+	return EncryptScore(0, 1, pk)
+}
+
+// EncryptScore encrypts a score between 0 and max for an answer, with a
+// DisjunctiveZKProof that the value is one of 0, 1, ..., max.
+func EncryptScore(score int64, max int64, pk *Key) (*Ciphertext, DisjunctiveZKProof, *big.Int, error) {
+	if score < 0 || score > max {
+		return nil, nil, nil, errors.New("score out of range")
+	}
+
+	randomness, err := rand.Int(rand.Reader, pk.ExponentPrime)
+	if err != nil {
+		// glog.Error("Couldn't get randomness for an encryption")
+		return nil, nil, nil, err
+	}
+
+	c := encryptValue(score, randomness, pk)
+
+	// Real proof of score and simulated proofs of all the other values
+	proof := make(DisjunctiveZKProof, max+1)
+	for v := int64(0); v <= max; v++ {
+		if v == score {
+			continue
+		}
+		if err = proof.CreateFakeProof(v, v, c, pk); err != nil {
+			// glog.Error("Couldn't create a simulated proof")
+			return nil, nil, nil, err
+		}
+	}
+
+	if err = proof.CreateRealProof(score, c, randomness, pk); err != nil {
+		// glog.Error("Couldn't create a real proof")
+		return nil, nil, nil, err
+	}
+
+	return c, proof, randomness, nil
+}
+
+// EncryptMixed encrypts an answer to a mixnet question, see
+// Question.EncodeMixed, with a proof of knowledge of the randomness of each
+// choice instead of proofs of its plaintext: the plaintexts are checked once
+// the ballots are mixed and decrypted.
+func EncryptMixed(q *Question, answer []int64, pk *Key) (*EncryptedAnswer, error) {
+	plaintexts, err := q.EncodeMixed(answer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid answers: %s", err)
+	}
+
+	ch := make([]*Ciphertext, len(plaintexts))
+	rp := make([]*SchnorrProof, len(plaintexts))
+	rs := make([]*big.Int, len(plaintexts))
+	for j, v := range plaintexts {
+		if rs[j], err = rand.Int(rand.Reader, pk.ExponentPrime); err != nil {
+			return nil, err
+		}
+
+		ch[j] = encryptValue(v, rs[j], pk)
+
+		// alpha = g^r
+		if rp[j], err = NewSchnorrProof(rs[j], pk); err != nil {
+			return nil, err
+		}
+	}
+
+	as := make([]int64, len(answer))
+	copy(as, answer)
+
+	return &EncryptedAnswer{Choices: ch, RandomnessProofs: rp, Answer: as, Randomness: rs}, nil
+}
+
+// EncryptScores encrypts an answer to a score question, the score of each of
+// its answers, with a proof that each score lies between 0 and the highest
+// score. There is no overall proof: every combination of scores is valid.
+func EncryptScores(q *Question, scores []int64, pk *Key) (*EncryptedAnswer, error) {
+	if err := q.checkScores(scores); err != nil {
+		return nil, fmt.Errorf("invalid answers: %s", err)
+	}
+
+	ch := make([]*Ciphertext, len(scores))
+	ip := make([]DisjunctiveZKProof, len(scores))
+	rs := make([]*big.Int, len(scores))
+	for j, s := range scores {
+		var err error
+		if ch[j], ip[j], rs[j], err = EncryptScore(s, q.MaxChoice(), pk); err != nil {
+			return nil, err
+		}
+	}
+
+	as := make([]int64, len(scores))
+	copy(as, scores)
+
+	return &EncryptedAnswer{Choices: ch, IndividualProofs: ip, Answer: as, Randomness: rs}, nil
+}
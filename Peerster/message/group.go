@@ -0,0 +1,269 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/group/edwards25519"
+)
+
+// Names of the groups a Key can live in. An empty name is a mod p group, so
+// that keys created before groups were selectable keep working.
+const (
+	GroupModP    = "modp"
+	GroupEd25519 = "ed25519"
+)
+
+// A Group is a cyclic group of prime order in which keys, ciphertexts and
+// proofs are computed. Elements are carried as *big.Int so that they are
+// serialized the same way whatever the group, and the group is written
+// multiplicatively: for an elliptic curve, Mul is point addition and Exp is
+// scalar multiplication.
+//
+// The result of an operation on an element that is not a member of the group
+// is unspecified, so callers must check untrusted elements with IsMember.
+type Group interface {
+	// Order is the prime order q of the group.
+	Order() *big.Int
+
+	Generator() *big.Int
+
+	Identity() *big.Int
+
+	Mul(a *big.Int, b *big.Int) *big.Int
+
+	Exp(a *big.Int, k *big.Int) *big.Int
+
+	Inv(a *big.Int) *big.Int
+
+	IsMember(a *big.Int) bool
+
+	// HashToElement maps data to an element whose discrete logarithm is
+	// unknown to anyone, such as the independent generators of a
+	// commitment scheme.
+	HashToElement(data []byte) *big.Int
+}
+
+// Group returns the group in which the key is defined.
+func (pk *Key) Group() Group {
+	if pk.GroupName == GroupEd25519 {
+		return ed25519Group{}
+	}
+
+	return &modPGroup{pk.Generator, pk.Prime, pk.ExponentPrime}
+}
+
+// IsMember checks that x is in the group of the key.
+func (pk *Key) IsMember(x *big.Int) bool {
+	return pk.Group().IsMember(x)
+}
+
+// WithPublicValue returns a key in the same group as pk with public value y.
+func (pk *Key) WithPublicValue(y *big.Int) *Key {
+	return &Key{
+		Generator:     pk.Generator,
+		Prime:         pk.Prime,
+		ExponentPrime: pk.ExponentPrime,
+		PublicValue:   y,
+		GroupName:     pk.GroupName,
+	}
+}
+
+// SameGroup checks that pk and other are keys in the same group.
+func (pk *Key) SameGroup(other *Key) bool {
+	if other == nil {
+		return false
+	}
+
+	same := func(a *big.Int, b *big.Int) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && a.Cmp(b) == 0)
+	}
+
+	// names differ for mod p keys from before groups were selectable
+	name, otherName := pk.GroupName, other.GroupName
+	if name == "" {
+		name = GroupModP
+	}
+	if otherName == "" {
+		otherName = GroupModP
+	}
+
+	return name == otherName && same(pk.Generator, other.Generator) &&
+		same(pk.Prime, other.Prime) && same(pk.ExponentPrime, other.ExponentPrime)
+}
+
+// modPGroup is the subgroup of order q of Z_p^*, generated by g.
+type modPGroup struct {
+	g *big.Int
+	p *big.Int
+	q *big.Int
+}
+
+func (m *modPGroup) Order() *big.Int {
+	return m.q
+}
+
+func (m *modPGroup) Generator() *big.Int {
+	return m.g
+}
+
+func (m *modPGroup) Identity() *big.Int {
+	return big.NewInt(1)
+}
+
+func (m *modPGroup) Mul(a *big.Int, b *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, b)
+	return r.Mod(r, m.p)
+}
+
+func (m *modPGroup) Exp(a *big.Int, k *big.Int) *big.Int {
+	return new(big.Int).Exp(a, k, m.p)
+}
+
+func (m *modPGroup) Inv(a *big.Int) *big.Int {
+	return new(big.Int).ModInverse(a, m.p)
+}
+
+func (m *modPGroup) IsMember(x *big.Int) bool {
+	if x == nil || x.Sign() <= 0 || x.Cmp(m.p) >= 0 {
+		return false
+	}
+
+	return new(big.Int).Exp(x, m.q, m.p).Cmp(big.NewInt(1)) == 0
+}
+
+// HashToElement expands the hash of data to 128 bits more than p, reduces it
+// mod p and raises it to (p - 1) / q to land in the subgroup.
+func (m *modPGroup) HashToElement(data []byte) *big.Int {
+	cofactor := new(big.Int).Sub(m.p, big.NewInt(1))
+	cofactor.Div(cofactor, m.q)
+
+	for counter := uint32(0); ; counter++ {
+		x := new(big.Int).SetBytes(expandHash(data, counter, (m.p.BitLen()+128+7)/8))
+		h := x.Exp(x.Mod(x, m.p), cofactor, m.p)
+		if h.Cmp(big.NewInt(1)) > 0 {
+			return h
+		}
+	}
+}
+
+// expandHash hashes data with a counter into n bytes.
+func expandHash(data []byte, counter uint32, n int) []byte {
+	out := make([]byte, 0, n+sha256.Size)
+	for block := uint32(0); len(out) < n; block++ {
+		h := sha256.New()
+		binary.Write(h, binary.BigEndian, counter)
+		binary.Write(h, binary.BigEndian, block)
+		h.Write(data)
+		out = h.Sum(out)
+	}
+	return out[:n]
+}
+
+var ed25519Suite = edwards25519.NewBlakeSHA256Ed25519()
+
+// ed25519Order is the prime order l of the Ed25519 base point.
+var ed25519Order, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+
+// ed25519Group is the prime order subgroup of Ed25519. A point is carried as
+// its 32-byte encoding read as a big-endian integer.
+type ed25519Group struct{}
+
+// NewEd25519Parameters returns the parameters of the Ed25519 group, without
+// any key pair.
+func NewEd25519Parameters() *Key {
+	return &Key{
+		Generator:     ed25519Group{}.Generator(),
+		ExponentPrime: new(big.Int).Set(ed25519Order),
+		GroupName:     GroupEd25519,
+	}
+}
+
+func (ed25519Group) Order() *big.Int {
+	return ed25519Order
+}
+
+func (ed25519Group) Generator() *big.Int {
+	return pointToInt(ed25519Suite.Point().Base())
+}
+
+func (ed25519Group) Identity() *big.Int {
+	return pointToInt(ed25519Suite.Point().Null())
+}
+
+func (ed25519Group) Mul(a *big.Int, b *big.Int) *big.Int {
+	return pointToInt(ed25519Suite.Point().Add(intToPoint(a), intToPoint(b)))
+}
+
+func (ed25519Group) Exp(a *big.Int, k *big.Int) *big.Int {
+	return pointToInt(ed25519Suite.Point().Mul(intToScalar(k), intToPoint(a)))
+}
+
+func (ed25519Group) Inv(a *big.Int) *big.Int {
+	return pointToInt(ed25519Suite.Point().Neg(intToPoint(a)))
+}
+
+// IsMember checks that x encodes a point of the prime order subgroup, which
+// rules out the small order points of the curve.
+func (ed25519Group) IsMember(x *big.Int) bool {
+	if x == nil || x.Sign() < 0 || x.BitLen() > 256 {
+		return false
+	}
+
+	p := ed25519Suite.Point()
+	if err := p.UnmarshalBinary(x.FillBytes(make([]byte, 32))); err != nil {
+		return false
+	}
+
+	// l * P = (l - 1) * P + P is the identity only in the subgroup
+	lm1 := new(big.Int).Sub(ed25519Order, big.NewInt(1))
+	lp := ed25519Suite.Point().Mul(intToScalar(lm1), p)
+	return lp.Add(lp, p).Equal(ed25519Suite.Point().Null())
+}
+
+// HashToElement tries successive hashes of data until one decodes to a point,
+// which is multiplied by the cofactor 8 to land in the subgroup.
+func (ed25519Group) HashToElement(data []byte) *big.Int {
+	eight := big.NewInt(8)
+	for counter := uint32(0); ; counter++ {
+		p := ed25519Suite.Point()
+		if err := p.UnmarshalBinary(expandHash(data, counter, 32)); err != nil {
+			continue
+		}
+
+		p.Mul(intToScalar(eight), p)
+		if !p.Equal(ed25519Suite.Point().Null()) {
+			return pointToInt(p)
+		}
+	}
+}
+
+func pointToInt(p kyber.Point) *big.Int {
+	buf, _ := p.MarshalBinary()
+	return new(big.Int).SetBytes(buf)
+}
+
+// intToPoint decodes a point. Encodings that are not points, which IsMember
+// rejects, decode to the identity.
+func intToPoint(x *big.Int) kyber.Point {
+	p := ed25519Suite.Point()
+	if x == nil || x.Sign() < 0 || x.BitLen() > 256 {
+		return p.Null()
+	}
+
+	if err := p.UnmarshalBinary(x.FillBytes(make([]byte, 32))); err != nil {
+		return p.Null()
+	}
+	return p
+}
+
+// intToScalar reduces k mod l into a kyber scalar, which is little-endian.
+func intToScalar(k *big.Int) kyber.Scalar {
+	buf := new(big.Int).Mod(k, ed25519Order).FillBytes(make([]byte, 32))
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	return ed25519Suite.Scalar().SetBytes(buf)
+}
@@ -0,0 +1,161 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// States of an election. An election is a draft until the trustees hold it
+// frozen. They open the voting when its window starts and close it when it
+// ends, then they tally it when asked to, and the result is published once
+// their shares of the tally are sent. The trustees agree on each transition
+// by recording it in the blockchain of the election.
+const (
+	StateDraft     = "draft"
+	StateFrozen    = "frozen"
+	StateOpen      = "open"
+	StateClosed    = "closed"
+	StateTallying  = "tallying"
+	StatePublished = "published"
+)
+
+// ClockSkew is how far the clocks of two trustees may differ: a trustee takes
+// a transition that is due this much later by its own clock.
+const ClockSkew = time.Minute
+
+// DefaultVotingPeriod is how long the voting lasts if its end isn't given.
+const DefaultVotingPeriod = time.Hour
+
+// NextState gets the state an election moves to from the given state, or ""
+// from the last one.
+func NextState(state string) string {
+	switch state {
+	case StateDraft:
+		return StateFrozen
+	case StateFrozen:
+		return StateOpen
+	case StateOpen:
+		return StateClosed
+	case StateClosed:
+		return StateTallying
+	case StateTallying:
+		return StatePublished
+	}
+
+	return ""
+}
+
+// VotingWindow parses the times the voting of the election opens and closes
+// at, given in RFC 3339.
+func (e *Election) VotingWindow() (time.Time, time.Time, error) {
+	start, err := time.Parse(time.RFC3339, e.VotingStartsAt)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start of the voting: %s", err)
+	}
+
+	end, err := time.Parse(time.RFC3339, e.VotingEndsAt)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end of the voting: %s", err)
+	}
+
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, errors.New("the voting ends before it starts")
+	}
+
+	return start, end, nil
+}
+
+// SetVotingWindow sets the times the voting of the election opens and closes
+// at.
+func (e *Election) SetVotingWindow(start time.Time, end time.Time) error {
+	if !start.Before(end) {
+		return errors.New("the voting ends before it starts")
+	}
+
+	e.VotingStartsAt = start.UTC().Format(time.RFC3339)
+	e.VotingEndsAt = end.UTC().Format(time.RFC3339)
+	return nil
+}
+
+// ValidateTimes checks that the election is frozen at a valid time and that
+// its voting window is valid.
+func (e *Election) ValidateTimes() error {
+	if _, err := time.Parse(time.RFC3339, e.FrozenAt); err != nil {
+		return fmt.Errorf("invalid freezing time: %s", err)
+	}
+
+	_, _, err := e.VotingWindow()
+	return err
+}
+
+// CheckWindow checks that a ballot cast at the given time is cast while the
+// voting is open.
+func (e *Election) CheckWindow(at time.Time) error {
+	start, end, err := e.VotingWindow()
+	if err != nil {
+		return err
+	}
+
+	if at.Before(start) {
+		return errors.New("the voting is not open yet")
+	}
+	if !at.Before(end) {
+		return errors.New("the voting is closed")
+	}
+
+	return nil
+}
+
+// A Transition moves an election from a state to the next one. At is the time
+// a trustee proposed it at, in RFC 3339.
+type Transition struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	At   string `json:"at"`
+}
+
+// NewTransition creates the transition from the given state, proposed at the
+// given time.
+func NewTransition(from string, at time.Time) *Transition {
+	return &Transition{
+		From: from,
+		To:   NextState(from),
+		At:   at.UTC().Format(time.RFC3339),
+	}
+}
+
+// CheckTransition checks that the election can make the transition from the
+// given state at the given time: the voting opens when its window starts and
+// closes when it ends, up to ClockSkew, it is never opened once its window has
+// ended, and the other transitions are made in order.
+func (e *Election) CheckTransition(t *Transition, state string, now time.Time) error {
+	if t == nil || t.From != state || t.To == "" || t.To != NextState(state) {
+		return errors.New("invalid transition")
+	}
+
+	if _, err := time.Parse(time.RFC3339, t.At); err != nil {
+		return fmt.Errorf("invalid transition time: %s", err)
+	}
+
+	start, end, err := e.VotingWindow()
+	if err != nil {
+		return err
+	}
+
+	switch t.To {
+	case StateOpen:
+		if now.Add(ClockSkew).Before(start) {
+			return errors.New("the voting doesn't start yet")
+		}
+		if !now.Before(end) {
+			return errors.New("the voting already ended")
+		}
+	case StateClosed:
+		if now.Add(ClockSkew).Before(end) {
+			return errors.New("the voting doesn't end yet")
+		}
+	}
+
+	return nil
+}
@@ -1,12 +1,15 @@
 package message
 
 import (
+	"bytes"
 	"crypto/sha256"
-	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
 	"net"
+	"strings"
 )
 
 type Election struct {
@@ -36,12 +39,22 @@ type Election struct {
 
 	VotersHash string `json:"voters_hash"`
 
+	// Weights are the weights of the ballots of the voters, by voter uuid.
+	Weights map[string]int64 `json:"weights,omitempty"`
+
+	// Revote is the policy for the voters who cast more than one ballot,
+	// see ComputeRevote.
+	Revote string `json:"revote,omitempty"`
+
 	VotingEndsAt   string `json:"voting_ends_at"`
 	VotingStartsAt string `json:"voting_starts_at"`
 
 	Secret *big.Int
 
 	Trustees []*Trustee `json:"trustee"`
+
+	// Threshold is the number of trustees needed to decrypt the tally.
+	Threshold int `json:"threshold"`
 }
 
 type Question struct {
@@ -53,17 +66,33 @@ type Question struct {
 
 	Max int `json:"max"`
 
+	// MaxScore is the highest score of an answer to a score question.
+	MaxScore int `json:"max_score,omitempty"`
+
 	Min int `json:"min"`
 
 	Question string `json:"question"`
 
 	ResultType string `json:"result_type"`
 
+	// Seats is the number of answers a ranked question elects.
+	Seats int `json:"seats,omitempty"`
+
 	ShortName string `json:"short_name"`
 
 	TallyType string `json:"tally_type"`
 }
 
+// ComputeMax gets the maximum number of selections for a question. A Max of
+// 0 means that every answer may be selected.
+func (q *Question) ComputeMax() int {
+	if q.Max == 0 {
+		return len(q.Answers)
+	}
+
+	return q.Max
+}
+
 /* Struct definition */
 type Message struct {
 
@@ -173,15 +202,28 @@ type WrappedRumorTLCMessage struct {
 	RumorMessage      *RumorMessage
 	TLCMessage        *TLCMessage
 	BlockRumorMessage *BlockRumorMessage
+	DKGMessage        *DKGMessage
+	ConsensusMessage  *ConsensusMessage
 }
 
 type Trustee struct {
 	DecryptionFactors [][]*big.Int `json:"decryption_factors"`
 
+	// DecryptionProofs proves that each of the DecryptionFactors was
+	// computed with the secret behind PublicKey.
+	DecryptionProofs [][]*ZKProof `json:"decryption_proofs"`
+
 	PublicKey *Key `json:"public_key"`
 
 	PublicKeyHash string `json:"public_key_hash"`
 
+	// PoK proves that the trustee knows the secret behind PublicKey.
+	PoK *SchnorrProof `json:"pok"`
+
+	// Index is the point at which the trustee's share of the election
+	// secret was evaluated.
+	Index int `json:"index"`
+
 	Uuid string `json:"uuid"`
 
 	Address string `json:"address"`
@@ -197,6 +239,9 @@ type Key struct {
 	ExponentPrime *big.Int `json:"q"`
 
 	PublicValue *big.Int `json:"y"`
+
+	// GroupName selects the group of the key, see Group.
+	GroupName string `json:"group"`
 }
 
 /************************ Message for blockchain ************************/
@@ -211,34 +256,52 @@ type CastBallot struct {
 	// VoteHash is the SHA-256 hash of the JSON corresponding to Vote.
 	VoteHash string `json:"vote_hash"`
 
-	// VoterHash is the SHA-256 hash of the Voter JSON corresponding to
-	// VoterUuid.
+	// VoterHash is the hash of the entry of VoterUuid on the voter roll,
+	// see RollEntry.Hash.
 	VoterHash string `json:"voter_hash"`
 
 	// VoterUuid is the unique identifier for the Voter that cast Vote.
 	VoterUuid string `json:"voter_uuid"`
+
+	// Eligibility proves that the voter is on the roll of the election.
+	Eligibility *RollProof `json:"eligibility,omitempty"`
+
+	// Signature is the signature of the voter on the ballot, hex encoded,
+	// see CastBallot.Sign. It is kept in the block of the ballot.
+	Signature string `json:"signature,omitempty"`
 }
 
 func (cb *CastBallot) BigInt2Str() {
-	/* This func convert bigint in ballot to string */
+	/*
+		This func convert bigint in ballot to string
+		Only the ciphertexts and the proofs are kept, the plaintext answer and
+		the randomness of a ballot must never be gossiped
+	*/
 
 	for _, answer := range cb.Vote.Answers {
 		// Convert all big int to string
 		answer.ChoicesStr = make([]*CiphertextStr, len(answer.Choices))
-		answer.RandomnessStr = make([]*string, len(answer.Randomness))
 
 		for i, choice := range answer.Choices {
 			answer.ChoicesStr[i] = NewCiphertextStr(choice.Alpha, choice.Beta)
 		}
-		for i, r := range answer.Randomness {
-			// Convert all big int to string in randomness
-			result := r.String()
-			answer.RandomnessStr[i] = &result
+		answer.IndividualProofsStr = make([]*DisjunctiveZKProofStr, len(answer.IndividualProofs))
+		for i, proof := range answer.IndividualProofs {
+			answer.IndividualProofsStr[i] = NewDisjunctiveZKProofStr(proof)
+		}
+		answer.OverallProofStr = NewDisjunctiveZKProofStr(answer.OverallProof)
+		answer.RandomnessProofsStr = make([]*SchnorrProofStr, len(answer.RandomnessProofs))
+		for i, proof := range answer.RandomnessProofs {
+			answer.RandomnessProofsStr[i] = proof.BigInt2Str()
 		}
 
-		// Remove all big int pointers
+		// Remove all big int pointers and secret material
 		answer.Choices = make([]*Ciphertext, 0)
-		answer.Randomness = make([]*big.Int, 0)
+		answer.IndividualProofs = make([]DisjunctiveZKProof, 0)
+		answer.OverallProof = make(DisjunctiveZKProof, 0)
+		answer.RandomnessProofs = nil
+		answer.Answer = nil
+		answer.Randomness = nil
 	}
 }
 
@@ -248,28 +311,81 @@ func (cb *CastBallot) Str2BigInt() {
 	for _, answer := range cb.Vote.Answers {
 		// Convert all string to big int
 		answer.Choices = make([]*Ciphertext, len(answer.ChoicesStr))
-		answer.Randomness = make([]*big.Int, len(answer.RandomnessStr))
 
 		for i, choiceStr := range answer.ChoicesStr {
 			answer.Choices[i] = NewCiphertext(choiceStr.Alpha, choiceStr.Beta)
 		}
-		for i, r := range answer.RandomnessStr {
-			result := new(big.Int)
-			result, ok := result.SetString(*r, 10)
-			if !ok {
-				fmt.Println("Cannot convert randomness str to big int")
-				return
+		answer.IndividualProofs = make([]DisjunctiveZKProof, len(answer.IndividualProofsStr))
+		for i, proofStr := range answer.IndividualProofsStr {
+			answer.IndividualProofs[i] = NewDisjunctiveZKProof(proofStr)
+		}
+		if answer.OverallProofStr != nil {
+			answer.OverallProof = NewDisjunctiveZKProof(answer.OverallProofStr)
+		}
+		if len(answer.RandomnessProofsStr) > 0 {
+			answer.RandomnessProofs = make([]*SchnorrProof, len(answer.RandomnessProofsStr))
+			for i, proofStr := range answer.RandomnessProofsStr {
+				answer.RandomnessProofs[i] = proofStr.Str2BigInt()
 			}
-			answer.Randomness[i] = result
 		}
 		// Remove all string pointers
 		answer.ChoicesStr = make([]*CiphertextStr, 0)
-		answer.RandomnessStr = make([]*string, 0)
+		answer.IndividualProofsStr = make([]*DisjunctiveZKProofStr, 0)
+		answer.OverallProofStr = nil
+		answer.RandomnessProofsStr = nil
 	}
 
 	return
 }
 
+func (cb *CastBallot) CopyStr2BigInt() (*CastBallot, error) {
+	/*
+		This func returns a copy of a ballot converted to string, as it is
+		gossiped, converted back to big int, so that the ballot shared with
+		the blockchain isn't touched
+	*/
+
+	if cb.Vote == nil {
+		return nil, errors.New("missing ballot")
+	}
+
+	vote := *cb.Vote
+	vote.Answers = make([]*EncryptedAnswer, len(cb.Vote.Answers))
+	for i, answer := range cb.Vote.Answers {
+		if answer == nil {
+			return nil, fmt.Errorf("missing answer %d", i)
+		}
+		copied := *answer
+		vote.Answers[i] = &copied
+	}
+
+	copied := *cb
+	copied.Vote = &vote
+	copied.Str2BigInt()
+	return &copied, nil
+}
+
+func (cb *CastBallot) CheckTrackerStr() error {
+	/*
+		This func checks the tracker of a ballot converted to string, as it
+		is gossiped
+	*/
+
+	copied, err := cb.CopyStr2BigInt()
+	if err != nil {
+		return err
+	}
+	return copied.CheckTracker()
+}
+
+// A RejectedBallot is a cast ballot that failed verification and was left out
+// of the tally.
+type RejectedBallot struct {
+	VoterUuid string `json:"voter_uuid"`
+
+	Reason string `json:"reason"`
+}
+
 // A Ballot is a cryptographic vote in an Election.
 type Ballot struct {
 	// Answers is a list of answers to the Election specified by
@@ -289,10 +405,22 @@ type EncryptedAnswer struct {
 	Choices    []*Ciphertext `json:"choices"`
 	ChoicesStr []*CiphertextStr
 
+	IndividualProofs    []DisjunctiveZKProof `json:"individual_proofs"`
+	IndividualProofsStr []*DisjunctiveZKProofStr
+
+	OverallProof    DisjunctiveZKProof `json:"overall_proof"`
+	OverallProofStr *DisjunctiveZKProofStr
+
+	// RandomnessProofs replaces the other proofs for a mixnet question,
+	// see Question.IsMixnet.
+	RandomnessProofs    []*SchnorrProof `json:"randomness_proofs,omitempty"`
+	RandomnessProofsStr []*SchnorrProofStr
+
+	// Answer and Randomness are only set on a ballot that reveals its vote,
+	// which trustees refuse, see Ballot.CheckSealed.
 	Answer []int64 `json:"answer,omitempty"`
 
-	Randomness    []*big.Int `json:"randomness,omitempty"`
-	RandomnessStr []*string
+	Randomness []*big.Int `json:"randomness,omitempty"`
 }
 
 type Ciphertext struct {
@@ -351,10 +479,7 @@ type Block struct {
 	// Hash of current block
 	CurrentHash [32]byte
 
-	// Fitness which decide the priority to be added into blockchain
-	Fitness uint64
-
-	// Round
+	// Round, the sequence number of the block in the blockchain
 	Round int
 
 	// Source
@@ -363,15 +488,32 @@ type Block struct {
 	// Election name
 	ElectionName string
 
-	// Ballot
-	CastBallot *CastBallot
+	// Ballots, in the order they are recorded
+	CastBallots []*CastBallot
+
+	// Transition of the election, in a block without ballots
+	Transition *Transition
 }
 
 func (b *Block) ToString() (blockStr string) {
-	blockStr = fmt.Sprintf("Election: %s Round: %d: Voter: %s Hash: %x",
+	if b.Transition != nil {
+		blockStr = fmt.Sprintf("Election: %s Round: %d: Transition: %s to %s Hash: %x",
+			b.ElectionName,
+			b.Round,
+			b.Transition.From,
+			b.Transition.To,
+			b.CurrentHash)
+		return
+	}
+
+	voters := make([]string, len(b.CastBallots))
+	for i, cb := range b.CastBallots {
+		voters[i] = cb.VoterUuid
+	}
+	blockStr = fmt.Sprintf("Election: %s Round: %d: Voters: %s Hash: %x",
 		b.ElectionName,
 		b.Round,
-		b.CastBallot.VoterUuid,
+		strings.Join(voters, " "),
 		b.CurrentHash)
 	return
 }
@@ -388,34 +530,270 @@ type BlockRumorMessage struct {
 	Proof  *Proof // Ptr to proof
 }
 
+// Types of DKGMessage, in the order of the phases of the key generation.
+const (
+	DKGKey           = "key"
+	DKGDeal          = "deal"
+	DKGComplaint     = "complaint"
+	DKGJustification = "justification"
+	DKGQualified     = "qualified"
+)
+
+// An EncryptedShare is the share of a dealer for the trustee Index, hidden
+// with hashed ElGamal under the ephemeral key of that trustee.
+type EncryptedShare struct {
+	Index int
+	C1    string
+	C2    string
+}
+
+// A DKGMessage is gossiped among the trustees while they jointly generate the
+// key of an election. Big integers are carried as decimal strings.
+type DKGMessage struct {
+	Origin       string
+	ID           uint32
+	ElectionName string
+	Index        int // trustee index of the sender
+	Type         string
+
+	// DKGKey: ephemeral encryption key, Feldman commitments g^a_k and a
+	// proof of knowledge of a_0, so that no dealer can choose its
+	// contribution to the joint key after seeing the others
+	EncKey      string
+	Commitments []string
+	PoK         *SchnorrProofStr
+
+	// DKGDeal: one encrypted share per trustee
+	Shares []*EncryptedShare
+
+	// DKGComplaint: index of the accused dealer
+	Accused int
+
+	// DKGJustification: share of the sender for the complaining trustee
+	Target int
+	Share  string
+
+	// DKGQualified: the dealers the sender found qualified, sorted
+	Qualified []int
+
+	Proof *Proof // Ptr to proof
+}
+
+// Types of ConsensusVote, in the order of the phases of a round of PBFT, and
+// of a change of view.
+const (
+	ConsensusPrePrepare = "pre-prepare"
+	ConsensusPrepare    = "prepare"
+	ConsensusCommit     = "commit"
+	ConsensusViewChange = "view-change"
+	ConsensusNewView    = "new-view"
+)
+
+// A ConsensusMessage is gossiped among the trustees of an election to agree on
+// the blocks of its blockchain.
+type ConsensusMessage struct {
+	Origin       string
+	ID           uint32
+	ElectionName string
+
+	Vote *ConsensusVote
+
+	// ConsensusPrePrepare: the block proposed by the leader of the view
+	Block *Block
+
+	// ConsensusNewView: the view changes the new leader collected
+	ViewChanges []*ConsensusVote
+
+	// ConsensusViewChange and ConsensusNewView: the prepare votes proving
+	// that the digest of the vote was prepared
+	Prepares []*ConsensusVote
+
+	Proof *Proof // Ptr to proof
+}
+
+// A ConsensusVote is signed by a trustee with its share of the election key.
+// Digest is the hash of the block of round Seq the vote is for, hex encoded.
+type ConsensusVote struct {
+	Index  int // trustee index of the signer
+	Type   string
+	View   int
+	Seq    int
+	Digest string
+
+	// ConsensusViewChange and ConsensusNewView: the view Digest was
+	// prepared in, -1 if no block was prepared
+	Prepared int
+
+	Signature *SchnorrProofStr
+}
+
 func (b *Block) Hash() (out [32]byte) {
 	/*
 		This func provide the hash of block
 	*/
 
-	h := sha256.New()
-	h.Write(b.PrevHash[:])
+	return ChainHash(b.PrevHash, b.Digest())
+}
 
-	// Hash the ballot data
-	referenceString := b.CastBallot.VoteHash + b.CastBallot.VoterHash
-	voteHashBytes := sha256.Sum256([]byte(referenceString))
-	//voteHashStr := hex.EncodeToString(voteHashBytes[:])
+// Digest is the hash of the transition of the block, or the Merkle root of
+// its ballots.
+func (b *Block) Digest() [32]byte {
+	if b.Transition != nil {
+		return TransitionDigest(b.Transition)
+	}
 
-	// Hash current block with prev block's hash
-	h.Write(voteHashBytes[:])
-	copy(out[:], h.Sum(nil))
+	return BallotsRoot(b.CastBallots)
+}
 
+// The ballots of a block are committed to as the root of a Merkle tree over
+// their digests, so that a voter can check that its ballot is in a block from
+// the audit path of its digest, without the other ballots of the block. The
+// digest of a ballot commits to its vote through the tracker only, so a block
+// is only valid if the tracker of each of its ballots is the one of its vote,
+// see Block.CheckBallots.
+
+func ballotLeaves(ballots []*CastBallot) [][]byte {
+	leaves := make([][]byte, len(ballots))
+	for i, cb := range ballots {
+		digest := BallotDigest(cb.VoteHash, cb.VoterHash, cb.Signature)
+		leaves[i] = merkleLeaf(digest[:])
+	}
+	return leaves
+}
+
+// CheckBallots checks that the tracker of each ballot of the block, converted
+// to string as it is gossiped, is the one of its vote. Otherwise the vote of a
+// ballot could be swapped without changing the hash of the block.
+func (b *Block) CheckBallots() error {
+	for i, cb := range b.CastBallots {
+		if cb == nil {
+			return fmt.Errorf("missing ballot %d", i)
+		}
+		if err := cb.CheckTrackerStr(); err != nil {
+			return fmt.Errorf("ballot %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// BallotsRoot computes the Merkle root of the given ballots.
+func BallotsRoot(ballots []*CastBallot) (out [32]byte) {
+	copy(out[:], merkleRoot(ballotLeaves(ballots)))
 	return
 }
 
+// BallotPath gets the audit path of the ballot at index in the block, hex
+// encoded.
+func (b *Block) BallotPath(index int) []string {
+	path := merklePath(index, ballotLeaves(b.CastBallots))
+	out := make([]string, len(path))
+	for i, h := range path {
+		out[i] = hex.EncodeToString(h)
+	}
+	return out
+}
+
+// TransitionDigest is the hash of the transition of the election that a block
+// commits to.
+func TransitionDigest(t *Transition) [32]byte {
+	js, _ := json.Marshal(t)
+	return sha256.Sum256(js)
+}
+
+// BallotDigest is the hash of the ballot data that a block commits to. The
+// signature of the voter is committed to as well, so that it can be audited.
+// The vote is committed to by its tracker voteHash.
+func BallotDigest(voteHash string, voterHash string, signature string) [32]byte {
+	referenceString := voteHash + voterHash + signature
+	return sha256.Sum256([]byte(referenceString))
+}
+
+// ChainHash hashes the digest of a block with the hash of the previous block.
+func ChainHash(prevHash [32]byte, digest [32]byte) (out [32]byte) {
+	h := sha256.New()
+	h.Write(prevHash[:])
+	h.Write(digest[:])
+	copy(out[:], h.Sum(nil))
+	return
+}
+
+// An InclusionProof shows that the ballot with a given tracker is in the
+// blockchain of an election. The ballot is at Index of the Size ballots of
+// block Round, and Path is the audit path of its digest. Links[i] is the
+// digest of block i+1, so that the hash of every block from the genesis block
+// to Head can be recomputed. Hashes are hex encoded.
+type InclusionProof struct {
+	Election  string   `json:"election"`
+	Tracker   string   `json:"tracker"`
+	VoterHash string   `json:"voter_hash"`
+	Signature string   `json:"signature,omitempty"`
+	Round     int      `json:"round"`
+	Index     int      `json:"index"`
+	Size      int      `json:"size"`
+	Path      []string `json:"path"`
+	Links     []string `json:"links"`
+	Head      string   `json:"head"`
+}
+
+// Verify checks that the ballot is in block Round of a chain ending at Head.
+// Head must be compared with the head reported by other trustees.
+func (p *InclusionProof) Verify() error {
+	if p.Round < 1 || p.Round > len(p.Links) {
+		return errors.New("round out of the chain")
+	}
+	if p.Index < 0 || p.Index >= p.Size {
+		return errors.New("ballot out of the block")
+	}
+
+	path := make([][]byte, len(p.Path))
+	for i, s := range p.Path {
+		h, err := hex.DecodeString(s)
+		if err != nil || len(h) != sha256.Size {
+			return fmt.Errorf("invalid node %d of the ballot path", i)
+		}
+		path[i] = h
+	}
+
+	ballot := BallotDigest(p.Tracker, p.VoterHash, p.Signature)
+	root, err := merkleRootFromPath(p.Index, p.Size, merkleLeaf(ballot[:]), path)
+	if err != nil {
+		return err
+	}
+
+	// the genesis block has the hash of nothing
+	prev := sha256.Sum256(make([]byte, 0))
+	for i, link := range p.Links {
+		b, err := hex.DecodeString(link)
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid link %d", i+1)
+		}
+		var digest [32]byte
+		copy(digest[:], b)
+
+		if i+1 == p.Round && !bytes.Equal(digest[:], root) {
+			return errors.New("ballot is not in its block")
+		}
+		prev = ChainHash(prev, digest)
+	}
+
+	if hex.EncodeToString(prev[:]) != p.Head {
+		return errors.New("chain does not end at head")
+	}
+	return nil
+}
+
 /***************************************************************************/
 func (m *WrappedRumorTLCMessage) GetOrigin() (origin string) {
 	if m.RumorMessage != nil {
 		origin = m.RumorMessage.Origin
 	} else if m.TLCMessage != nil {
 		origin = m.TLCMessage.Origin
-	} else {
+	} else if m.BlockRumorMessage != nil {
 		origin = m.BlockRumorMessage.Origin
+	} else if m.DKGMessage != nil {
+		origin = m.DKGMessage.Origin
+	} else {
+		origin = m.ConsensusMessage.Origin
 	}
 	return
 }
@@ -425,8 +803,12 @@ func (m *WrappedRumorTLCMessage) GetID() (ID uint32) {
 		ID = m.RumorMessage.ID
 	} else if m.TLCMessage != nil {
 		ID = m.TLCMessage.ID
-	} else {
+	} else if m.BlockRumorMessage != nil {
 		ID = m.BlockRumorMessage.ID
+	} else if m.DKGMessage != nil {
+		ID = m.DKGMessage.ID
+	} else {
+		ID = m.ConsensusMessage.ID
 	}
 	return
 }
@@ -445,6 +827,8 @@ type GossipPacket struct {
 	TLCMessage        *TLCMessage
 	ACK               *TLCAck
 	BlockRumorMessage *BlockRumorMessage
+	DKGMessage        *DKGMessage
+	ConsensusMessage  *ConsensusMessage
 }
 
 type Gossiper struct {
@@ -484,126 +868,322 @@ func (status *StatusPacket) ToMap() (statusMap StatusMap) {
 	return
 }
 
-func (e *Election) Tally(votes []*CastBallot, t *Trustee, trusteeSecrets *big.Int) {
-	tallies, _ := e.AccumulateTallies(votes)
-
-	df := make([][]*big.Int, len(e.Questions))
-	//dp := make([][]*ZKProof, len(e.Questions))
-	for i, q := range e.Questions {
-		df[i] = make([]*big.Int, len(q.Answers))
-		//dp[i] = make([]*ZKProof, len(q.Answers))
-		for j := range q.Answers {
-			df[i][j] = new(big.Int).Exp(tallies[i][j].Alpha, trusteeSecrets, t.PublicKey.Prime)
-			//if dp[i][j], err = NewPartialDecryptionProof(tallies[i][j], df[i][j], trusteeSecrets[k], t.PublicKey); err != nil {
-			//  glog.Errorf("Couldn't create a proof for (%d, %d) for trustee %d\n", i, j, k)
-			//  return nil, err
-			//}
+// Tally computes the decryption factors of trustee t for the encrypted tally
+// of the votes, with a proof that each factor used the trustee's secret.
+func (e *Election) Tally(votes []*CastBallot, t *Trustee, trusteeSecrets *big.Int) error {
+	tallies, _, _ := e.AccumulateTallies(votes)
+
+	return t.ComputeDecryptionFactors(tallies, trusteeSecrets)
+}
+
+// ComputeDecryptionFactors sets the decryption factors of trustee t for the
+// ciphertexts, be they the tallies of the questions or mixed ballots, with a
+// proof that each factor used the trustee's secret.
+func (t *Trustee) ComputeDecryptionFactors(ciphertexts [][]*Ciphertext, secret *big.Int) error {
+	df := make([][]*big.Int, len(ciphertexts))
+	dp := make([][]*ZKProof, len(ciphertexts))
+	for i := range ciphertexts {
+		df[i] = make([]*big.Int, len(ciphertexts[i]))
+		dp[i] = make([]*ZKProof, len(ciphertexts[i]))
+		for j, c := range ciphertexts[i] {
+			df[i][j] = t.PublicKey.Group().Exp(c.Alpha, secret)
+			var err error
+			if dp[i][j], err = NewPartialDecryptionProof(c, df[i][j], secret, t.PublicKey); err != nil {
+				fmt.Printf("Couldn't create a proof for (%d, %d)\n", i, j)
+				return err
+			}
 		}
 	}
 
 	t.DecryptionFactors = df
-	//t.DecryptionProofs = dp
+	t.DecryptionProofs = dp
+	return nil
 }
 
-func (election *Election) AccumulateTallies(votes []*CastBallot) ([][]*Ciphertext, []string) {
+// VerifyDecryptionFactors checks that the trustee sent one decryption factor
+// per question and answer, each with a valid partial decryption proof.
+func (t *Trustee) VerifyDecryptionFactors(tallies [][]*Ciphertext) error {
+	if t == nil || t.PublicKey == nil {
+		return errors.New("missing public key")
+	}
+
+	if len(t.DecryptionFactors) != len(tallies) || len(t.DecryptionProofs) != len(tallies) {
+		return errors.New("wrong number of decryption factors")
+	}
+
+	for i := range tallies {
+		if len(t.DecryptionFactors[i]) != len(tallies[i]) || len(t.DecryptionProofs[i]) != len(tallies[i]) {
+			return fmt.Errorf("wrong number of decryption factors for question %d", i)
+		}
+
+		for j := range tallies[i] {
+			if !t.DecryptionProofs[i][j].VerifyPartialDecryption(tallies[i][j], t.DecryptionFactors[i][j], t.PublicKey) {
+				return fmt.Errorf("invalid decryption proof for (%d, %d)", i, j)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (election *Election) AccumulateTallies(votes []*CastBallot) ([][]*Ciphertext, []string, []*RejectedBallot) {
+	tallies, fingerprints, rejected, _ := election.accumulateTallies(votes)
+	return tallies, fingerprints, rejected
+}
+
+// accumulateTallies also returns the total weight of the ballots it counted.
+func (election *Election) accumulateTallies(votes []*CastBallot) ([][]*Ciphertext, []string, []*RejectedBallot, int64) {
 	// Initialize the tally structures for homomorphic accumulation.
 
+	g := election.PublicKey.Group()
 	tallies := make([][]*Ciphertext, len(election.Questions))
-	fingerprints := make([]string, len(votes))
-	for i := range tallies {
-		tallies[i] = make([]*Ciphertext, len(election.Questions[i].Answers))
+	fingerprints := make([]string, 0, len(votes))
+	for i, q := range election.Questions {
+		// the ballots for a mixnet question are mixed instead
+		if q.IsMixnet() {
+			tallies[i] = make([]*Ciphertext, 0)
+			continue
+		}
+
+		tallies[i] = make([]*Ciphertext, len(q.Answers))
 		for j := range tallies[i] {
-			// Each tally must start at 1 for the multiplicative
+			// Each tally must start at the identity for the
 			// homomorphism to work.
-			tallies[i][j] = &Ciphertext{big.NewInt(1), big.NewInt(1)}
+			tallies[i][j] = &Ciphertext{g.Identity(), g.Identity()}
 		}
 	}
 
-	// Verify the votes and accumulate the tallies.
-	//resp := make(chan bool)
+	// Verify the votes in parallel, then accumulate only the ones that
+	// passed.
+	errs := election.VerifyBallots(votes)
+	rejected := make([]*RejectedBallot, 0)
+	counted := int64(0)
 	for i := range votes {
-		// Shadow i as a new variable for the goroutine.
-		i := i
-		//go func(c chan bool) {
-		//	glog.Infof("Verifying vote from %s\n", votes[i].VoterUuid)
-		//	c <- votes[i].Vote.Verify(election)
-		//	return
-		//}(resp)
-
-		h := sha256.Sum256(votes[i].JSON)
-		encodedHash := base64.StdEncoding.EncodeToString(h[:])
-		fingerprint := encodedHash[:len(encodedHash)-1]
+		if errs[i] != nil {
+			voterUuid := ""
+			if votes[i] != nil {
+				voterUuid = votes[i].VoterUuid
+			}
+			fmt.Printf("Vote verification failed for %s: %s\n", voterUuid, errs[i])
+			rejected = append(rejected, &RejectedBallot{voterUuid, errs[i].Error()})
+			continue
+		}
+
+		// the fingerprint of a counted ballot is its tracker, recomputed
+		// rather than trusted from the cast ballot
+		fingerprint, err := votes[i].Vote.Tracker()
+		if err != nil {
+			fmt.Printf("Couldn't compute the tracker of %s: %s\n", votes[i].VoterUuid, err)
+			rejected = append(rejected, &RejectedBallot{votes[i].VoterUuid, err.Error()})
+			continue
+		}
 		fingerprints = append(fingerprints, fingerprint)
 
-		for j, q := range election.Questions {
-			for k := range q.Answers {
-				// tally_j_k = (tally_j_k * ballot_i_j_k) mod p
-				tallies[j][k].MulCiphertexts(votes[i].Vote.Answers[j].Choices[k], election.PublicKey.Prime)
+		// a weighted ballot counts as many times as its weight
+		w := election.Weight(votes[i].VoterUuid)
+		counted += w
+		for j := range election.Questions {
+			for k := range tallies[j] {
+				// tally_j_k = tally_j_k * ballot_i_j_k^w
+				choice := votes[i].Vote.Answers[j].Choices[k]
+				if w != 1 {
+					choice = choice.ExpCiphertext(w, g)
+				}
+				tallies[j][k].MulCiphertexts(choice, g)
 			}
 		}
 	}
 
-	// Make sure all the votes passed verification.
-	//for _ = range votes {
-	//	if !<-resp {
-	//		glog.Error("Vote verification failed")
-	//		return nil, nil
-	//	}
-	//}
-
-	return tallies, fingerprints
+	return tallies, fingerprints, rejected, counted
 }
 
-func (prod *Ciphertext) MulCiphertexts(other *Ciphertext, prime *big.Int) *Ciphertext {
-	prod.Alpha.Mul(prod.Alpha, other.Alpha)
-	prod.Alpha.Mod(prod.Alpha, prime)
-	prod.Beta.Mul(prod.Beta, other.Beta)
-	prod.Beta.Mod(prod.Beta, prime)
+func (prod *Ciphertext) MulCiphertexts(other *Ciphertext, group Group) *Ciphertext {
+	prod.Alpha = group.Mul(prod.Alpha, other.Alpha)
+	prod.Beta = group.Mul(prod.Beta, other.Beta)
 	return prod
 }
 
 type Result [][]int64
 
-func (e *Election) Tallier(votes []*CastBallot, trustees []*Trustee) (Result, error) {
-	tallies, _ := e.AccumulateTallies(votes)
+// ComputeThreshold gets the number of trustees needed to decrypt. Elections
+// without a threshold need all of their trustees.
+func (e *Election) ComputeThreshold() int {
+	if e.Threshold > 0 {
+		return e.Threshold
+	}
+
+	return len(e.Trustees)
+}
+
+// MinThreshold gets the smallest threshold of an election with n trustees: a
+// majority of them, and at least two, so that no trustee decrypts the ballots
+// alone.
+func MinThreshold(n int) int {
+	if n/2+1 < 2 {
+		return 2
+	}
+
+	return n/2 + 1
+}
+
+// CheckThreshold checks that the election has trustees and that its
+// threshold is at least MinThreshold of them.
+func (e *Election) CheckThreshold() error {
+	n := len(e.Trustees)
+	if n == 0 {
+		return errors.New("the election has no trustees")
+	}
+
+	t := e.ComputeThreshold()
+	if t < MinThreshold(n) || t > n {
+		return fmt.Errorf("threshold %d of %d trustees, at least %d are needed", t, n, MinThreshold(n))
+	}
+	return nil
+}
+
+// SelectTrustees picks the first threshold trustees, by distinct index, whose
+// public key matches the election and whose decryption factors are proven
+// correct. Misbehaving trustees are named in the error if too few remain.
+func (e *Election) SelectTrustees(trustees []*Trustee, tallies [][]*Ciphertext) ([]*Trustee, error) {
+	if err := e.CheckThreshold(); err != nil {
+		return nil, err
+	}
+	threshold := e.ComputeThreshold()
+
+	honest := make([]*Trustee, 0, threshold)
+	seen := make(map[int]bool)
+	misbehaving := make([]string, 0)
+	for _, t := range trustees {
+		if len(honest) == threshold {
+			break
+		}
+
+		if t == nil || t.Index <= 0 || seen[t.Index] {
+			continue
+		}
+
+		err := e.CheckTrusteeKey(t)
+		if err == nil {
+			err = t.VerifyDecryptionFactors(tallies)
+		}
+		if err != nil {
+			fmt.Printf("Trustee %s misbehaved: %s\n", t.Address, err)
+			misbehaving = append(misbehaving, fmt.Sprintf("%s (%s)", t.Address, err))
+			continue
+		}
+
+		seen[t.Index] = true
+		honest = append(honest, t)
+	}
+
+	if len(honest) < threshold {
+		return nil, fmt.Errorf("only %d of the %d trustees needed sent valid decryption factors, misbehaving trustees: %v",
+			len(honest), threshold, misbehaving)
+	}
+
+	return honest, nil
+}
+
+// CheckTrusteeKey makes sure t uses the public key the election was frozen
+// with for the trustee at the same index. An election without trustees
+// accepts no key.
+func (e *Election) CheckTrusteeKey(t *Trustee) error {
+	if t.PublicKey == nil {
+		return errors.New("missing public key")
+	}
+	if len(e.Trustees) == 0 {
+		return errors.New("the election has no trustees")
+	}
+
+	for _, et := range e.Trustees {
+		if et != nil && et.Index == t.Index {
+			if et.PublicKey == nil || !et.PublicKey.SameGroup(t.PublicKey) || t.PublicKey.PublicValue == nil ||
+				et.PublicKey.PublicValue.Cmp(t.PublicKey.PublicValue) != 0 {
+				return errors.New("public key does not match the election")
+			}
+			return nil
+		}
+	}
+
+	return errors.New("unknown trustee")
+}
+
+// LagrangeCoefficient computes the coefficient of the share at index in the
+// interpolation of f(0) from the shares at indices, mod q.
+func LagrangeCoefficient(index int, indices []int, q *big.Int) *big.Int {
+	num := big.NewInt(1)
+	den := big.NewInt(1)
+	for _, m := range indices {
+		if m == index {
+			continue
+		}
+
+		// lambda = prod m / (m - index)
+		num.Mul(num, big.NewInt(int64(m)))
+		num.Mod(num, q)
+		den.Mul(den, big.NewInt(int64(m-index)))
+		den.Mod(den, q)
+	}
+
+	den.ModInverse(den, q)
+	return num.Mul(num, den).Mod(num, q)
+}
+
+// CombineDecryptionFactors interpolates alpha^x from the decryption factors
+// alpha^f(i) of the trustees at the given indices.
+func CombineDecryptionFactors(factors []*big.Int, indices []int, pk *Key) *big.Int {
+	g := pk.Group()
+	alpha := g.Identity()
+	for k, df := range factors {
+		lambda := LagrangeCoefficient(indices[k], indices, pk.ExponentPrime)
+		alpha = g.Mul(alpha, g.Exp(df, lambda))
+	}
+	return alpha
+}
+
+// Tallier decrypts the tally of the votes with the decryption factors of the
+// trustees. It also returns the total weight of the ballots counted, which is
+// the number of ballots in an election without weights.
+func (e *Election) Tallier(votes []*CastBallot, trustees []*Trustee) (Result, int64, error) {
+	tallies, _, _, counted := e.accumulateTallies(votes)
+
+	// Only combine the decryption factors of trustees that check out.
+	honest, err := e.SelectTrustees(trustees, tallies)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	indices := make([]int, len(honest))
+	for k, t := range honest {
+		indices[k] = t.Index
+	}
 
 	// For each question and each answer, reassemble the tally and search for its value.
 	// Then put this in the results.
-	maxValue := len(votes)
+	maxValue := e.MaxTally(votes)
+	table := GetDiscreteLogTable(e.PublicKey, maxValue)
 	result := make([][]int64, len(e.Questions))
-	for i, q := range e.Questions {
-		result[i] = make([]int64, len(q.Answers))
-		for j := range q.Answers {
-			alpha := big.NewInt(1)
-			for k := range trustees {
-				alpha.Mul(alpha, trustees[k].DecryptionFactors[i][j])
-				alpha.Mod(alpha, trustees[k].PublicKey.Prime)
+	for i := range e.Questions {
+		result[i] = make([]int64, len(tallies[i]))
+		for j := range tallies[i] {
+			factors := make([]*big.Int, len(honest))
+			for k := range honest {
+				factors[k] = honest[k].DecryptionFactors[i][j]
 			}
+			alpha := CombineDecryptionFactors(factors, indices, e.PublicKey)
 
-			beta := new(big.Int).ModInverse(alpha, e.PublicKey.Prime)
-			beta.Mul(beta, tallies[i][j].Beta)
-			beta.Mod(beta, e.PublicKey.Prime)
+			g := e.PublicKey.Group()
+			beta := g.Mul(tallies[i][j].Beta, g.Inv(alpha))
 
 			// This decrypted value can be anything between g^0 and g^maxValue.
-			// Try all values until we find it.
-			temp := new(big.Int)
-			val := new(big.Int)
-			var v int
-			for v = 0; v <= maxValue; v++ {
-				val.SetInt64(int64(v))
-				temp.Exp(e.PublicKey.Generator, val, e.PublicKey.Prime)
-				if temp.Cmp(beta) == 0 {
-					result[i][j] = int64(v)
-					break
-				}
-			}
-
-			if v > maxValue {
+			v, ok := table.Log(beta)
+			if !ok || v > maxValue {
 				fmt.Printf("Couldn't decrypt value (%d, %d)\n", i, j)
-				return nil, errors.New("couldn't decrypt part of the tally")
+				return nil, 0, errors.New("couldn't decrypt part of the tally")
 			}
+			result[i][j] = v
 		}
 	}
 
-	return result, nil
+	return result, counted, nil
 }
@@ -0,0 +1,47 @@
+package message
+
+import (
+	"math/big"
+	"testing"
+)
+
+// castBallot casts a ballot of a single choice encrypted as (alpha, beta),
+// converted to string as it is gossiped.
+func castBallot(t *testing.T, voter string, alpha, beta int64) *CastBallot {
+	cb := &CastBallot{
+		Vote: &Ballot{
+			Answers: []*EncryptedAnswer{{
+				Choices: []*Ciphertext{{big.NewInt(alpha), big.NewInt(beta)}},
+			}},
+			ElectionHash: "election-hash",
+			ElectionUuid: "election-uuid",
+		},
+		VoterHash: voter,
+		VoterUuid: voter,
+	}
+	if err := cb.ComputeTracker(); err != nil {
+		t.Fatal(err)
+	}
+	cb.BigInt2Str()
+	return cb
+}
+
+func TestBlockCheckBallots(t *testing.T) {
+	b := &Block{
+		ElectionName: "election",
+		CastBallots:  []*CastBallot{castBallot(t, "alice", 2, 3), castBallot(t, "bob", 5, 7)},
+	}
+	if err := b.CheckBallots(); err != nil {
+		t.Fatalf("honest block: %s", err)
+	}
+
+	// The trackers, and so the hash of the block, are left untouched.
+	digest := b.Digest()
+	b.CastBallots[0].Vote = castBallot(t, "alice", 11, 13).Vote
+	if b.Digest() != digest {
+		t.Fatal("the digest of the block commits to the vote beyond its tracker")
+	}
+	if err := b.CheckBallots(); err == nil {
+		t.Fatal("block with a swapped vote passes")
+	}
+}
@@ -0,0 +1,243 @@
+package message
+
+// The ballots for the mixnet questions of an election are mixed by the
+// trustees in turn, each shuffling the output of the previous one, and the
+// output of the last mix is decrypted ballot by ballot with the decryption
+// factors of a threshold of trustees. As long as one mixer is honest, no one
+// can tell which voter cast which decrypted ballot.
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// A Mix is the shuffle of the ballots by one trustee, with its proof.
+type Mix struct {
+	// Index is the index of the trustee that mixed.
+	Index int `json:"index"`
+
+	// Output is a list of ballots, each the list of the choices of all the
+	// mixnet questions in the order of the questions.
+	Output [][]*Ciphertext `json:"output"`
+
+	Proof *ShuffleProof `json:"proof"`
+}
+
+// HasMixnet tells whether some question of the election is mixed.
+func (e *Election) HasMixnet() bool {
+	for _, q := range e.Questions {
+		if q.IsMixnet() {
+			return true
+		}
+	}
+	return false
+}
+
+// MixInput collects the ballots to mix from the votes, in the order of the
+// votes: the choices of the mixnet questions of every vote that passes
+// verification. A vote that reuses a ciphertext of an earlier vote is left
+// out, since decrypting a copy would reveal the plaintext of the original.
+func (e *Election) MixInput(votes []*CastBallot) [][]*Ciphertext {
+	input := make([][]*Ciphertext, 0, len(votes))
+	if !e.HasMixnet() {
+		return input
+	}
+
+	errs := e.VerifyBallots(votes)
+	seen := make(map[string]bool)
+	for i, vote := range votes {
+		if errs[i] != nil {
+			continue
+		}
+
+		ballot := make([]*Ciphertext, 0)
+		for j, q := range e.Questions {
+			if q.IsMixnet() {
+				ballot = append(ballot, vote.Vote.Answers[j].Choices...)
+			}
+		}
+
+		copied := false
+		for _, c := range ballot {
+			copied = copied || seen[c.Alpha.String()]
+		}
+		if copied {
+			fmt.Printf("Vote of %s copies an earlier ballot\n", vote.VoterUuid)
+			continue
+		}
+		for _, c := range ballot {
+			seen[c.Alpha.String()] = true
+		}
+
+		input = append(input, ballot)
+	}
+
+	return input
+}
+
+// NewMix shuffles the input as the trustee at index.
+func NewMix(index int, input [][]*Ciphertext, pk *Key) (*Mix, error) {
+	output, proof, err := Shuffle(input, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mix{Index: index, Output: output, Proof: proof}, nil
+}
+
+// VerifyMixes checks that each of the mixes is a shuffle of the output of the
+// previous one, starting from input, by a distinct trustee of the election.
+// It returns the output of the last mix.
+func (e *Election) VerifyMixes(input [][]*Ciphertext, mixes []*Mix) ([][]*Ciphertext, error) {
+	mixed := make(map[int]bool)
+	for k, mix := range mixes {
+		if mix == nil {
+			return nil, fmt.Errorf("missing mix %d", k)
+		}
+
+		known := len(e.Trustees) == 0
+		for _, t := range e.Trustees {
+			known = known || (t != nil && t.Index == mix.Index)
+		}
+		if !known || mixed[mix.Index] {
+			return nil, fmt.Errorf("mix %d is not by a new trustee", k)
+		}
+
+		if err := mix.Proof.Verify(input, mix.Output, e.PublicKey); err != nil {
+			return nil, fmt.Errorf("mix %d by trustee %d: %s", k, mix.Index, err)
+		}
+
+		mixed[mix.Index] = true
+		input = mix.Output
+	}
+
+	return input, nil
+}
+
+// MixedAnswers are the decrypted answers to a mixnet question.
+type MixedAnswers struct {
+	// Answers are the valid answers, in the order of the mixed ballots.
+	Answers [][]int64 `json:"answers"`
+
+	// WriteIns are the texts of the answers to a write-in question.
+	WriteIns []string `json:"write_ins,omitempty"`
+
+	// Invalid counts the ballots whose answer couldn't be decrypted or
+	// isn't one a voter could have encrypted.
+	Invalid int `json:"invalid"`
+
+	// Ranked is the count of the answers to a ranked question.
+	Ranked *RankedResult `json:"ranked,omitempty"`
+}
+
+// A MixedResult holds the MixedAnswers of each question, nil for the
+// questions that are tallied homomorphically.
+type MixedResult []*MixedAnswers
+
+// DecryptMixed combines the decryption factors of the trustees for the mixed
+// ballots and decodes the answers to each mixnet question.
+func (e *Election) DecryptMixed(mixed [][]*Ciphertext, trustees []*Trustee) (MixedResult, error) {
+	// Only combine the decryption factors of trustees that check out.
+	honest, err := e.SelectTrustees(trustees, mixed)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := make([]int, len(honest))
+	for k, t := range honest {
+		indices[k] = t.Index
+	}
+
+	maxValue := int64(0)
+	result := make(MixedResult, len(e.Questions))
+	for i, q := range e.Questions {
+		if q.IsMixnet() {
+			result[i] = &MixedAnswers{Answers: make([][]int64, 0)}
+			if q.MixMaxValue() > maxValue {
+				maxValue = q.MixMaxValue()
+			}
+		}
+	}
+
+	g := e.PublicKey.Group()
+	table := GetDiscreteLogTable(e.PublicKey, maxValue)
+	for b, ballot := range mixed {
+		// the choice of the ballot at which the question starts
+		start := 0
+		for i, q := range e.Questions {
+			if !q.IsMixnet() {
+				continue
+			}
+
+			plaintexts := make([]int64, q.MixWidth())
+			decrypted := start+len(plaintexts) <= len(ballot)
+			for k := range plaintexts {
+				if !decrypted {
+					break
+				}
+
+				factors := make([]*big.Int, len(honest))
+				for t := range honest {
+					factors[t] = honest[t].DecryptionFactors[b][start+k]
+				}
+				alpha := CombineDecryptionFactors(factors, indices, e.PublicKey)
+
+				plaintexts[k], decrypted = table.Log(g.Mul(ballot[start+k].Beta, g.Inv(alpha)))
+			}
+			start += len(plaintexts)
+
+			var answer []int64
+			if decrypted {
+				answer, err = q.DecodeMixed(plaintexts)
+			}
+			if !decrypted || err != nil {
+				result[i].Invalid++
+				continue
+			}
+
+			result[i].Answers = append(result[i].Answers, answer)
+			if q.ChoiceType == ChoiceWriteIn {
+				text := make([]byte, len(answer))
+				for k, v := range answer {
+					text[k] = byte(v)
+				}
+				result[i].WriteIns = append(result[i].WriteIns, string(text))
+			}
+		}
+	}
+
+	for i, q := range e.Questions {
+		if q.IsMixnet() && q.ChoiceType == ChoiceRanked {
+			result[i].Ranked = CountRanked(result[i].Answers, len(q.Answers), q.ComputeSeats())
+		}
+	}
+
+	return result, nil
+}
+
+// MergeMixed fills in the result the number of selections of each answer of
+// the approval questions that were mixed, and the number of first
+// preferences of each answer of the ranked questions.
+func (e *Election) MergeMixed(result Result, mixed MixedResult) error {
+	if len(result) != len(e.Questions) || len(mixed) != len(e.Questions) {
+		return errors.New("results don't match the questions")
+	}
+
+	for i, q := range e.Questions {
+		if mixed[i] == nil || q.ChoiceType == ChoiceWriteIn {
+			continue
+		}
+
+		result[i] = make([]int64, len(q.Answers))
+		for _, answer := range mixed[i].Answers {
+			if q.ChoiceType == ChoiceRanked && len(answer) > 0 {
+				answer = answer[:1]
+			}
+			for _, index := range answer {
+				result[i][index]++
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Tally types of a Question. The ballots of a homomorphic question are
+// multiplied together and only the totals per answer are decrypted. The
+// ballots of a mixnet question are shuffled by the trustees and decrypted one
+// by one, which allows answers that don't add up, like rankings and write-ins.
+const (
+	TallyHomomorphic = "homomorphic"
+	TallyMixnet      = "mixnet"
+)
+
+// Choice types of a Question. The answer to a ranked question lists answers
+// in the order of preference of the voter, and the answer to a write-in
+// question is a text rather than a selection of its answers. Both are mixnet
+// questions. The answer to a score question gives each of its answers a score
+// between 0 and its MaxScore, and is tallied homomorphically.
+const (
+	ChoiceApproval = "approval"
+	ChoiceRanked   = "ranked"
+	ChoiceScore    = "score"
+	ChoiceWriteIn  = "write-in"
+)
+
+// DefaultWriteInLength is the length in bytes of the answer to a write-in
+// question without a Max.
+const DefaultWriteInLength = 32
+
+// IsMixnet tells whether the ballots for the question are mixed. Score
+// questions are always tallied homomorphically.
+func (q *Question) IsMixnet() bool {
+	if q.ChoiceType == ChoiceScore {
+		return false
+	}
+
+	return q.TallyType == TallyMixnet || q.ChoiceType == ChoiceRanked || q.ChoiceType == ChoiceWriteIn
+}
+
+// ComputeSeats gets the number of answers a ranked question elects. A Seats
+// of 0 means a single winner, by instant runoff.
+func (q *Question) ComputeSeats() int {
+	if q.Seats == 0 {
+		return 1
+	}
+
+	return q.Seats
+}
+
+// SetSeats sets the number of answers a ranked question elects by single
+// transferable vote.
+func (q *Question) SetSeats(seats int) error {
+	if q.ChoiceType != ChoiceRanked {
+		return errors.New("only ranked questions elect several answers")
+	}
+
+	if seats < 1 || seats > len(q.Answers) {
+		return errors.New("invalid number of seats")
+	}
+
+	q.Seats = seats
+	return nil
+}
+
+// MixWidth gets the number of choices of an answer to a mixnet question: one
+// per answer that may be selected, or one per byte of a write-in.
+func (q *Question) MixWidth() int {
+	if q.ChoiceType == ChoiceWriteIn {
+		if q.Max == 0 {
+			return DefaultWriteInLength
+		}
+		return q.Max
+	}
+
+	return q.ComputeMax()
+}
+
+// MixMaxValue gets the largest plaintext of a choice of a mixnet question.
+func (q *Question) MixMaxValue() int64 {
+	if q.ChoiceType == ChoiceWriteIn {
+		return 256
+	}
+
+	return int64(len(q.Answers))
+}
+
+// checkMixed checks an answer to a mixnet question: the distinct indices of
+// the selected answers, in the order of the voter, or the bytes of a write-in.
+func (q *Question) checkMixed(answer []int64) error {
+	if len(answer) < q.Min || len(answer) > q.MixWidth() {
+		return fmt.Errorf("answer has %d choices, min is %d and max is %d", len(answer), q.Min, q.MixWidth())
+	}
+
+	if q.ChoiceType == ChoiceWriteIn {
+		for _, b := range answer {
+			if b < 0 || b > 255 {
+				return errors.New("write-in is not a list of bytes")
+			}
+		}
+		return nil
+	}
+
+	selected := make([]bool, len(q.Answers))
+	for _, index := range answer {
+		if index < 0 || index >= int64(len(selected)) || selected[index] {
+			return errors.New("each selection must be a distinct answer")
+		}
+		selected[index] = true
+	}
+	return nil
+}
+
+// EncodeMixed turns an answer to a mixnet question into the plaintexts of its
+// choices. The k-th choice is 1 + the k-th selected answer, or 1 + the k-th
+// byte of a write-in, and the remaining choices are 0, so that the order of
+// the answer is kept.
+func (q *Question) EncodeMixed(answer []int64) ([]int64, error) {
+	if err := q.checkMixed(answer); err != nil {
+		return nil, err
+	}
+
+	plaintexts := make([]int64, q.MixWidth())
+	for k, v := range answer {
+		plaintexts[k] = v + 1
+	}
+	return plaintexts, nil
+}
+
+// DecodeMixed recovers an answer from the decrypted choices of a mixnet
+// question, and rejects any encoding EncodeMixed wouldn't produce.
+func (q *Question) DecodeMixed(plaintexts []int64) ([]int64, error) {
+	if len(plaintexts) != q.MixWidth() {
+		return nil, errors.New("wrong number of choices")
+	}
+
+	answer := make([]int64, 0, len(plaintexts))
+	for k, v := range plaintexts {
+		if v == 0 {
+			for _, rest := range plaintexts[k:] {
+				if rest != 0 {
+					return nil, errors.New("empty choice in the middle of the answer")
+				}
+			}
+			break
+		}
+		answer = append(answer, v-1)
+	}
+
+	if err := q.checkMixed(answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// VerifyRandomness checks the proof that the voter knows the randomness of
+// each of the Choices, so that a ballot can't be made of re-encrypted choices
+// of another voter.
+func (a *EncryptedAnswer) VerifyRandomness(pk *Key) error {
+	if len(a.RandomnessProofs) != len(a.Choices) {
+		return errors.New("wrong number of randomness proofs")
+	}
+
+	for i, c := range a.Choices {
+		if !a.RandomnessProofs[i].Verify(c.Alpha, pk) {
+			return fmt.Errorf("invalid randomness proof for choice %d", i)
+		}
+	}
+
+	return nil
+}
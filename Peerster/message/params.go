@@ -0,0 +1,173 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// Names of the standard mod p groups. Their parameters are fixed, so that an
+// election doesn't spend seconds generating a group nobody has audited.
+const (
+	// GroupRFC3526 is the 2048-bit MODP group 14 of RFC 3526.
+	GroupRFC3526 = "rfc3526-2048"
+
+	// GroupFFDHE2048 is the 2048-bit ffdhe2048 group of RFC 7919.
+	GroupFFDHE2048 = "ffdhe2048"
+
+	// GroupHelios is the default group of Helios, with a 256-bit q.
+	GroupHelios = "helios"
+)
+
+// Minimal sizes of the primes of a mod p group that isn't a named group.
+const (
+	MinPrimeBits         = 2048
+	MinExponentPrimeBits = 224
+)
+
+// namedGroups are the parameters of the groups that can be selected by name.
+var namedGroups = map[string]*Key{
+	GroupEd25519:   NewEd25519Parameters(),
+	GroupRFC3526:   safePrimeGroup(GroupRFC3526, rfc3526Prime),
+	GroupFFDHE2048: safePrimeGroup(GroupFFDHE2048, ffdhe2048Prime),
+	GroupHelios: {
+		Generator:     decimal(heliosGenerator),
+		Prime:         decimal(heliosPrime),
+		ExponentPrime: decimal(heliosExponentPrime),
+		GroupName:     GroupHelios,
+	},
+}
+
+const rfc3526Prime = `
+	FFFFFFFF FFFFFFFF C90FDAA2 2168C234 C4C6628B 80DC1CD1 29024E08 8A67CC74
+	020BBEA6 3B139B22 514A0879 8E3404DD EF9519B3 CD3A431B 302B0A6D F25F1437
+	4FE1356D 6D51C245 E485B576 625E7EC6 F44C42E9 A637ED6B 0BFF5CB6 F406B7ED
+	EE386BFB 5A899FA5 AE9F2411 7C4B1FE6 49286651 ECE45B3D C2007CB8 A163BF05
+	98DA4836 1C55D39A 69163FA8 FD24CF5F 83655D23 DCA3AD96 1C62F356 208552BB
+	9ED52907 7096966D 670C354E 4ABC9804 F1746C08 CA18217C 32905E46 2E36CE3B
+	E39E772C 180E8603 9B2783A2 EC07A28F B5C55DF0 6F4C52C9 DE2BCBF6 95581718
+	3995497C EA956AE5 15D22618 98FA0510 15728E5A 8AACAA68 FFFFFFFF FFFFFFFF`
+
+const ffdhe2048Prime = `
+	FFFFFFFF FFFFFFFF ADF85458 A2BB4A9A AFDC5620 273D3CF1 D8B9C583 CE2D3695
+	A9E13641 146433FB CC939DCE 249B3EF9 7D2FE363 630C75D8 F681B202 AEC4617A
+	D3DF1ED5 D5FD6561 2433F51F 5F066ED0 85636555 3DED1AF3 B557135E 7F57C935
+	984F0C70 E0E68B77 E2A689DA F3EFE872 1DF158A1 36ADE735 30ACCA4F 483A797A
+	BC0AB182 B324FB61 D108A94B B2C8E3FB B96ADAB7 60D7F468 1D4F42A3 DE394DF4
+	AE56EDE7 6372BB19 0B07A7C8 EE0A6D70 9E02FCE1 CDF7E2EC C03404CD 28342F61
+	9172FE9C E98583FF 8E4F1232 EEF28183 C3FE3B1B 4C6FAD73 3BB5FCBC 2EC22005
+	C58EF183 7D1683B2 C6F34A26 C1B2EFFA 886B4238 61285C97 FFFFFFFF FFFFFFFF`
+
+const heliosPrime = "16328632084933010002384055033805457329601614771185955389739167309086214800406465799038583634953752941675645562182498120750264980492381375579367675648771293800310370964745767014243638518442553823973482995267304044326777047662957480269391322789378384619428596446446984694306187644767462460965622580087564339212631775817895958409016676398975671266179637898557687317076177218843233150695157881061257053019133078545928983562221396313169622475509818442661047018436264806901023966236718367204710755935899013750306107738002364137917426595737403871114187750804346564731250609196846638183903982387884578266136503697493474682071"
+
+const heliosExponentPrime = "61329566248342901292543872769978950870633559608669337131139375508370458778917"
+
+const heliosGenerator = "14887492224963187634282421537186040801304008017743492304481737382571933937568724473847106029915040150784031882206090286938661464458896494215273989547889201144857352611058572236578734319505128042602372864570426550855201448111746579871811249114781674309062693442442368697449970648232621880001709535143047913661432883287150003429802392229361583608686643243349727791976247247948618930423866180410558458272606627111270040091203073580238905303994472202930783207472394578498507764703191288249547659899997131166130259700604433891232298182348403175947450284433411265966789131024573629546048637848902243503970966798589660808533"
+
+// safePrimeGroup returns the group of quadratic residues mod the safe prime
+// p = 2q + 1, which 2 generates for the primes of RFC 3526 and RFC 7919.
+func safePrimeGroup(name string, hex string) *Key {
+	p, _ := new(big.Int).SetString(strings.Join(strings.Fields(hex), ""), 16)
+	return &Key{
+		Generator:     big.NewInt(2),
+		Prime:         p,
+		ExponentPrime: new(big.Int).Rsh(p, 1),
+		GroupName:     name,
+	}
+}
+
+func decimal(s string) *big.Int {
+	n, _ := new(big.Int).SetString(s, 10)
+	return n
+}
+
+// NamedGroupParameters returns the parameters of a named group, without any
+// key pair.
+func NamedGroupParameters(name string) (*Key, bool) {
+	params, ok := namedGroups[name]
+	if !ok {
+		return nil, false
+	}
+
+	return params.WithPublicValue(nil), true
+}
+
+// validGroups caches the parameters that passed validation, as checking the
+// primes of a mod p group is slow.
+var (
+	validGroups    = make(map[string]bool)
+	validGroupsMux sync.Mutex
+)
+
+// groupID identifies the group of the key by all of its parameters, whatever
+// its public value. Keys that differ only in q are in different groups, as q
+// is validated with the rest.
+func (pk *Key) groupID() string {
+	return fmt.Sprintf("%s,%v,%v,%v", pk.GroupName, pk.Generator, pk.Prime, pk.ExponentPrime)
+}
+
+// ValidateGroup checks the parameters of the key before it is used. A named
+// group must have its standard parameters. Any other mod p group must have
+// large primes p and q with q dividing p - 1, and g must generate the subgroup
+// of order q. The public value, if set, must be in the group.
+func (pk *Key) ValidateGroup() error {
+	if pk == nil || pk.Generator == nil || pk.ExponentPrime == nil {
+		return errors.New("missing group parameters")
+	}
+
+	validGroupsMux.Lock()
+	valid := validGroups[pk.groupID()]
+	validGroupsMux.Unlock()
+
+	if !valid {
+		if err := pk.validateParameters(); err != nil {
+			return err
+		}
+
+		validGroupsMux.Lock()
+		validGroups[pk.groupID()] = true
+		validGroupsMux.Unlock()
+	}
+
+	if pk.PublicValue != nil && !pk.IsMember(pk.PublicValue) {
+		return errors.New("public value is not in the group")
+	}
+	return nil
+}
+
+func (pk *Key) validateParameters() error {
+	if named, ok := namedGroups[pk.GroupName]; ok {
+		if !pk.SameGroup(named) {
+			return fmt.Errorf("parameters differ from the %s group", pk.GroupName)
+		}
+		return nil
+	}
+
+	if pk.GroupName != GroupModP && pk.GroupName != "" {
+		return fmt.Errorf("unknown group %q", pk.GroupName)
+	}
+
+	g, p, q := pk.Generator, pk.Prime, pk.ExponentPrime
+	if p == nil {
+		return errors.New("missing prime p")
+	}
+	if p.BitLen() < MinPrimeBits || q.BitLen() < MinExponentPrimeBits {
+		return fmt.Errorf("group too small: p has %d bits and q has %d bits", p.BitLen(), q.BitLen())
+	}
+	if !p.ProbablyPrime(20) || !q.ProbablyPrime(20) {
+		return errors.New("p or q is not prime")
+	}
+
+	pm1 := new(big.Int).Sub(p, big.NewInt(1))
+	if new(big.Int).Mod(pm1, q).Sign() != 0 {
+		return errors.New("q does not divide p - 1")
+	}
+
+	// g has order q if it is not 1 and g^q = 1
+	if g.Cmp(big.NewInt(1)) <= 0 || g.Cmp(p) >= 0 || new(big.Int).Exp(g, q, p).Cmp(big.NewInt(1)) != 0 {
+		return errors.New("g does not generate the subgroup of order q")
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package message
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestValidateGroupChecksExponentPrime(t *testing.T) {
+	params, _ := NamedGroupParameters(GroupRFC3526)
+	modp := &Key{Generator: params.Generator, Prime: params.Prime, ExponentPrime: params.ExponentPrime, GroupName: GroupModP}
+	if err := modp.ValidateGroup(); err != nil {
+		t.Fatalf("valid group: %s", err)
+	}
+
+	// same g and p as a group that passed, with a tiny q
+	small := &Key{Generator: params.Generator, Prime: params.Prime, ExponentPrime: big.NewInt(11), GroupName: GroupModP}
+	if err := small.ValidateGroup(); err == nil {
+		t.Fatal("group with a tiny q passes")
+	}
+}
@@ -0,0 +1,566 @@
+package message
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+	"sync"
+)
+
+// A Commitment is the first message of a Chaum-Pedersen proof of equality of
+// discrete logarithms.
+type Commitment struct {
+	// A = g^w
+	A *big.Int `json:"A"`
+
+	// B = y^w
+	B *big.Int `json:"B"`
+}
+
+// A ZKProof is a non-interactive Chaum-Pedersen proof that a Ciphertext
+// encrypts a given value.
+type ZKProof struct {
+	Challenge *big.Int `json:"challenge"`
+
+	Commitment *Commitment `json:"commitment"`
+
+	Response *big.Int `json:"response"`
+}
+
+// A DisjunctiveZKProof proves that a Ciphertext encrypts one of a consecutive
+// range of values, without revealing which one. The proof at index i is for
+// the value min+i.
+type DisjunctiveZKProof []*ZKProof
+
+// ZKProofStr is the string form of a ZKProof carried in gossiped blocks.
+type ZKProofStr struct {
+	Challenge   *string
+	CommitmentA *string
+	CommitmentB *string
+	Response    *string
+}
+
+func NewZKProofStr(p *ZKProof) *ZKProofStr {
+	if p == nil || p.Challenge == nil || p.Response == nil ||
+		p.Commitment == nil || p.Commitment.A == nil || p.Commitment.B == nil {
+		return &ZKProofStr{}
+	}
+
+	challenge := p.Challenge.String()
+	a := p.Commitment.A.String()
+	b := p.Commitment.B.String()
+	response := p.Response.String()
+	return &ZKProofStr{
+		Challenge:   &challenge,
+		CommitmentA: &a,
+		CommitmentB: &b,
+		Response:    &response,
+	}
+}
+
+func str2BigInt(s *string) *big.Int {
+	if s == nil {
+		return nil
+	}
+
+	n, ok := new(big.Int).SetString(*s, 10)
+	if !ok {
+		fmt.Println("Convert proof string to big int err")
+		return nil
+	}
+	return n
+}
+
+func NewZKProof(ps *ZKProofStr) *ZKProof {
+	return &ZKProof{
+		Challenge: str2BigInt(ps.Challenge),
+		Commitment: &Commitment{
+			A: str2BigInt(ps.CommitmentA),
+			B: str2BigInt(ps.CommitmentB),
+		},
+		Response: str2BigInt(ps.Response),
+	}
+}
+
+// DisjunctiveZKProofStr wraps the proofs of a DisjunctiveZKProof, since
+// protobuf cannot encode nested slices.
+type DisjunctiveZKProofStr struct {
+	Proofs []*ZKProofStr
+}
+
+func NewDisjunctiveZKProofStr(dzkp DisjunctiveZKProof) *DisjunctiveZKProofStr {
+	ds := &DisjunctiveZKProofStr{make([]*ZKProofStr, len(dzkp))}
+	for i, p := range dzkp {
+		ds.Proofs[i] = NewZKProofStr(p)
+	}
+	return ds
+}
+
+func NewDisjunctiveZKProof(ds *DisjunctiveZKProofStr) DisjunctiveZKProof {
+	dzkp := make(DisjunctiveZKProof, len(ds.Proofs))
+	for i, ps := range ds.Proofs {
+		dzkp[i] = NewZKProof(ps)
+	}
+	return dzkp
+}
+
+// divGExp computes beta / g^value, which is y^r if beta encrypts value.
+func divGExp(beta *big.Int, value int64, pk *Key) *big.Int {
+	g := pk.Group()
+	return g.Mul(beta, g.Inv(g.Exp(pk.Generator, big.NewInt(value))))
+}
+
+// computeChallenge hashes the ciphertext and all the commitments of the proof
+// to get the Fiat-Shamir challenge in Z_q.
+func (dzkp DisjunctiveZKProof) computeChallenge(c *Ciphertext, pk *Key) *big.Int {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s,%s", c.Alpha, c.Beta)
+	for _, p := range dzkp {
+		fmt.Fprintf(h, ",%s,%s", p.Commitment.A, p.Commitment.B)
+	}
+
+	challenge := new(big.Int).SetBytes(h.Sum(nil))
+	return challenge.Mod(challenge, pk.ExponentPrime)
+}
+
+// CreateFakeProof simulates a proof at the given index that c encrypts value.
+// Every fake proof must be created before the real proof.
+func (dzkp DisjunctiveZKProof) CreateFakeProof(index int64, value int64, c *Ciphertext, pk *Key) error {
+	challenge, err := rand.Int(rand.Reader, pk.ExponentPrime)
+	if err != nil {
+		return err
+	}
+
+	response, err := rand.Int(rand.Reader, pk.ExponentPrime)
+	if err != nil {
+		return err
+	}
+
+	g := pk.Group()
+
+	// A = g^response / alpha^challenge
+	a := g.Mul(g.Exp(pk.Generator, response), g.Inv(g.Exp(c.Alpha, challenge)))
+
+	// B = y^response / (beta / g^value)^challenge
+	b := g.Mul(g.Exp(pk.PublicValue, response), g.Inv(g.Exp(divGExp(c.Beta, value, pk), challenge)))
+
+	dzkp[index] = &ZKProof{challenge, &Commitment{a, b}, response}
+	return nil
+}
+
+// CreateRealProof creates the proof at the given index using the randomness r
+// of the encryption. Its challenge is whatever is left of the overall
+// challenge once the simulated challenges are subtracted.
+func (dzkp DisjunctiveZKProof) CreateRealProof(index int64, c *Ciphertext, r *big.Int, pk *Key) error {
+	w, err := rand.Int(rand.Reader, pk.ExponentPrime)
+	if err != nil {
+		return err
+	}
+
+	g := pk.Group()
+	commitment := &Commitment{
+		A: g.Exp(pk.Generator, w),
+		B: g.Exp(pk.PublicValue, w),
+	}
+	dzkp[index] = &ZKProof{Commitment: commitment}
+
+	for i, p := range dzkp {
+		if p == nil {
+			return fmt.Errorf("proof %d is missing", i)
+		}
+	}
+
+	challenge := dzkp.computeChallenge(c, pk)
+	for i, p := range dzkp {
+		if int64(i) != index {
+			challenge.Sub(challenge, p.Challenge)
+		}
+	}
+	challenge.Mod(challenge, pk.ExponentPrime)
+
+	// response = w + challenge * r mod q
+	response := new(big.Int).Mul(challenge, r)
+	response.Add(response, w)
+	response.Mod(response, pk.ExponentPrime)
+
+	dzkp[index].Challenge = challenge
+	dzkp[index].Response = response
+	return nil
+}
+
+// Verify checks a single proof that c encrypts value.
+func (zkp *ZKProof) Verify(value int64, c *Ciphertext, pk *Key) bool {
+	if zkp == nil || zkp.Challenge == nil || zkp.Response == nil ||
+		zkp.Commitment == nil || zkp.Commitment.A == nil || zkp.Commitment.B == nil {
+		return false
+	}
+
+	g := pk.Group()
+	if !g.IsMember(zkp.Commitment.A) || !g.IsMember(zkp.Commitment.B) {
+		return false
+	}
+
+	// g^response = A * alpha^challenge
+	lhs := g.Exp(pk.Generator, zkp.Response)
+	rhs := g.Mul(zkp.Commitment.A, g.Exp(c.Alpha, zkp.Challenge))
+	if lhs.Cmp(rhs) != 0 {
+		return false
+	}
+
+	// y^response = B * (beta / g^value)^challenge
+	lhs = g.Exp(pk.PublicValue, zkp.Response)
+	rhs = g.Mul(zkp.Commitment.B, g.Exp(divGExp(c.Beta, value, pk), zkp.Challenge))
+	return lhs.Cmp(rhs) == 0
+}
+
+// Verify checks that c encrypts one of min, min+1, ..., min+len(dzkp)-1.
+func (dzkp DisjunctiveZKProof) Verify(min int64, c *Ciphertext, pk *Key) bool {
+	if len(dzkp) == 0 || c == nil || c.Alpha == nil || c.Beta == nil {
+		return false
+	}
+
+	sum := big.NewInt(0)
+	for i, p := range dzkp {
+		if !p.Verify(min+int64(i), c, pk) {
+			return false
+		}
+		sum.Add(sum, p.Challenge)
+	}
+	sum.Mod(sum, pk.ExponentPrime)
+
+	return sum.Cmp(dzkp.computeChallenge(c, pk)) == 0
+}
+
+// VerifyChoices checks the proof that each choice of the answer encrypts
+// a value between 0 and the largest plaintext of a choice of the question:
+// either 0 or 1, or a score.
+func (a *EncryptedAnswer) VerifyChoices(q *Question, pk *Key) error {
+	if len(a.IndividualProofs) != len(a.Choices) {
+		return errors.New("wrong number of individual proofs")
+	}
+
+	for i, c := range a.Choices {
+		// the length of a proof is the range it proves
+		if int64(len(a.IndividualProofs[i])) != q.MaxChoice()+1 {
+			return fmt.Errorf("wrong range of the proof for choice %d", i)
+		}
+		if !a.IndividualProofs[i].Verify(0, c, pk) {
+			return fmt.Errorf("invalid proof for choice %d", i)
+		}
+	}
+
+	return nil
+}
+
+// VerifyOverall checks the proof that the product of the choices encrypts a
+// value between the min and max of the question.
+func (a *EncryptedAnswer) VerifyOverall(q *Question, pk *Key) error {
+	if len(a.OverallProof) != q.ComputeMax()-q.Min+1 {
+		return errors.New("wrong number of overall proofs")
+	}
+
+	g := pk.Group()
+	tally := &Ciphertext{g.Identity(), g.Identity()}
+	for _, c := range a.Choices {
+		tally.MulCiphertexts(c, g)
+	}
+
+	if !a.OverallProof.Verify(int64(q.Min), tally, pk) {
+		return errors.New("invalid overall proof")
+	}
+
+	return nil
+}
+
+// partialDecryptionChallenge hashes the statement and commitment of a
+// partial decryption proof into a challenge in Z_q.
+func partialDecryptionChallenge(c *Ciphertext, df *big.Int, commitment *Commitment, pk *Key) *big.Int {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s,%s,%s,%s,%s", pk.PublicValue, c.Alpha, df, commitment.A, commitment.B)
+
+	challenge := new(big.Int).SetBytes(h.Sum(nil))
+	return challenge.Mod(challenge, pk.ExponentPrime)
+}
+
+// NewPartialDecryptionProof proves that the decryption factor df = alpha^x
+// uses the same secret x as the trustee public value y = g^x.
+func NewPartialDecryptionProof(c *Ciphertext, df *big.Int, secret *big.Int, pk *Key) (*ZKProof, error) {
+	w, err := rand.Int(rand.Reader, pk.ExponentPrime)
+	if err != nil {
+		return nil, err
+	}
+
+	g := pk.Group()
+	commitment := &Commitment{
+		A: g.Exp(pk.Generator, w),
+		B: g.Exp(c.Alpha, w),
+	}
+	challenge := partialDecryptionChallenge(c, df, commitment, pk)
+
+	// response = w + challenge * secret mod q
+	response := new(big.Int).Mul(challenge, secret)
+	response.Add(response, w)
+	response.Mod(response, pk.ExponentPrime)
+
+	return &ZKProof{challenge, commitment, response}, nil
+}
+
+// VerifyPartialDecryption checks a proof created by NewPartialDecryptionProof
+// against the trustee public key pk.
+func (zkp *ZKProof) VerifyPartialDecryption(c *Ciphertext, df *big.Int, pk *Key) bool {
+	if zkp == nil || zkp.Challenge == nil || zkp.Response == nil ||
+		zkp.Commitment == nil || zkp.Commitment.A == nil || zkp.Commitment.B == nil || df == nil {
+		return false
+	}
+
+	g := pk.Group()
+	if !g.IsMember(zkp.Commitment.A) || !g.IsMember(zkp.Commitment.B) || !g.IsMember(df) {
+		return false
+	}
+
+	if zkp.Challenge.Cmp(partialDecryptionChallenge(c, df, zkp.Commitment, pk)) != 0 {
+		return false
+	}
+
+	// g^response = A * y^challenge
+	lhs := g.Exp(pk.Generator, zkp.Response)
+	rhs := g.Mul(zkp.Commitment.A, g.Exp(pk.PublicValue, zkp.Challenge))
+	if lhs.Cmp(rhs) != 0 {
+		return false
+	}
+
+	// alpha^response = B * df^challenge
+	lhs = g.Exp(c.Alpha, zkp.Response)
+	rhs = g.Mul(zkp.Commitment.B, g.Exp(df, zkp.Challenge))
+	return lhs.Cmp(rhs) == 0
+}
+
+// A SchnorrProof is a non-interactive proof of knowledge of the secret x
+// behind a public value y = g^x.
+type SchnorrProof struct {
+	Commitment *big.Int `json:"commitment"`
+
+	Challenge *big.Int `json:"challenge"`
+
+	Response *big.Int `json:"response"`
+}
+
+// schnorrChallenge hashes the public value and the commitment of a Schnorr
+// proof into a challenge in Z_q.
+func schnorrChallenge(y *big.Int, commitment *big.Int, pk *Key) *big.Int {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s,%s,%s,%s", pk.GroupName, pk.Generator, y, commitment)
+
+	challenge := new(big.Int).SetBytes(h.Sum(nil))
+	return challenge.Mod(challenge, pk.ExponentPrime)
+}
+
+// NewSchnorrProof proves knowledge of secret for the public value
+// g^secret in the group of pk.
+func NewSchnorrProof(secret *big.Int, pk *Key) (*SchnorrProof, error) {
+	w, err := rand.Int(rand.Reader, pk.ExponentPrime)
+	if err != nil {
+		return nil, err
+	}
+
+	g := pk.Group()
+	y := g.Exp(pk.Generator, secret)
+	commitment := g.Exp(pk.Generator, w)
+	challenge := schnorrChallenge(y, commitment, pk)
+
+	// response = w + challenge * secret mod q
+	response := new(big.Int).Mul(challenge, secret)
+	response.Add(response, w)
+	response.Mod(response, pk.ExponentPrime)
+
+	return &SchnorrProof{commitment, challenge, response}, nil
+}
+
+// Verify checks that the prover knows the secret behind y.
+func (p *SchnorrProof) Verify(y *big.Int, pk *Key) bool {
+	if p == nil || p.Commitment == nil || p.Challenge == nil || p.Response == nil {
+		return false
+	}
+
+	g := pk.Group()
+	if !g.IsMember(y) || !g.IsMember(p.Commitment) ||
+		p.Challenge.Cmp(schnorrChallenge(y, p.Commitment, pk)) != 0 {
+		return false
+	}
+
+	// g^response = commitment * y^challenge
+	lhs := g.Exp(pk.Generator, p.Response)
+	rhs := g.Mul(p.Commitment, g.Exp(y, p.Challenge))
+	return lhs.Cmp(rhs) == 0
+}
+
+// SchnorrProofStr is the string form of a SchnorrProof carried in gossiped
+// messages.
+type SchnorrProofStr struct {
+	Commitment *string
+	Challenge  *string
+	Response   *string
+}
+
+func (p *SchnorrProof) BigInt2Str() *SchnorrProofStr {
+	if p == nil || p.Commitment == nil || p.Challenge == nil || p.Response == nil {
+		return &SchnorrProofStr{}
+	}
+
+	commitment := p.Commitment.String()
+	challenge := p.Challenge.String()
+	response := p.Response.String()
+	return &SchnorrProofStr{&commitment, &challenge, &response}
+}
+
+func (ps *SchnorrProofStr) Str2BigInt() *SchnorrProof {
+	if ps == nil {
+		return nil
+	}
+
+	return &SchnorrProof{
+		Commitment: str2BigInt(ps.Commitment),
+		Challenge:  str2BigInt(ps.Challenge),
+		Response:   str2BigInt(ps.Response),
+	}
+}
+
+// VerifyPoK checks the proof of knowledge of the trustee against its public
+// key.
+func (t *Trustee) VerifyPoK() error {
+	if t.PublicKey == nil || t.PublicKey.PublicValue == nil {
+		return fmt.Errorf("trustee %d has no public key", t.Index)
+	}
+
+	if !t.PoK.Verify(t.PublicKey.PublicValue, t.PublicKey) {
+		return fmt.Errorf("invalid proof of knowledge for trustee %d", t.Index)
+	}
+
+	return nil
+}
+
+// CheckSealed checks that the ballot carries no plaintext answer nor
+// randomness, which would reveal the vote to whoever sees the ballot.
+func (b *Ballot) CheckSealed() error {
+	if b == nil {
+		return errors.New("missing ballot")
+	}
+
+	for i, a := range b.Answers {
+		if a != nil && (len(a.Answer) > 0 || len(a.Randomness) > 0) {
+			return fmt.Errorf("answer %d reveals the vote", i)
+		}
+	}
+
+	return nil
+}
+
+// Verify checks that the ballot is bound to the election, has the right shape
+// for its questions, only contains group elements and carries valid proofs.
+func (b *Ballot) Verify(election *Election) error {
+	if b == nil {
+		return errors.New("missing ballot")
+	}
+
+	if election.PublicKey == nil {
+		return errors.New("election has no public key")
+	}
+
+	if b.ElectionUuid != election.Uuid {
+		return errors.New("ballot is for a different election")
+	}
+
+	// the hash covers the key and the questions, so a ballot encrypted
+	// against anything but the frozen election is rejected here
+	hash, err := election.Hash()
+	if err != nil {
+		return err
+	}
+	if b.ElectionHash != hash {
+		return errors.New("ballot does not match the election hash")
+	}
+
+	if len(b.Answers) != len(election.Questions) {
+		return errors.New("wrong number of answers")
+	}
+
+	pk := election.PublicKey
+	for i, q := range election.Questions {
+		a := b.Answers[i]
+		width := len(q.Answers)
+		if q.IsMixnet() {
+			width = q.MixWidth()
+		}
+		if a == nil || len(a.Choices) != width {
+			return fmt.Errorf("wrong number of choices for question %d", i)
+		}
+
+		for j, c := range a.Choices {
+			if c == nil || !pk.IsMember(c.Alpha) || !pk.IsMember(c.Beta) {
+				return fmt.Errorf("choice %d of question %d is not in the group", j, i)
+			}
+		}
+
+		// the plaintexts of a mixnet ballot are checked once decrypted
+		if q.IsMixnet() {
+			if err := a.VerifyRandomness(pk); err != nil {
+				return fmt.Errorf("question %d: %s", i, err)
+			}
+			continue
+		}
+
+		if err := a.VerifyChoices(q, pk); err != nil {
+			return fmt.Errorf("question %d: %s", i, err)
+		}
+
+		// any combination of scores is valid
+		if q.ChoiceType == ChoiceScore {
+			continue
+		}
+
+		if err := a.VerifyOverall(q, pk); err != nil {
+			return fmt.Errorf("question %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// VerifyBallots verifies the votes on a pool of workers, that each is cast by
+// a voter on the roll and that it is the vote its tracker is computed on. The
+// error at index i is nil if and only if votes[i] passed verification.
+func (election *Election) VerifyBallots(votes []*CastBallot) []error {
+	errs := make([]error, len(votes))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if votes[i] == nil {
+					errs[i] = errors.New("missing vote")
+					continue
+				}
+				if errs[i] = election.CheckEligibility(votes[i]); errs[i] == nil {
+					errs[i] = votes[i].CheckTracker()
+				}
+				if errs[i] == nil {
+					errs[i] = votes[i].Vote.Verify(election)
+				}
+			}
+		}()
+	}
+
+	for i := range votes {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return errs
+}
@@ -0,0 +1,96 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Result types of a Question. The result of a relative question is the share
+// of the votes of each answer, and the result of an absolute question is the
+// answers that a majority of the ballots chose.
+const (
+	ResultAbsolute = "absolute"
+	ResultRelative = "relative"
+)
+
+// Validate checks that the question is one a voter can answer: its choice,
+// tally and result types are known and agree with each other, and its min,
+// max and seats fit its answers.
+func (q *Question) Validate() error {
+	if q.ResultType != ResultAbsolute && q.ResultType != ResultRelative {
+		return errors.New("invalid result type")
+	}
+
+	if q.Max < 0 || q.Min < 0 {
+		return errors.New("invalid question min and max")
+	}
+
+	switch q.ChoiceType {
+	case ChoiceApproval:
+		if q.TallyType != TallyHomomorphic && q.TallyType != TallyMixnet {
+			return errors.New("invalid tally type")
+		}
+		if q.ComputeMax() > len(q.Answers) || q.Min > q.ComputeMax() {
+			return errors.New("invalid question min and max")
+		}
+	case ChoiceScore:
+		if len(q.Answers) == 0 {
+			return errors.New("a score question needs answers")
+		}
+		if q.TallyType != TallyHomomorphic {
+			return errors.New("a score question is tallied homomorphically")
+		}
+		if q.Min != 0 || q.Max != 0 || q.MaxScore < 0 {
+			return errors.New("a score question has no min and max")
+		}
+	case ChoiceRanked:
+		if len(q.Answers) == 0 {
+			return errors.New("a ranked question needs answers")
+		}
+		if q.TallyType != TallyMixnet {
+			return errors.New("a ranked question is mixed")
+		}
+		if q.ComputeMax() > len(q.Answers) || q.Min > q.ComputeMax() {
+			return errors.New("invalid question min and max")
+		}
+		if q.Seats < 0 || q.Seats > len(q.Answers) {
+			return errors.New("invalid number of seats")
+		}
+	case ChoiceWriteIn:
+		if len(q.Answers) != 0 {
+			return errors.New("a write-in question has no answers")
+		}
+		if q.TallyType != TallyMixnet {
+			return errors.New("a write-in question is mixed")
+		}
+		if q.Min > q.MixWidth() {
+			return errors.New("invalid question min and max")
+		}
+	default:
+		return errors.New("invalid choice type")
+	}
+
+	if q.Seats != 0 && q.ChoiceType != ChoiceRanked {
+		return errors.New("only ranked questions elect several answers")
+	}
+
+	return nil
+}
+
+// ValidateQuestions checks each of the questions of the election.
+func (e *Election) ValidateQuestions() error {
+	if len(e.Questions) == 0 {
+		return errors.New("election has no questions")
+	}
+
+	for i, q := range e.Questions {
+		if q == nil {
+			return fmt.Errorf("question %d is missing", i)
+		}
+		if err := q.Validate(); err != nil {
+			return fmt.Errorf("question %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
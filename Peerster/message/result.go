@@ -0,0 +1,99 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// A QuestionResult is the outcome of a question, as its result type asks: the
+// share of the votes of each answer for a relative question, and the answers
+// that reach a majority for an absolute one.
+type QuestionResult struct {
+	ResultType string `json:"result_type"`
+
+	// Counts are the votes of each answer: its selections, its total score
+	// or its first preferences.
+	Counts []int64 `json:"counts"`
+
+	// Ballots is the weight of the valid ballots counted for the question.
+	Ballots int64 `json:"ballots"`
+
+	// Percentages are the shares of the votes of each answer of a relative
+	// question.
+	Percentages []float64 `json:"percentages,omitempty"`
+
+	// Majority is the number of votes an answer of an absolute question
+	// needs to win, and Winners are the answers that won, with the most
+	// votes first. A ranked question is won at the quota of its count.
+	Majority int64 `json:"majority,omitempty"`
+	Winners  []int `json:"winners,omitempty"`
+}
+
+// Summarize computes the outcome of each question from the result of the
+// tally, with the mixed answers merged in, the mixed answers themselves and
+// the weight of the ballots counted by the tally. The answers to a write-in
+// question are only in its mixed answers.
+func (e *Election) Summarize(result Result, mixed MixedResult, ballots int64) ([]*QuestionResult, error) {
+	if len(result) != len(e.Questions) {
+		return nil, errors.New("results don't match the questions")
+	}
+
+	summary := make([]*QuestionResult, len(e.Questions))
+	for i, q := range e.Questions {
+		qr := &QuestionResult{
+			ResultType: q.ResultType,
+			Counts:     make([]int64, len(result[i])),
+			Ballots:    ballots,
+		}
+		copy(qr.Counts, result[i])
+		summary[i] = qr
+
+		var answers *MixedAnswers
+		if q.IsMixnet() {
+			if i >= len(mixed) || mixed[i] == nil {
+				return nil, fmt.Errorf("question %d is not decrypted", i)
+			}
+			answers = mixed[i]
+			qr.Ballots = int64(len(answers.Answers))
+		}
+
+		if q.ChoiceType == ChoiceWriteIn {
+			continue
+		}
+
+		if q.ResultType == ResultRelative {
+			total := int64(0)
+			for _, c := range qr.Counts {
+				total += c
+			}
+
+			qr.Percentages = make([]float64, len(qr.Counts))
+			for j, c := range qr.Counts {
+				if total > 0 {
+					qr.Percentages[j] = 100 * float64(c) / float64(total)
+				}
+			}
+			continue
+		}
+
+		if answers != nil && answers.Ranked != nil {
+			qr.Majority = int64(answers.Ranked.Quota)
+			qr.Winners = answers.Ranked.Winners
+			continue
+		}
+
+		// more than half of the votes the ballots could give an answer
+		qr.Majority = qr.Ballots*q.MaxChoice()/2 + 1
+		for j, c := range qr.Counts {
+			if c >= qr.Majority {
+				qr.Winners = append(qr.Winners, j)
+			}
+		}
+		sort.SliceStable(qr.Winners, func(a, b int) bool {
+			return qr.Counts[qr.Winners[a]] > qr.Counts[qr.Winners[b]]
+		})
+	}
+
+	return summary, nil
+}
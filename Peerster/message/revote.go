@@ -0,0 +1,76 @@
+package message
+
+import (
+	"errors"
+)
+
+// Revote policies of an Election, for voters who cast more than one ballot.
+// Under first-wins only the first ballot of a voter is recorded. Under
+// last-wins and reject-all-conflicts every ballot is recorded, and the tally
+// counts the latest ballot of a voter, or no ballot of a voter who cast
+// different ones. A voter who can vote again can't prove how it voted.
+const (
+	RevoteFirst  = "first"
+	RevoteLast   = "last"
+	RevoteReject = "reject"
+)
+
+// ComputeRevote gets the revote policy of the election, first-wins by default.
+func (e *Election) ComputeRevote() string {
+	if e.Revote == "" {
+		return RevoteFirst
+	}
+
+	return e.Revote
+}
+
+// SetRevote sets the revote policy of the election.
+func (e *Election) SetRevote(policy string) error {
+	if policy != RevoteFirst && policy != RevoteLast && policy != RevoteReject {
+		return errors.New("invalid revote policy")
+	}
+
+	e.Revote = policy
+	return nil
+}
+
+// RecordsRevotes tells whether every ballot of a voter is recorded, rather
+// than only its first one.
+func (e *Election) RecordsRevotes() bool {
+	return e.ComputeRevote() != RevoteFirst
+}
+
+// SelectBallots selects the ballots that count from the ballots recorded for
+// the election, in the order they were recorded, following its revote
+// policy. errs[i] is the error of the verification of ballots[i], and the
+// ballots that failed it are left out first.
+func (e *Election) SelectBallots(ballots []*CastBallot, errs []error) []*CastBallot {
+	policy := e.ComputeRevote()
+
+	// the index of the ballot that counts for each voter, or -1
+	selected := make(map[string]int)
+	for i, cb := range ballots {
+		if errs[i] != nil {
+			continue
+		}
+
+		j, ok := selected[cb.VoterUuid]
+		switch {
+		case !ok:
+			selected[cb.VoterUuid] = i
+		case policy == RevoteLast:
+			selected[cb.VoterUuid] = i
+		case policy == RevoteReject && (j < 0 || ballots[j].VoteHash != cb.VoteHash):
+			selected[cb.VoterUuid] = -1
+		}
+	}
+
+	counted := make([]*CastBallot, 0, len(selected))
+	for i, cb := range ballots {
+		if errs[i] == nil && selected[cb.VoterUuid] == i {
+			counted = append(counted, cb)
+		}
+	}
+
+	return counted
+}
@@ -0,0 +1,243 @@
+package message
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The voter roll of an election is committed to in its VotersHash, as the
+// root of a Merkle tree over the entries of the roll sorted by voter uuid,
+// following RFC 6962: a leaf is the hash of 0x00 and the JSON of an entry, and
+// a node the hash of 0x01 and its two children. A voter proves to be on the
+// roll with the audit path of its entry, without the trustees holding the roll.
+// The ballots of a block of the blockchain are committed to in a tree of the
+// same kind.
+
+// A RollEntry is a voter on the roll of an election.
+type RollEntry struct {
+	Uuid string `json:"uuid"`
+
+	// PublicKey is the key the voter signs its ballots with, hex encoded,
+	// see CastBallot.Sign.
+	PublicKey string `json:"public_key"`
+}
+
+// Hash computes the leaf hash of the entry, hex encoded. It is the VoterHash
+// of the ballots of the voter.
+func (v *RollEntry) Hash() string {
+	return hex.EncodeToString(v.leaf())
+}
+
+func (v *RollEntry) leaf() []byte {
+	js, _ := json.Marshal(v)
+	return merkleLeaf(js)
+}
+
+func merkleLeaf(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleSplit gets the largest power of 2 smaller than n, for n > 1.
+func merkleSplit(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+
+	k := merkleSplit(len(leaves))
+	return merkleNode(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merklePath gets the audit path of the leaf at index: the roots of the
+// sibling subtrees, from the leaf up.
+func merklePath(index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(merklePath(index, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(index-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// A VoterRoll is the list of the voters of an election, sorted by uuid.
+type VoterRoll struct {
+	Entries []*RollEntry
+
+	leaves [][]byte
+}
+
+// NewVoterRoll creates the roll of the given voters.
+func NewVoterRoll(entries []*RollEntry) (*VoterRoll, error) {
+	sorted := make([]*RollEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Uuid < sorted[j].Uuid
+	})
+
+	roll := &VoterRoll{Entries: sorted, leaves: make([][]byte, len(sorted))}
+	for i, v := range sorted {
+		if v == nil || v.Uuid == "" {
+			return nil, errors.New("voter without uuid")
+		}
+		if i > 0 && sorted[i-1].Uuid == v.Uuid {
+			return nil, fmt.Errorf("voter %s is on the roll twice", v.Uuid)
+		}
+		if _, err := decodePublicKey(v.PublicKey); err != nil {
+			return nil, fmt.Errorf("voter %s: %s", v.Uuid, err)
+		}
+		roll.leaves[i] = v.leaf()
+	}
+
+	return roll, nil
+}
+
+// Root computes the Merkle root of the roll, hex encoded, which is the
+// VotersHash of the election.
+func (r *VoterRoll) Root() string {
+	return hex.EncodeToString(merkleRoot(r.leaves))
+}
+
+// Prove gets the proof that the voter with the given uuid is on the roll.
+func (r *VoterRoll) Prove(uuid string) (*RollProof, bool) {
+	index := sort.Search(len(r.Entries), func(i int) bool {
+		return r.Entries[i].Uuid >= uuid
+	})
+	if index == len(r.Entries) || r.Entries[index].Uuid != uuid {
+		return nil, false
+	}
+
+	path := merklePath(index, r.leaves)
+	proof := &RollProof{
+		Voter: r.Entries[index],
+		Index: index,
+		Size:  len(r.Entries),
+		Path:  make([]string, len(path)),
+	}
+	for i, h := range path {
+		proof.Path[i] = hex.EncodeToString(h)
+	}
+
+	return proof, true
+}
+
+// A RollProof shows that a voter is the entry at Index of a roll of Size
+// voters. Path is the audit path of the entry, hex encoded.
+type RollProof struct {
+	Voter *RollEntry `json:"voter"`
+	Index int        `json:"index"`
+	Size  int        `json:"size"`
+	Path  []string   `json:"path"`
+}
+
+// Verify checks that the proof leads to the given root.
+func (p *RollProof) Verify(root string) error {
+	if p.Voter == nil || p.Index < 0 || p.Index >= p.Size {
+		return errors.New("invalid roll proof")
+	}
+
+	path := make([][]byte, len(p.Path))
+	for i, s := range p.Path {
+		h, err := hex.DecodeString(s)
+		if err != nil || len(h) != sha256.Size {
+			return fmt.Errorf("invalid node %d of the roll proof", i)
+		}
+		path[i] = h
+	}
+
+	computed, err := merkleRootFromPath(p.Index, p.Size, p.Voter.leaf(), path)
+	if err != nil {
+		return err
+	}
+
+	expected, err := hex.DecodeString(root)
+	if err != nil || !bytes.Equal(computed, expected) {
+		return errors.New("voter is not on the roll")
+	}
+
+	return nil
+}
+
+// merkleRootFromPath recomputes the root of a tree of size leaves from the leaf
+// at index and its audit path.
+func merkleRootFromPath(index int, size int, leaf []byte, path [][]byte) ([]byte, error) {
+	if size == 1 {
+		if len(path) != 0 {
+			return nil, errors.New("audit path is too long")
+		}
+		return leaf, nil
+	}
+	if len(path) == 0 {
+		return nil, errors.New("audit path is too short")
+	}
+
+	k := merkleSplit(size)
+	sibling := path[len(path)-1]
+	if index < k {
+		left, err := merkleRootFromPath(index, k, leaf, path[:len(path)-1])
+		if err != nil {
+			return nil, err
+		}
+		return merkleNode(left, sibling), nil
+	}
+
+	right, err := merkleRootFromPath(index-k, size-k, leaf, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	return merkleNode(sibling, right), nil
+}
+
+// CheckEligibility checks that the ballot is cast by a voter on the roll of
+// the election: its Eligibility must prove that the entry of its voter is
+// under the VotersHash, and it must be signed with the key of that entry.
+// Anyone can vote in an election with open registration.
+func (e *Election) CheckEligibility(cb *CastBallot) error {
+	if e.Openreg {
+		return nil
+	}
+
+	if cb == nil || cb.Eligibility == nil || cb.Eligibility.Voter == nil {
+		return errors.New("ballot has no proof that its voter is on the roll")
+	}
+
+	p := cb.Eligibility
+	if p.Voter.Uuid != cb.VoterUuid || p.Voter.Hash() != cb.VoterHash {
+		return errors.New("roll proof is for another voter")
+	}
+
+	if err := p.Verify(e.VotersHash); err != nil {
+		return err
+	}
+
+	return cb.VerifySignature(p.Voter.PublicKey)
+}
@@ -0,0 +1,117 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// DefaultMaxScore is the highest score of an answer to a score question
+// without a MaxScore.
+const DefaultMaxScore = 10
+
+// ComputeMaxScore gets the highest score of an answer to a score question.
+func (q *Question) ComputeMaxScore() int {
+	if q.MaxScore <= 0 {
+		return DefaultMaxScore
+	}
+
+	return q.MaxScore
+}
+
+// SetMaxScore sets the highest score of an answer to a score question.
+func (q *Question) SetMaxScore(maxScore int) error {
+	if q.ChoiceType != ChoiceScore {
+		return errors.New("only score questions have scores")
+	}
+
+	if maxScore < 1 {
+		return errors.New("invalid highest score")
+	}
+
+	q.MaxScore = maxScore
+	return nil
+}
+
+// MaxChoice gets the largest plaintext of a choice of a homomorphic question:
+// the highest score of a score question, and 1 for a selection otherwise.
+func (q *Question) MaxChoice() int64 {
+	if q.ChoiceType == ChoiceScore {
+		return int64(q.ComputeMaxScore())
+	}
+
+	return 1
+}
+
+// checkScores checks an answer to a score question: one score between 0 and
+// the highest score for each of the answers.
+func (q *Question) checkScores(scores []int64) error {
+	if len(scores) != len(q.Answers) {
+		return fmt.Errorf("answer has %d scores for %d answers", len(scores), len(q.Answers))
+	}
+
+	for j, s := range scores {
+		if s < 0 || s > q.MaxChoice() {
+			return fmt.Errorf("score %d of answer %d is not between 0 and %d", s, j, q.MaxChoice())
+		}
+	}
+	return nil
+}
+
+// SetWeights sets the weight of the ballots of each voter, by voter uuid.
+// Voters without a weight count once. The ballots for a mixnet question are
+// decrypted apart from their voter, so a weighted election can't have any.
+func (e *Election) SetWeights(weights map[string]int64) error {
+	for _, q := range e.Questions {
+		if q.IsMixnet() {
+			return errors.New("a weighted election can't have mixnet questions")
+		}
+	}
+
+	ws := make(map[string]int64, len(weights))
+	for voter, w := range weights {
+		if w < 1 {
+			return fmt.Errorf("weight of voter %s is not positive", voter)
+		}
+		ws[voter] = w
+	}
+
+	e.Weights = ws
+	return nil
+}
+
+// Weight gets the weight of the ballots of a voter.
+func (e *Election) Weight(voterUuid string) int64 {
+	if w, ok := e.Weights[voterUuid]; ok && w > 0 {
+		return w
+	}
+
+	return 1
+}
+
+// MaxTally gets the largest value a tally of the votes can take: the total
+// weight of the voters times the largest plaintext of a choice.
+func (e *Election) MaxTally(votes []*CastBallot) int64 {
+	total := int64(0)
+	for _, vote := range votes {
+		if vote != nil {
+			total += e.Weight(vote.VoterUuid)
+		}
+	}
+
+	maxChoice := int64(1)
+	for _, q := range e.Questions {
+		if !q.IsMixnet() && q.MaxChoice() > maxChoice {
+			maxChoice = q.MaxChoice()
+		}
+	}
+
+	return total * maxChoice
+}
+
+// ExpCiphertext raises a Ciphertext to the power w, which encrypts w times its
+// value.
+func (c *Ciphertext) ExpCiphertext(w int64, group Group) *Ciphertext {
+	e := big.NewInt(w)
+	return &Ciphertext{group.Exp(c.Alpha, e), group.Exp(c.Beta, e)}
+}
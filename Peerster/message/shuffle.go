@@ -0,0 +1,452 @@
+package message
+
+// Verifiable re-encryption shuffle of lists of ballots. A mix server permutes
+// its input and re-encrypts every ciphertext, so that no one can link an
+// output ballot to an input ballot, and proves with the shuffle argument of
+// Terelius and Wikström, in the form given by Haenni et al. for CHVote, that
+// the output encrypts the same plaintexts as the input.
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// A ShuffleProof proves that a list of ballots, each a list of ciphertexts of
+// the same width, is a re-encryption of another list in some secret order.
+type ShuffleProof struct {
+	// Commitments commits to the permutation: if input j goes to output
+	// i, Commitments[j] = g^r_j * h_i for independent generators h_i.
+	Commitments []*big.Int `json:"commitments"`
+
+	// ChainCommitments commits to the challenges in the order of the
+	// output: ChainCommitments[i] = g^rHat_i * ChainCommitments[i-1]^u'_i,
+	// starting from the generator h.
+	ChainCommitments []*big.Int `json:"chain_commitments"`
+
+	// Commitments of the sigma protocol, T4 has one entry per column.
+	T1   *big.Int      `json:"t1"`
+	T2   *big.Int      `json:"t2"`
+	T3   *big.Int      `json:"t3"`
+	T4   []*Ciphertext `json:"t4"`
+	THat []*big.Int    `json:"t_hat"`
+
+	// Responses of the sigma protocol.
+	S1     *big.Int   `json:"s1"`
+	S2     *big.Int   `json:"s2"`
+	S3     *big.Int   `json:"s3"`
+	S4     []*big.Int `json:"s4"`
+	SHat   []*big.Int `json:"s_hat"`
+	SPrime []*big.Int `json:"s_prime"`
+}
+
+// ReEncrypt multiplies c by an encryption of g^0 with the given randomness.
+func ReEncrypt(c *Ciphertext, randomness *big.Int, pk *Key) *Ciphertext {
+	g := pk.Group()
+	return &Ciphertext{
+		Alpha: g.Mul(c.Alpha, g.Exp(pk.Generator, randomness)),
+		Beta:  g.Mul(c.Beta, g.Exp(pk.PublicValue, randomness)),
+	}
+}
+
+// Shuffle permutes the ballots at random and re-encrypts each of their
+// ciphertexts, and proves it.
+func Shuffle(input [][]*Ciphertext, pk *Key) ([][]*Ciphertext, *ShuffleProof, error) {
+	n := len(input)
+	if n == 0 {
+		return nil, nil, errors.New("nothing to shuffle")
+	}
+	width := len(input[0])
+	for _, ballot := range input {
+		if len(ballot) != width {
+			return nil, nil, errors.New("ballots of different widths")
+		}
+	}
+
+	// Fisher-Yates: output i is input pi[i]
+	pi := make([]int, n)
+	for i := range pi {
+		pi[i] = i
+	}
+	for i := n - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return nil, nil, err
+		}
+		pi[i], pi[j.Int64()] = pi[j.Int64()], pi[i]
+	}
+
+	output := make([][]*Ciphertext, n)
+	randomness := make([][]*big.Int, n)
+	for i := range output {
+		var err error
+		if randomness[i], err = randomExponents(width, pk.ExponentPrime); err != nil {
+			return nil, nil, err
+		}
+
+		output[i] = make([]*Ciphertext, width)
+		for k, c := range input[pi[i]] {
+			output[i][k] = ReEncrypt(c, randomness[i][k], pk)
+		}
+	}
+
+	proof, err := newShuffleProof(input, output, pi, randomness, pk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return output, proof, nil
+}
+
+// newShuffleProof proves that output[i] is input[pi[i]] re-encrypted with
+// randomness[i].
+func newShuffleProof(input [][]*Ciphertext, output [][]*Ciphertext, pi []int, randomness [][]*big.Int, pk *Key) (*ShuffleProof, error) {
+	g := pk.Group()
+	q := pk.ExponentPrime
+	n, width := len(input), len(input[0])
+	h, hs := mixGenerators(pk, n)
+
+	r, err := randomExponents(n, q)
+	if err != nil {
+		return nil, err
+	}
+	commitments := make([]*big.Int, n)
+	for i, j := range pi {
+		commitments[j] = g.Mul(g.Exp(pk.Generator, r[j]), hs[i])
+	}
+
+	seed := shuffleSeed(input, output, commitments, pk)
+	u := shuffleChallenges(seed, n, q)
+
+	// u'_i = u_pi(i), the challenges in the order of the output
+	uPrime := make([]*big.Int, n)
+	for i, j := range pi {
+		uPrime[i] = u[j]
+	}
+
+	rHat, err := randomExponents(n, q)
+	if err != nil {
+		return nil, err
+	}
+	chain := make([]*big.Int, n)
+	prev := h
+	for i := range chain {
+		chain[i] = g.Mul(g.Exp(pk.Generator, rHat[i]), g.Exp(prev, uPrime[i]))
+		prev = chain[i]
+	}
+
+	// the exponents of g in the statements: rBar in the product of the
+	// commitments, rTilde in their product weighted by u, rChain in the
+	// last chain commitment and rStar[k] in the re-encryption of the
+	// weighted product of column k
+	rBar := new(big.Int)
+	rTilde := new(big.Int)
+	for j := range r {
+		rBar.Add(rBar, r[j])
+		rTilde.Add(rTilde, new(big.Int).Mul(r[j], u[j]))
+	}
+	rBar.Mod(rBar, q)
+	rTilde.Mod(rTilde, q)
+
+	rChain := new(big.Int)
+	for i := range rHat {
+		rChain.Mul(rChain, uPrime[i])
+		rChain.Add(rChain, rHat[i])
+		rChain.Mod(rChain, q)
+	}
+
+	rStar := make([]*big.Int, width)
+	for k := range rStar {
+		rStar[k] = new(big.Int)
+		for i := range randomness {
+			rStar[k].Add(rStar[k], new(big.Int).Mul(randomness[i][k], uPrime[i]))
+		}
+		rStar[k].Mod(rStar[k], q)
+	}
+
+	w, err := randomExponents(3, q)
+	if err != nil {
+		return nil, err
+	}
+	w4, err := randomExponents(width, q)
+	if err != nil {
+		return nil, err
+	}
+	wHat, err := randomExponents(n, q)
+	if err != nil {
+		return nil, err
+	}
+	wPrime, err := randomExponents(n, q)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ShuffleProof{
+		Commitments:      commitments,
+		ChainCommitments: chain,
+		T1:               g.Exp(pk.Generator, w[0]),
+		T2:               g.Exp(pk.Generator, w[1]),
+		T3:               g.Mul(g.Exp(pk.Generator, w[2]), multiExp(hs, wPrime, g)),
+		T4:               make([]*Ciphertext, width),
+		THat:             make([]*big.Int, n),
+	}
+	for k := range p.T4 {
+		alphas, betas := column(output, k)
+		minusW4 := negate(w4[k], q)
+		p.T4[k] = &Ciphertext{
+			Alpha: g.Mul(g.Exp(pk.Generator, minusW4), multiExp(alphas, wPrime, g)),
+			Beta:  g.Mul(g.Exp(pk.PublicValue, minusW4), multiExp(betas, wPrime, g)),
+		}
+	}
+	prev = h
+	for i := range p.THat {
+		p.THat[i] = g.Mul(g.Exp(pk.Generator, wHat[i]), g.Exp(prev, wPrime[i]))
+		prev = chain[i]
+	}
+
+	c := p.challenge(seed, q)
+
+	// s = w + c * witness mod q
+	respond := func(w *big.Int, witness *big.Int) *big.Int {
+		s := new(big.Int).Mul(c, witness)
+		s.Add(s, w)
+		return s.Mod(s, q)
+	}
+
+	p.S1 = respond(w[0], rBar)
+	p.S2 = respond(w[1], rChain)
+	p.S3 = respond(w[2], rTilde)
+	p.S4 = make([]*big.Int, width)
+	for k := range p.S4 {
+		p.S4[k] = respond(w4[k], rStar[k])
+	}
+	p.SHat = make([]*big.Int, n)
+	p.SPrime = make([]*big.Int, n)
+	for i := 0; i < n; i++ {
+		p.SHat[i] = respond(wHat[i], rHat[i])
+		p.SPrime[i] = respond(wPrime[i], uPrime[i])
+	}
+
+	return p, nil
+}
+
+// Verify checks that output is a shuffle of input under pk.
+func (p *ShuffleProof) Verify(input [][]*Ciphertext, output [][]*Ciphertext, pk *Key) error {
+	if p == nil {
+		return errors.New("missing shuffle proof")
+	}
+
+	n := len(input)
+	if n == 0 || len(output) != n {
+		return errors.New("wrong number of ballots")
+	}
+
+	g := pk.Group()
+	q := pk.ExponentPrime
+	width := len(input[0])
+	for i := range output {
+		if len(input[i]) != width || len(output[i]) != width {
+			return fmt.Errorf("ballot %d has the wrong width", i)
+		}
+		for k, c := range input[i] {
+			if c == nil {
+				return fmt.Errorf("choice %d of input ballot %d is missing", k, i)
+			}
+		}
+		for k, c := range output[i] {
+			if c == nil || !g.IsMember(c.Alpha) || !g.IsMember(c.Beta) {
+				return fmt.Errorf("choice %d of ballot %d is not in the group", k, i)
+			}
+		}
+	}
+
+	if len(p.Commitments) != n || len(p.ChainCommitments) != n || len(p.THat) != n ||
+		len(p.SHat) != n || len(p.SPrime) != n || len(p.T4) != width || len(p.S4) != width {
+		return errors.New("shuffle proof has the wrong size")
+	}
+
+	elements := []*big.Int{p.T1, p.T2, p.T3}
+	elements = append(elements, p.Commitments...)
+	elements = append(elements, p.ChainCommitments...)
+	elements = append(elements, p.THat...)
+	for _, t := range p.T4 {
+		if t == nil {
+			return errors.New("shuffle proof is not in the group")
+		}
+		elements = append(elements, t.Alpha, t.Beta)
+	}
+	for _, x := range elements {
+		if !g.IsMember(x) {
+			return errors.New("shuffle proof is not in the group")
+		}
+	}
+
+	responses := []*big.Int{p.S1, p.S2, p.S3}
+	responses = append(responses, p.S4...)
+	responses = append(responses, p.SHat...)
+	responses = append(responses, p.SPrime...)
+	for _, s := range responses {
+		if s == nil {
+			return errors.New("missing response in the shuffle proof")
+		}
+	}
+
+	h, hs := mixGenerators(pk, n)
+	seed := shuffleSeed(input, output, p.Commitments, pk)
+	u := shuffleChallenges(seed, n, q)
+	c := p.challenge(seed, q)
+	minusC := negate(c, q)
+
+	// t = statement^-c * g^s * ..., for each statement of the prover
+	check := func(t *big.Int, statement *big.Int, rest *big.Int) bool {
+		return t.Cmp(g.Mul(g.Exp(statement, minusC), rest)) == 0
+	}
+
+	// the product of the commitments is g^rBar * prod h_i
+	cBar := g.Mul(multiExp(p.Commitments, nil, g), g.Inv(multiExp(hs, nil, g)))
+	if !check(p.T1, cBar, g.Exp(pk.Generator, p.S1)) {
+		return errors.New("commitments are not to a permutation")
+	}
+
+	// the chain ends at g^rChain * h^prod u_j
+	uProduct := big.NewInt(1)
+	for _, uj := range u {
+		uProduct.Mul(uProduct, uj)
+		uProduct.Mod(uProduct, q)
+	}
+	cHat := g.Mul(p.ChainCommitments[n-1], g.Inv(g.Exp(h, uProduct)))
+	if !check(p.T2, cHat, g.Exp(pk.Generator, p.S2)) {
+		return errors.New("chain does not commit to the permuted challenges")
+	}
+
+	// the commitments weighted by u are g^rTilde * prod h_i^u'_i
+	cTilde := multiExp(p.Commitments, u, g)
+	if !check(p.T3, cTilde, g.Mul(g.Exp(pk.Generator, p.S3), multiExp(hs, p.SPrime, g))) {
+		return errors.New("commitments don't match the permuted challenges")
+	}
+
+	// the output weighted by u' re-encrypts the input weighted by u
+	for k := range p.T4 {
+		minusS4 := negate(p.S4[k], q)
+		inAlphas, inBetas := column(input, k)
+		outAlphas, outBetas := column(output, k)
+		if !check(p.T4[k].Alpha, multiExp(inAlphas, u, g),
+			g.Mul(g.Exp(pk.Generator, minusS4), multiExp(outAlphas, p.SPrime, g))) ||
+			!check(p.T4[k].Beta, multiExp(inBetas, u, g),
+				g.Mul(g.Exp(pk.PublicValue, minusS4), multiExp(outBetas, p.SPrime, g))) {
+			return fmt.Errorf("choice %d is not re-encrypted", k)
+		}
+	}
+
+	prev := h
+	for i := range p.THat {
+		if !check(p.THat[i], p.ChainCommitments[i], g.Mul(g.Exp(pk.Generator, p.SHat[i]), g.Exp(prev, p.SPrime[i]))) {
+			return fmt.Errorf("invalid chain commitment %d", i)
+		}
+		prev = p.ChainCommitments[i]
+	}
+
+	return nil
+}
+
+// mixGenerators derives the generator h and the generators h_0..h_n-1 of the
+// permutation commitments from the group, so that no one knows their
+// discrete logarithms.
+func mixGenerators(pk *Key, n int) (*big.Int, []*big.Int) {
+	g := pk.Group()
+	h := g.HashToElement([]byte(fmt.Sprintf("%s,mixnet,h", pk.groupID())))
+	hs := make([]*big.Int, n)
+	for i := range hs {
+		hs[i] = g.HashToElement([]byte(fmt.Sprintf("%s,mixnet,%d", pk.groupID(), i)))
+	}
+	return h, hs
+}
+
+// shuffleSeed hashes the statement and the permutation commitments, from
+// which all the challenges are derived.
+func shuffleSeed(input [][]*Ciphertext, output [][]*Ciphertext, commitments []*big.Int, pk *Key) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s,%s", pk.groupID(), pk.PublicValue)
+	for _, ballots := range [][][]*Ciphertext{input, output} {
+		for _, ballot := range ballots {
+			for _, c := range ballot {
+				fmt.Fprintf(h, ",%s,%s", c.Alpha, c.Beta)
+			}
+			fmt.Fprint(h, ";")
+		}
+	}
+	writeInts(h, commitments...)
+	return h.Sum(nil)
+}
+
+// shuffleChallenges derives the challenges u_j that weight the input ballots.
+func shuffleChallenges(seed []byte, n int, q *big.Int) []*big.Int {
+	u := make([]*big.Int, n)
+	for j := range u {
+		h := sha256.New()
+		fmt.Fprintf(h, "%x,u,%d", seed, j)
+		u[j] = new(big.Int).SetBytes(h.Sum(nil))
+		u[j].Mod(u[j], q)
+	}
+	return u
+}
+
+// challenge hashes the seed and the commitments of the sigma protocol.
+func (p *ShuffleProof) challenge(seed []byte, q *big.Int) *big.Int {
+	h := sha256.New()
+	fmt.Fprintf(h, "%x,c", seed)
+	writeInts(h, p.ChainCommitments...)
+	writeInts(h, p.T1, p.T2, p.T3)
+	for _, t := range p.T4 {
+		writeInts(h, t.Alpha, t.Beta)
+	}
+	writeInts(h, p.THat...)
+
+	c := new(big.Int).SetBytes(h.Sum(nil))
+	return c.Mod(c, q)
+}
+
+func writeInts(h hash.Hash, xs ...*big.Int) {
+	for _, x := range xs {
+		fmt.Fprintf(h, ",%s", x)
+	}
+}
+
+// multiExp computes prod xs[i]^es[i], or prod xs[i] if es is nil.
+func multiExp(xs []*big.Int, es []*big.Int, g Group) *big.Int {
+	prod := g.Identity()
+	for i, x := range xs {
+		if es != nil {
+			x = g.Exp(x, es[i])
+		}
+		prod = g.Mul(prod, x)
+	}
+	return prod
+}
+
+// column returns the alphas and betas of the k-th ciphertext of each ballot.
+func column(ballots [][]*Ciphertext, k int) ([]*big.Int, []*big.Int) {
+	alphas := make([]*big.Int, len(ballots))
+	betas := make([]*big.Int, len(ballots))
+	for i, ballot := range ballots {
+		alphas[i], betas[i] = ballot[k].Alpha, ballot[k].Beta
+	}
+	return alphas, betas
+}
+
+func negate(x *big.Int, q *big.Int) *big.Int {
+	minus := new(big.Int).Neg(x)
+	return minus.Mod(minus, q)
+}
+
+func randomExponents(n int, q *big.Int) ([]*big.Int, error) {
+	xs := make([]*big.Int, n)
+	for i := range xs {
+		var err error
+		if xs[i], err = rand.Int(rand.Reader, q); err != nil {
+			return nil, err
+		}
+	}
+	return xs, nil
+}
@@ -0,0 +1,171 @@
+package message
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sort"
+	"testing"
+)
+
+// testKey returns a key of the Ed25519 group and its secret.
+func testKey(t *testing.T) (*Key, *big.Int) {
+	params := NewEd25519Parameters()
+	secret, err := rand.Int(rand.Reader, params.ExponentPrime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params.WithPublicValue(params.Group().Exp(params.Generator, secret)), secret
+}
+
+// encryptBallots encrypts each row of values as a ballot.
+func encryptBallots(t *testing.T, values [][]int64, pk *Key) [][]*Ciphertext {
+	ballots := make([][]*Ciphertext, len(values))
+	for i, row := range values {
+		ballots[i] = make([]*Ciphertext, len(row))
+		for k, v := range row {
+			r, err := rand.Int(rand.Reader, pk.ExponentPrime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ballots[i][k] = encryptValue(v, r, pk)
+		}
+	}
+	return ballots
+}
+
+// decryptBallots decrypts the ballots to the group elements g^v, as strings,
+// sorted so that the plaintexts of two lists can be compared.
+func decryptBallots(ballots [][]*Ciphertext, pk *Key, secret *big.Int) []string {
+	g := pk.Group()
+	out := make([]string, len(ballots))
+	for i, ballot := range ballots {
+		for _, c := range ballot {
+			out[i] += g.Mul(c.Beta, g.Inv(g.Exp(c.Alpha, secret))).String() + ","
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestShuffle(t *testing.T) {
+	pk, secret := testKey(t)
+	input := encryptBallots(t, [][]int64{{1, 0}, {0, 1}, {1, 1}, {0, 0}}, pk)
+
+	output, proof, err := Shuffle(input, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proof.Verify(input, output, pk); err != nil {
+		t.Fatalf("honest shuffle: %s", err)
+	}
+
+	in, out := decryptBallots(input, pk, secret), decryptBallots(output, pk, secret)
+	for i := range in {
+		if in[i] != out[i] {
+			t.Fatal("the shuffle changed the plaintexts")
+		}
+	}
+}
+
+func TestShuffleTampered(t *testing.T) {
+	pk, _ := testKey(t)
+	input := encryptBallots(t, [][]int64{{1, 0}, {0, 1}, {1, 1}, {0, 0}}, pk)
+
+	output, proof, err := Shuffle(input, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// copy returns a copy of the output to tamper with
+	copy := func() [][]*Ciphertext {
+		c := make([][]*Ciphertext, len(output))
+		for i := range output {
+			c[i] = append([]*Ciphertext{}, output[i]...)
+		}
+		return c
+	}
+
+	replaced := copy()
+	replaced[0][0] = encryptBallots(t, [][]int64{{2}}, pk)[0][0]
+	if proof.Verify(input, replaced, pk) == nil {
+		t.Error("a replaced ciphertext passes")
+	}
+
+	// a re-encryption of the same plaintext changes the randomness
+	reencrypted := copy()
+	reencrypted[1][1] = ReEncrypt(reencrypted[1][1], big.NewInt(1), pk)
+	if proof.Verify(input, reencrypted, pk) == nil {
+		t.Error("a re-encrypted ciphertext passes")
+	}
+
+	swapped := copy()
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+	if proof.Verify(input, swapped, pk) == nil {
+		t.Error("swapped ballots pass")
+	}
+
+	if proof.Verify(input, output[1:], pk) == nil {
+		t.Error("a dropped ballot passes")
+	}
+
+	other := encryptBallots(t, [][]int64{{1, 0}, {0, 1}, {1, 1}, {0, 0}}, pk)
+	if proof.Verify(other, output, pk) == nil {
+		t.Error("the shuffle of other ballots passes")
+	}
+
+	bad := *proof
+	bad.S1 = new(big.Int).Add(proof.S1, big.NewInt(1))
+	if bad.Verify(input, output, pk) == nil {
+		t.Error("a forged response passes")
+	}
+
+	bad = *proof
+	bad.Commitments = append([]*big.Int{}, proof.Commitments...)
+	bad.Commitments[0], bad.Commitments[1] = bad.Commitments[1], bad.Commitments[0]
+	if bad.Verify(input, output, pk) == nil {
+		t.Error("swapped commitments pass")
+	}
+}
+
+func TestVerifyMixes(t *testing.T) {
+	pk, _ := testKey(t)
+	e := &Election{PublicKey: pk, Trustees: []*Trustee{{Index: 1}, {Index: 2}}}
+	input := encryptBallots(t, [][]int64{{1}, {0}, {1}}, pk)
+
+	first, err := NewMix(1, input, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewMix(2, first.Output, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := e.VerifyMixes(input, []*Mix{first, second})
+	if err != nil {
+		t.Fatalf("honest mixes: %s", err)
+	}
+	if len(out) != len(input) || out[0][0] != second.Output[0][0] {
+		t.Fatal("the output is not the one of the last mix")
+	}
+
+	if _, err := e.VerifyMixes(input, []*Mix{second, first}); err == nil {
+		t.Error("mixes out of order pass")
+	}
+
+	again, err := NewMix(1, first.Output, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.VerifyMixes(input, []*Mix{first, again}); err == nil {
+		t.Error("two mixes by the same trustee pass")
+	}
+
+	stranger, err := NewMix(3, first.Output, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.VerifyMixes(input, []*Mix{first, stranger}); err == nil {
+		t.Error("a mix by an unknown trustee passes")
+	}
+}
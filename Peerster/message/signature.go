@@ -0,0 +1,83 @@
+package message
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// A voter signs its cast ballots with an Ed25519 key, the public half of which
+// is in its entry on the roll, so that only the holder of the key can cast a
+// ballot in the name of the voter. The signature binds the tracker of the
+// ballot to the election and to the entry of the voter, and it is kept in the
+// block of the ballot so that it can be audited from the chain.
+
+// NewSigningKey generates a signing key for a voter, and the public key of its
+// entry on the roll, hex encoded.
+func NewSigningKey() (ed25519.PrivateKey, string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return private, hex.EncodeToString(public), nil
+}
+
+func decodePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid signing key")
+	}
+
+	return ed25519.PublicKey(b), nil
+}
+
+// SignedData is what the voter signs: the tracker of the ballot, the election
+// it is cast in and the voter casting it.
+func (cb *CastBallot) SignedData() []byte {
+	data := struct {
+		ElectionHash string `json:"election_hash"`
+		ElectionUuid string `json:"election_uuid"`
+		VoteHash     string `json:"vote_hash"`
+		VoterHash    string `json:"voter_hash"`
+		VoterUuid    string `json:"voter_uuid"`
+	}{
+		VoteHash:  cb.VoteHash,
+		VoterHash: cb.VoterHash,
+		VoterUuid: cb.VoterUuid,
+	}
+	if cb.Vote != nil {
+		data.ElectionHash = cb.Vote.ElectionHash
+		data.ElectionUuid = cb.Vote.ElectionUuid
+	}
+
+	js, _ := json.Marshal(data)
+	return js
+}
+
+// Sign signs the ballot with the key of its voter.
+func (cb *CastBallot) Sign(key ed25519.PrivateKey) {
+	cb.Signature = hex.EncodeToString(ed25519.Sign(key, cb.SignedData()))
+}
+
+// VerifySignature checks that the ballot is signed with the given public key,
+// hex encoded.
+func (cb *CastBallot) VerifySignature(publicKey string) error {
+	key, err := decodePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	sig, err := hex.DecodeString(cb.Signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("ballot is not signed")
+	}
+
+	if !ed25519.Verify(key, cb.SignedData(), sig) {
+		return errors.New("invalid ballot signature")
+	}
+
+	return nil
+}
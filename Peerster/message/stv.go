@@ -0,0 +1,177 @@
+package message
+
+// Counting of ranked questions by single transferable vote, with the Droop
+// quota and the surplus of an elected answer transferred at a fraction of
+// the value of each of its ballots (Gregory method). With a single seat, it is
+// instant-runoff voting. Votes are counted exactly as fractions and only
+// rounded when reported.
+import (
+	"math/big"
+	"sort"
+)
+
+// A RankedRound is a round of the count of a ranked question.
+type RankedRound struct {
+	// Votes are the votes of each answer still in the count at the start
+	// of the round, and 0 for the answers elected or eliminated before.
+	Votes []float64 `json:"votes"`
+
+	// Exhausted are the votes of the ballots without any answer left.
+	Exhausted float64 `json:"exhausted"`
+
+	// Elected and Eliminated are the answers elected or eliminated at the
+	// end of the round.
+	Elected    []int `json:"elected,omitempty"`
+	Eliminated []int `json:"eliminated,omitempty"`
+}
+
+// A RankedResult is the count of a ranked question, round by round.
+type RankedResult struct {
+	Seats int `json:"seats"`
+
+	// Quota is the number of votes that elects an answer.
+	Quota float64 `json:"quota"`
+
+	Rounds []*RankedRound `json:"rounds"`
+
+	// Winners are the elected answers, in the order they were elected.
+	Winners []int `json:"winners"`
+}
+
+// Status of an answer during the count.
+const (
+	continuing = iota
+	elected
+	eliminated
+)
+
+// CountRanked counts the rankings of the ballots, each a list of distinct
+// answers in order of preference, to elect seats of the answers.
+//
+// In each round, every ballot counts for its most preferred answer still in
+// the count. The answers that reach the quota are elected, and the ballots
+// counting for them carry their surplus over to their next preferences at a
+// reduced value. If none does, the answer with the fewest votes is
+// eliminated. A tie for the fewest votes is broken by the votes in the
+// previous rounds, from the latest, and then against the answer listed last.
+// Once the answers left fill the remaining seats, they are all elected.
+func CountRanked(rankings [][]int64, answers int, seats int) *RankedResult {
+	if seats > answers {
+		seats = answers
+	}
+
+	weights := make([]*big.Rat, len(rankings))
+	valid := int64(0)
+	for b, ranking := range rankings {
+		weights[b] = big.NewRat(1, 1)
+		if len(ranking) > 0 {
+			valid++
+		}
+	}
+
+	// Droop quota: floor(valid / (seats + 1)) + 1
+	quota := big.NewRat(valid/int64(seats+1)+1, 1)
+	quotaFloat, _ := quota.Float64()
+	result := &RankedResult{
+		Seats:   seats,
+		Quota:   quotaFloat,
+		Rounds:  make([]*RankedRound, 0),
+		Winners: make([]int, 0),
+	}
+
+	status := make([]int, answers)
+	history := make([][]*big.Rat, 0)
+	for len(result.Winners) < seats {
+		// count every ballot for its top answer still in the count
+		votes := make([]*big.Rat, answers)
+		for a := range votes {
+			votes[a] = new(big.Rat)
+		}
+		exhausted := new(big.Rat)
+		tops := make([]int, len(rankings))
+		for b, ranking := range rankings {
+			tops[b] = -1
+			for _, a := range ranking {
+				if a >= 0 && a < int64(answers) && status[a] == continuing {
+					tops[b] = int(a)
+					break
+				}
+			}
+
+			if tops[b] < 0 {
+				exhausted.Add(exhausted, weights[b])
+			} else {
+				votes[tops[b]].Add(votes[tops[b]], weights[b])
+			}
+		}
+		history = append(history, votes)
+
+		round := &RankedRound{Votes: make([]float64, answers)}
+		for a, v := range votes {
+			round.Votes[a], _ = v.Float64()
+		}
+		round.Exhausted, _ = exhausted.Float64()
+		result.Rounds = append(result.Rounds, round)
+
+		// the continuing answers, from the most to the fewest votes
+		left := make([]int, 0, answers)
+		for a := range status {
+			if status[a] == continuing {
+				left = append(left, a)
+			}
+		}
+		sort.SliceStable(left, func(i, j int) bool {
+			return ahead(left[i], left[j], history)
+		})
+
+		remaining := seats - len(result.Winners)
+		if len(left) <= remaining {
+			round.Elected = left
+			result.Winners = append(result.Winners, left...)
+			break
+		}
+
+		for _, a := range left {
+			if len(round.Elected) == remaining || votes[a].Cmp(quota) < 0 {
+				break
+			}
+			round.Elected = append(round.Elected, a)
+		}
+
+		if len(round.Elected) == 0 {
+			loser := left[len(left)-1]
+			status[loser] = eliminated
+			round.Eliminated = []int{loser}
+			continue
+		}
+
+		for _, a := range round.Elected {
+			status[a] = elected
+			result.Winners = append(result.Winners, a)
+
+			// the ballots for a keep the quota and pass on the
+			// surplus: each is now worth (votes - quota) / votes of
+			// what it was
+			surplus := new(big.Rat).Sub(votes[a], quota)
+			transfer := surplus.Quo(surplus, votes[a])
+			for b := range rankings {
+				if tops[b] == a {
+					weights[b].Mul(weights[b], transfer)
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// ahead tells whether answer a is ahead of answer b: it has more votes in the
+// latest round where they differ, or is listed first if they never do.
+func ahead(a int, b int, history [][]*big.Rat) bool {
+	for r := len(history) - 1; r >= 0; r-- {
+		if c := history[r][a].Cmp(history[r][b]); c != 0 {
+			return c > 0
+		}
+	}
+	return a < b
+}
@@ -0,0 +1,104 @@
+package message
+
+import (
+	"fmt"
+	"testing"
+)
+
+// repeat returns n copies of ranking.
+func repeat(n int, ranking ...int64) [][]int64 {
+	out := make([][]int64, n)
+	for i := range out {
+		out[i] = ranking
+	}
+	return out
+}
+
+// ballots concatenates lists of rankings.
+func ballots(lists ...[][]int64) [][]int64 {
+	out := make([][]int64, 0)
+	for _, l := range lists {
+		out = append(out, l...)
+	}
+	return out
+}
+
+func checkWinners(t *testing.T, r *RankedResult, winners ...int) {
+	t.Helper()
+	if fmt.Sprint(r.Winners) != fmt.Sprint(winners) {
+		t.Fatalf("winners %v, want %v", r.Winners, winners)
+	}
+}
+
+func TestCountRankedInstantRunoff(t *testing.T) {
+	// the plurality leader loses once the votes of the last answer go to
+	// their second preference
+	r := CountRanked(ballots(repeat(4, 0), repeat(3, 2, 1), repeat(2, 1, 2)), 3, 1)
+
+	checkWinners(t, r, 2)
+	if r.Quota != 5 {
+		t.Fatalf("quota %v, want 5", r.Quota)
+	}
+	if len(r.Rounds) != 2 || fmt.Sprint(r.Rounds[0].Eliminated) != "[1]" {
+		t.Fatalf("rounds %v", r.Rounds)
+	}
+	if fmt.Sprint(r.Rounds[1].Votes) != "[4 0 5]" {
+		t.Fatalf("votes %v after the transfer", r.Rounds[1].Votes)
+	}
+}
+
+func TestCountRankedTieBrokenByEarlierRounds(t *testing.T) {
+	// 1 and 2 tie in the second round, 2 had fewer votes in the first
+	r := CountRanked(ballots(repeat(5, 0), repeat(3, 1), repeat(2, 2), repeat(1, 3, 2)), 4, 1)
+
+	if len(r.Rounds) < 2 || fmt.Sprint(r.Rounds[1].Votes) != "[5 3 3 0]" {
+		t.Fatalf("rounds %v", r.Rounds)
+	}
+	if fmt.Sprint(r.Rounds[1].Eliminated) != "[2]" {
+		t.Fatalf("eliminated %v in the tie", r.Rounds[1].Eliminated)
+	}
+
+	// the ballots of 2 and 3 rank no one else
+	if r.Rounds[2].Exhausted != 3 {
+		t.Fatalf("%v exhausted votes, want 3", r.Rounds[2].Exhausted)
+	}
+	checkWinners(t, r, 0)
+}
+
+func TestCountRankedTieBrokenByOrder(t *testing.T) {
+	// with no earlier round to break it, the answer listed last goes
+	r := CountRanked(ballots(repeat(1, 0), repeat(1, 1)), 2, 1)
+
+	if fmt.Sprint(r.Rounds[0].Eliminated) != "[1]" {
+		t.Fatalf("eliminated %v", r.Rounds[0].Eliminated)
+	}
+	checkWinners(t, r, 0)
+}
+
+func TestCountRankedSurplusTransfer(t *testing.T) {
+	// 0 is elected with 6 votes for a quota of 4, and its surplus of 2 is
+	// passed on at 1/3 of each of its ballots
+	r := CountRanked(ballots(repeat(6, 0, 1), repeat(1, 1), repeat(2, 2)), 3, 2)
+
+	if r.Quota != 4 {
+		t.Fatalf("quota %v, want 4", r.Quota)
+	}
+	if fmt.Sprint(r.Rounds[0].Elected) != "[0]" {
+		t.Fatalf("elected %v in the first round", r.Rounds[0].Elected)
+	}
+	if fmt.Sprint(r.Rounds[1].Votes) != "[0 3 2]" {
+		t.Fatalf("votes %v after the surplus", r.Rounds[1].Votes)
+	}
+	checkWinners(t, r, 0, 1)
+}
+
+func TestCountRankedFillsSeats(t *testing.T) {
+	// empty and unknown answers don't count, and more seats than answers
+	// elect them all
+	r := CountRanked(ballots(repeat(2, 1), repeat(1), repeat(1, 7)), 2, 3)
+
+	if r.Seats != 2 {
+		t.Fatalf("%d seats for 2 answers", r.Seats)
+	}
+	checkWinners(t, r, 1, 0)
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"flag"
 	"fmt"
 
@@ -14,6 +15,10 @@ var port = flag.String("port", "8080", "please provide UI Port")
 func main() {
 	flag.Parse()
 	fmt.Println(*port)
-	v := &Voter{Port: *port}
+	v := &Voter{
+		Port:     *port,
+		Prepared: make(map[string]*PreparedBallot),
+		Keys:     make(map[string]ed25519.PrivateKey),
+	}
 	v.ListenToGui()
 }
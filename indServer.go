@@ -5,44 +5,51 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
 	. "github.com/TRUMANCFY/DSEProject/voter"
 	"github.com/gorilla/mux"
 )
 
 type Server struct {
 	listElection []ElectionStruct
-}
 
-type KeyStr struct {
-	// Generator is the generator element g used in ElGamal encryptions.
-	Generator string `json:"g"`
+	// frozen elections by name, as sent to the trustees
+	elections map[string]Election
 
-	// Prime is the prime p for the group used in encryption.
-	Prime string `json:"p"`
+	// elections waiting for their key generation, and the results reported
+	// so far by trustee index
+	pending map[string]Election
+	results map[string]map[int]*DKGResult
 
-	// ExponentPrime is another prime that specifies the group of exponent
-	// values in the exponent of Generator. It is used in challenge
-	// generation and verification.
-	ExponentPrime string `json:"q"`
+	// voter rolls by election name, committed to in the VotersHash of the
+	// election
+	rolls map[string]*message.VoterRoll
 
-	// PublicValue is the public-key value y used to encrypt.
-	PublicValue string `json:"y"`
+	Mux *sync.Mutex
 }
 
 func ConvertBigIntToStr(key *Key) KeyStr {
-	return KeyStr{
+	keyStr := KeyStr{
 		Generator:     key.Generator.String(),
-		Prime:         key.Prime.String(),
 		ExponentPrime: key.ExponentPrime.String(),
 		PublicValue:   key.PublicValue.String(),
+		Group:         key.GroupName,
+	}
+
+	// elliptic curve groups have no prime p
+	if key.Prime != nil {
+		keyStr.Prime = key.Prime.String()
 	}
+	return keyStr
 }
 
 type PKContainer struct {
@@ -50,11 +57,31 @@ type PKContainer struct {
 	PublicKey KeyStr `json:"publickey"`
 }
 
+type DKGContainer struct {
+	Name  string   `json:"name"`
+	Trust *Trustee `json:"trust"`
+	Elec  Election `json:"elec"`
+
+	// Result is where the trustee reports the generated key
+	Result string `json:"result"`
+}
+
 type PartialKeyContainer struct {
-	Name       string   `json:"name"`
-	PartialKey *big.Int `json:"partialkey"`
-	Trust      *Trustee `json:"trust"`
-	Elec       Election `json:"elec"`
+	Name  string   `json:"name"`
+	Trust *Trustee `json:"trust"`
+	Elec  Election `json:"elec"`
+}
+
+// DKGResult is what a trustee reports at the end of the key generation.
+type DKGResult struct {
+	Name      string     `json:"name"`
+	Index     int        `json:"index"`
+	PublicKey *Key       `json:"public_key"`
+	Trustees  []*big.Int `json:"trustees"`
+	Qualified []int      `json:"qualified"`
+
+	// PoK proves that the reporting trustee knows its share
+	PoK *message.SchnorrProof `json:"pok"`
 }
 
 type PrivateKeyMap struct {
@@ -70,6 +97,10 @@ type ElectionStruct struct {
 
 const PYTHON_SERVER = "127.0.0.1:4000"
 
+// IND_SERVER is the address this server listens on, the trustees report
+// the keys they generate to it.
+const IND_SERVER = "127.0.0.1:8081"
+
 func (s *Server) ReceiveElection(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		panic("wrong method")
@@ -77,95 +108,327 @@ func (s *Server) ReceiveElection(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var comingElection struct {
-		Elec Election `json:"elec"`
+		Elec  Election `json:"elec"`
+		Group string   `json:"group"`
+
+		// Voters are the voters on the roll with their signing keys,
+		// anyone can vote if there are none
+		Voters []*RollEntry `json:"voters"`
 	}
 
 	json.NewDecoder(r.Body).Decode(&comingElection)
 
-	var pk *Key
-	var secret *big.Int
-	pk, secret, err := NewKey()
-	comingElection.Elec.PublicKey = pk
-	comingElection.Elec.Secret = secret
+	// the questions are frozen as they are defined, so they must make sense
+	if err := comingElection.Elec.ValidateQuestions(); err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// the trustees open and close the voting at the times of its window
+	if _, _, err := comingElection.Elec.VotingWindow(); err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// a voter who votes again is counted as the revote policy says
+	if err := comingElection.Elec.SetRevote(comingElection.Elec.ComputeRevote()); err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	// create trustees from election
+	// commit to the roll before the election is frozen
+	roll, err := message.NewVoterRoll(comingElection.Voters)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	comingElection.Elec.VotersHash = roll.Root()
+	comingElection.Elec.Openreg = len(roll.Entries) == 0
+
+	// Ed25519 by default, as mod p ciphertexts are large and slow to set up
+	if comingElection.Group == "" {
+		comingElection.Group = message.GroupEd25519
+	}
+
+	// only the group is chosen here, the trustees generate the key together
+	params, err := NewGroupParameters(comingElection.Group)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	comingElection.Elec.PublicKey = params
+	comingElection.Elec.Secret = nil
+
+	// create trustees from election, any majority of them can decrypt
 	trusteeCount := 3
-	var trustees []*Trustee
-	var trusteeSecrets []*big.Int
-	trustees, trusteeSecrets, _ = SplitKey(comingElection.Elec.Secret, comingElection.Elec.PublicKey, trusteeCount)
+	if comingElection.Elec.Threshold <= 0 {
+		comingElection.Elec.Threshold = message.MinThreshold(trusteeCount)
+	}
 
-	// hardcoded addresses of the trusteeSecrets
-	trustees[0].Address = "http://127.0.0.1:8000/partialkey"
-	trustees[1].Address = "http://127.0.0.1:8001/partialkey"
-	trustees[2].Address = "http://127.0.0.1:8002/partialkey"
+	trustees := make([]*Trustee, trusteeCount)
+	for i := range trustees {
+		trustees[i] = &Trustee{Index: i + 1}
+	}
+
+	// hardcoded addresses of the trustees
+	trustees[0].Address = "http://127.0.0.1:8000"
+	trustees[1].Address = "http://127.0.0.1:8001"
+	trustees[2].Address = "http://127.0.0.1:8002"
 
 	// add those trustees to the election
 	comingElection.Elec.Trustees = trustees
+	if err := comingElection.Elec.CheckThreshold(); err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	var sendVal map[string]PartialKeyContainer
+	fmt.Println(comingElection.Elec.Questions)
 
+	elecSend := comingElection.Elec
+
+	s.Mux.Lock()
+	s.pending[elecSend.Name] = elecSend
+	s.rolls[elecSend.Name] = roll
+	s.results[elecSend.Name] = make(map[int]*DKGResult)
+	s.Mux.Unlock()
+
+	var sendVal map[string]DKGContainer
 	var jsonVal []byte
 
-	// append the election to the public elecrions
-	// s.listElection = append(s.listElection, comingElection.Elec)
+	// start the key generation on each trustee
+	for _, t := range trustees {
 
-	fmt.Println(comingElection.Elec.Questions)
+		dkgCon := DKGContainer{
+			Name:   elecSend.Name,
+			Trust:  t,
+			Elec:   elecSend,
+			Result: "http://" + IND_SERVER + "/dkgresult",
+		}
 
-	elecSend := comingElection.Elec
+		sendVal = map[string]DKGContainer{"dkg": dkgCon}
+		jsonVal, _ = json.Marshal(sendVal)
 
-	// comingElection.Elec.Name
-	pkContainer := PKContainer{
-		Name:      comingElection.Elec.Name,
-		PublicKey: ConvertBigIntToStr(pk),
+		if _, err := http.Post(t.Address+"/dkg", "application/json", bytes.NewBuffer(jsonVal)); err != nil {
+			fmt.Println(err)
+		}
 	}
+}
 
-	values := map[string]PKContainer{"pkcontainer": pkContainer}
-	jsonValue, _ := json.Marshal(values)
-	// target, _ := url.Parse("127.0.0.1:8081/election")
-	resp, err := http.Post("http://127.0.0.1:4000/publickey", "application/json", bytes.NewBuffer(jsonValue))
-	fmt.Print(resp)
-	if err != nil {
-		panic(err)
+// ReceiveDKGResult collects the results of the key generation. Once enough
+// trustees to decrypt agree on the keys, they are published to the election.
+func (s *Server) ReceiveDKGResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("wrong method")
+	}
+
+	var comingResult struct {
+		Result DKGResult `json:"result"`
+	}
+
+	json.NewDecoder(r.Body).Decode(&comingResult)
+	result := &comingResult.Result
+
+	s.Mux.Lock()
+
+	// a trustee reporting after the election was frozen only adds its proof
+	if frozen, ok := s.elections[result.Name]; ok {
+		t, err := attachPoK(&frozen, result)
+		if err == nil {
+			s.elections[frozen.Name] = frozen
+		}
+		s.Mux.Unlock()
+
+		if err != nil {
+			fmt.Printf("Reject key generation result of trustee %d: %s\n", result.Index, err)
+			return
+		}
+		s.SendTrustee(frozen, t)
+		return
 	}
 
-	privateKeys := make([]PrivateKeyMap, 0)
+	elec, ok := s.pending[result.Name]
+	if !ok {
+		s.Mux.Unlock()
+		return
+	}
 
-	//send PM POST to each trustee with its secret
-	for i, t := range trustees {
+	if err := checkDKGResult(result, &elec); err != nil {
+		s.Mux.Unlock()
+		fmt.Printf("Reject key generation result of trustee %d: %s\n", result.Index, err)
+		return
+	}
 
-		partialKeyCon := PartialKeyContainer{
-			Name:       comingElection.Elec.Name,
-			PartialKey: trusteeSecrets[i],
-			Trust:      trustees[i],
-			Elec:       elecSend,
+	results := s.results[elec.Name]
+	if _, ok := results[result.Index]; !ok {
+		results[result.Index] = result
+	}
+
+	agreeing := 0
+	for _, other := range results {
+		if sameDKGResult(result, other) {
+			agreeing++
 		}
+	}
+	if agreeing < elec.Threshold {
+		s.Mux.Unlock()
+		return
+	}
 
-		fmt.Println("=======")
-		fmt.Println(partialKeyCon)
+	// freeze the election with the generated keys, and the proofs of
+	// knowledge of the trustees that reported them
+	elec.PublicKey = result.PublicKey
+	for i, t := range elec.Trustees {
+		t.PublicKey = elec.PublicKey.WithPublicValue(result.Trustees[i])
+		if other, ok := results[t.Index]; ok && sameDKGResult(result, other) {
+			t.PoK = other.PoK
+		}
+	}
 
-		sendVal = map[string]PartialKeyContainer{"partial": partialKeyCon}
-		jsonVal, _ = json.Marshal(sendVal)
+	elec.FrozenAt = time.Now().UTC().Format(time.RFC3339)
+	if err := elec.ComputeHash(); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("Election %s frozen with hash %s\n", elec.Name, elec.ElectionHash)
 
-		http.Post(t.Address, "application/json", bytes.NewBuffer(jsonVal))
+	delete(s.pending, elec.Name)
+	delete(s.results, elec.Name)
+	s.elections[elec.Name] = elec
+	s.Mux.Unlock()
 
-		privateKeys = append(privateKeys, PrivateKeyMap{
-			Src:        t.Address,
-			PrivateKey: trusteeSecrets[i].String(),
-		})
+	s.PublishElection(elec)
+}
 
+// checkDKGResult checks that a result is for the group of the election and
+// that the reporting trustee knows the share behind its public value.
+func checkDKGResult(result *DKGResult, elec *Election) error {
+	if result.Index < 1 || result.Index > len(elec.Trustees) {
+		return errors.New("invalid trustee index")
 	}
 
+	pk := result.PublicKey
+	if pk == nil || pk.PublicValue == nil || !pk.SameGroup(elec.PublicKey) {
+		return errors.New("wrong group parameters")
+	}
+
+	if len(result.Trustees) != len(elec.Trustees) {
+		return errors.New("wrong number of trustee keys")
+	}
+	for _, y := range result.Trustees {
+		if y == nil {
+			return errors.New("missing trustee key")
+		}
+	}
+
+	reporter := &Trustee{
+		Index:     result.Index,
+		PoK:       result.PoK,
+		PublicKey: elec.PublicKey.WithPublicValue(result.Trustees[result.Index-1]),
+	}
+	return reporter.VerifyPoK()
+}
+
+// attachPoK adds the proof of knowledge of a late trustee to a frozen
+// election, if the trustee agrees with the frozen keys.
+func attachPoK(elec *Election, result *DKGResult) (*Trustee, error) {
+	if err := checkDKGResult(result, elec); err != nil {
+		return nil, err
+	}
+
+	frozen := &DKGResult{PublicKey: elec.PublicKey, Trustees: make([]*big.Int, len(elec.Trustees))}
+	for i, t := range elec.Trustees {
+		frozen.Trustees[i] = t.PublicKey.PublicValue
+	}
+	if !sameDKGResult(result, frozen) {
+		return nil, errors.New("keys differ from the frozen election")
+	}
+
+	if elec.Trustees[result.Index-1].PoK != nil {
+		return nil, errors.New("trustee already proved its key")
+	}
+
+	// copy the records, the frozen election may be read concurrently
+	trustees := make([]*Trustee, len(elec.Trustees))
+	copy(trustees, elec.Trustees)
+	t := *trustees[result.Index-1]
+	t.PoK = result.PoK
+	trustees[result.Index-1] = &t
+	elec.Trustees = trustees
+
+	return &t, nil
+}
+
+func sameDKGResult(a *DKGResult, b *DKGResult) bool {
+	if a.PublicKey.PublicValue.Cmp(b.PublicKey.PublicValue) != 0 || len(a.Trustees) != len(b.Trustees) {
+		return false
+	}
+
+	for i := range a.Trustees {
+		if a.Trustees[i].Cmp(b.Trustees[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// PublishElection sends the public key of a frozen election to the backend
+// and the frozen election to its trustees.
+func (s *Server) PublishElection(elec Election) {
+	pkContainer := PKContainer{
+		Name:      elec.Name,
+		PublicKey: ConvertBigIntToStr(elec.PublicKey),
+	}
+
+	values := map[string]PKContainer{"pkcontainer": pkContainer}
+	jsonValue, _ := json.Marshal(values)
+	resp, err := http.Post("http://127.0.0.1:4000/publickey", "application/json", bytes.NewBuffer(jsonValue))
+	fmt.Print(resp)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// trustees that did not prove their key yet get it once they report
+	for _, t := range elec.Trustees {
+		if t.PoK != nil {
+			s.SendTrustee(elec, t)
+		}
+	}
+
+	// no trustee secret is ever known here
 	elecStruct := ElectionStruct{
-		Elec:        comingElection.Elec.Name,
-		PublicKey:   ConvertBigIntToStr(pk),
-		PrivateKeys: privateKeys,
+		Elec:        elec.Name,
+		PublicKey:   ConvertBigIntToStr(elec.PublicKey),
+		PrivateKeys: make([]PrivateKeyMap, 0),
 	}
 
+	s.Mux.Lock()
 	s.listElection = append(s.listElection, elecStruct)
+	s.Mux.Unlock()
 
 	fmt.Println("+++++")
 	fmt.Println(s.listElection)
+}
+
+// SendTrustee sends a trustee its record in the frozen election.
+func (s *Server) SendTrustee(elec Election, t *Trustee) {
+	partialKeyCon := PartialKeyContainer{
+		Name:  elec.Name,
+		Trust: t,
+		Elec:  elec,
+	}
+
+	fmt.Println("=======")
+	fmt.Println(partialKeyCon)
+
+	sendVal := map[string]PartialKeyContainer{"partial": partialKeyCon}
+	jsonVal, _ := json.Marshal(sendVal)
 
+	http.Post(t.Address+"/partialkey", "application/json", bytes.NewBuffer(jsonVal))
 }
 
 func (s *Server) GetElectionInfo(w http.ResponseWriter, r *http.Request) {
@@ -183,6 +446,65 @@ func (s *Server) GetElectionInfo(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(messages)
 }
 
+// GetFrozenElection returns the public part of a frozen election, so that
+// voters encrypt their ballots against the same election as the trustees.
+func (s *Server) GetFrozenElection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("wrong method")
+	}
+
+	var comingElection struct {
+		Elec string `json:"elec"`
+	}
+
+	json.NewDecoder(r.Body).Decode(&comingElection)
+
+	s.Mux.Lock()
+	elec, ok := s.elections[comingElection.Elec]
+	s.Mux.Unlock()
+
+	var response struct {
+		Elec  Election `json:"elec"`
+		Exist bool     `json:"exist"`
+	}
+
+	if ok {
+		elec.Secret = nil
+		response.Elec = elec
+	}
+	response.Exist = ok
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetRollProof returns the proof that a voter is on the roll of an election,
+// which the voter attaches to its ballots.
+func (s *Server) GetRollProof(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("wrong method")
+	}
+
+	var request struct {
+		Elec  string `json:"elec"`
+		Voter string `json:"voter"`
+	}
+
+	json.NewDecoder(r.Body).Decode(&request)
+
+	var response struct {
+		Proof *RollProof `json:"proof"`
+		Exist bool       `json:"exist"`
+	}
+
+	s.Mux.Lock()
+	if roll, ok := s.rolls[request.Elec]; ok {
+		response.Proof, response.Exist = roll.Prove(request.Voter)
+	}
+	s.Mux.Unlock()
+
+	json.NewEncoder(w).Encode(response)
+}
+
 func (s *Server) AckPost(key Key, w http.ResponseWriter) {
 	var response struct {
 		PublicKey Key `json:"publickey"`
@@ -195,10 +517,13 @@ func (s *Server) ListenToGui() {
 	r := mux.NewRouter()
 	r.HandleFunc("/election", s.ReceiveElection).Methods("POST")
 	r.HandleFunc("/getElection", s.GetElectionInfo).Methods("GET")
+	r.HandleFunc("/frozenelection", s.GetFrozenElection).Methods("POST")
+	r.HandleFunc("/roll", s.GetRollProof).Methods("POST")
+	r.HandleFunc("/dkgresult", s.ReceiveDKGResult).Methods("POST")
 	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("./web/indserver/dist/"))))
 	srv := &http.Server{
 		Handler:           r,
-		Addr:              "127.0.0.1:8081",
+		Addr:              IND_SERVER,
 		WriteTimeout:      15 * time.Second,
 		ReadHeaderTimeout: 15 * time.Second,
 	}
@@ -241,6 +566,11 @@ func main() {
 	listElection := make([]ElectionStruct, 0)
 	s := &Server{
 		listElection: listElection,
+		elections:    make(map[string]Election),
+		pending:      make(map[string]Election),
+		results:      make(map[string]map[int]*DKGResult),
+		rolls:        make(map[string]*message.VoterRoll),
+		Mux:          &sync.Mutex{},
 	}
 
 	s.SendAuth()
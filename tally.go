@@ -3,10 +3,14 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -19,12 +23,104 @@ type TallyContainer struct {
 	Vote    []*message.CastBallot `json:"vote"`
 	Src     string                `json:"src"`
 	Elec    message.Election      `json:"elec"`
+
+	// Digest is the hash of Vote, set by the tallier.
+	Digest string `json:"-"`
 }
 
 type Tally struct {
 	Record map[string](map[string]TallyContainer)
 	Mux    *sync.Mutex
 	Res    map[string]message.Result
+	Boards map[string]*MixBoard
+	Mixed  map[string]message.MixedResult
+
+	// Frozen is the election of each tally, as the independent server froze it
+	Frozen map[string]*message.Election
+
+	// Ballots is the weight of the ballots counted in each tally
+	Ballots map[string]int64
+}
+
+// A MixBoard is where the trustees publish their mixes of the ballots of an
+// election, in turn, and then their decryption factors for the output of the
+// last mix. Anyone can fetch it and check every shuffle proof.
+type MixBoard struct {
+	Input [][]*message.Ciphertext `json:"input"`
+	Mixes []*message.Mix          `json:"mixes"`
+
+	// Closed is set by the first decryption, after which no mix is added.
+	Closed bool `json:"closed"`
+
+	Elec        message.Election            `json:"-"`
+	Decryptions map[string]*message.Trustee `json:"-"`
+}
+
+// Output returns the output of the last mix.
+func (b *MixBoard) Output() [][]*message.Ciphertext {
+	if len(b.Mixes) == 0 {
+		return b.Input
+	}
+	return b.Mixes[len(b.Mixes)-1].Output
+}
+
+// FrozenElectionAddress is where the independent server publishes the
+// elections it froze.
+const FrozenElectionAddress = "http://127.0.0.1:8081/frozenelection"
+
+// GetFrozenElection asks the independent server for the election with the
+// given name, so that the tally is checked against the election the trustees
+// were set up for rather than the one they post.
+func (t *Tally) GetFrozenElection(name string) (*message.Election, error) {
+	t.Mux.Lock()
+	elec, ok := t.Frozen[name]
+	t.Mux.Unlock()
+	if ok {
+		return elec, nil
+	}
+
+	values := map[string]string{"elec": name}
+	jsonValue, _ := json.Marshal(values)
+	resp, err := http.Post(FrozenElectionAddress, "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var frozen struct {
+		Elec  message.Election `json:"elec"`
+		Exist bool             `json:"exist"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&frozen); err != nil {
+		return nil, err
+	}
+
+	if !frozen.Exist {
+		return nil, fmt.Errorf("election %s has not been frozen", name)
+	}
+
+	if err := frozen.Elec.ComputeHash(); err != nil {
+		return nil, err
+	}
+
+	t.Mux.Lock()
+	t.Frozen[name] = &frozen.Elec
+	t.Mux.Unlock()
+
+	return &frozen.Elec, nil
+}
+
+// votesDigest is the hash of the ballots a trustee tallied, in order, so
+// that the tallies of trustees tallying the same ballots can be matched.
+func votesDigest(votes []*message.CastBallot) (string, error) {
+	js, err := json.Marshal(votes)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(js)
+	return base64.RawStdEncoding.EncodeToString(h[:]), nil
 }
 
 func (t *Tally) ReceiveTally(w http.ResponseWriter, r *http.Request) {
@@ -43,47 +139,101 @@ func (t *Tally) ReceiveTally(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Println(tallyObj.Tally)
 
-	t.Mux.Lock()
+	// the trustees must tally the election the independent server froze,
+	// whatever they post
+	elec, err := t.GetFrozenElection(tallyObj.Tally.Elec.Name)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	src := tallyObj.Tally.Src
+	if hash, err := tallyObj.Tally.Elec.Hash(); err != nil || hash != elec.ElectionHash {
+		fmt.Println("the tally is not for the frozen election")
+		return
+	}
 
-	fmt.Println(tallyObj.Tally.Trustee)
+	// the result is computed as the questions ask
+	if err := elec.ValidateQuestions(); err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	// elecName := tallyObj.Tally.Elec.Uuid
+	trustee := tallyObj.Tally.Trustee
+	if trustee == nil {
+		fmt.Println("missing trustee")
+		return
+	}
+	if err := elec.CheckTrusteeKey(trustee); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println(trustee)
+
+	digest, err := votesDigest(tallyObj.Tally.Vote)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	vote := tallyObj.Tally.Vote
+	tallyObj.Tally.Elec = *elec
+	tallyObj.Tally.Digest = digest
 
-	elec := tallyObj.Tally.Elec
+	t.Mux.Lock()
+	defer t.Mux.Unlock()
 
-	// put it in
+	// put it in, by trustee as the source is not authenticated
 	_, ok := t.Record[elec.Name]
 
 	if !ok {
 		t.Record[elec.Name] = make(map[string]TallyContainer)
 	}
 
-	t.Record[elec.Name][src] = tallyObj.Tally
+	t.Record[elec.Name][strconv.Itoa(trustee.Index)] = tallyObj.Tally
+
+	// the ballots are tallied once enough trustees tallied the same ones
+	_, done := t.Res[elec.Name]
+	if done {
+		return
+	}
 
 	trustees := make([]*message.Trustee, 0)
-	// check whether there are all
-	if len(t.Record[elec.Name]) == 3 {
-		for _, tallyo := range t.Record[elec.Name] {
+	var vote []*message.CastBallot
+	for _, tallyo := range t.Record[elec.Name] {
+		if tallyo.Digest == digest {
 			trustees = append(trustees, tallyo.Trustee)
+			vote = tallyo.Vote
 		}
-		res, err := elec.Tallier(vote, trustees)
+	}
 
-		if err != nil {
-			fmt.Println(err)
+	if len(trustees) < elec.ComputeThreshold() {
+		// wait for more trustees
+		return
+	}
+
+	// the trustees check the ballots to mix against their blockchains
+	// before mixing them
+	if _, ok := t.Boards[elec.Name]; !ok && elec.HasMixnet() {
+		t.Boards[elec.Name] = &MixBoard{
+			Input:       elec.MixInput(vote),
+			Mixes:       make([]*message.Mix, 0),
+			Elec:        *elec,
+			Decryptions: make(map[string]*message.Trustee),
 		}
+	}
 
+	res, ballots, err := elec.Tallier(vote, trustees)
+
+	if err != nil {
+		// wait for more trustees
+		fmt.Println(err)
+	} else {
 		// put the result into the container
 		t.Res[elec.Name] = res
-
-		fmt.Println(t.Res)
+		t.Ballots[elec.Name] = ballots
 	}
 
-	t.Mux.Unlock()
-
+	fmt.Println(t.Res)
 }
 
 func (t *Tally) GetElectionResult(w http.ResponseWriter, r *http.Request) {
@@ -100,18 +250,48 @@ func (t *Tally) GetElectionResult(w http.ResponseWriter, r *http.Request) {
 
 	elecName := comingElection.Elec
 
+	t.Mux.Lock()
+	defer t.Mux.Unlock()
+
 	res, ok := t.Res[elecName]
 
 	fmt.Println(elecName)
 
 	var ResultToSend struct {
-		Res   message.Result `json:"res"`
-		Exist bool           `json:"exist"`
+		Res   message.Result      `json:"res"`
+		Mixed message.MixedResult `json:"mixed,omitempty"`
+
+		// Summary is the outcome of each question: percentages for
+		// the relative ones, winners for the absolute ones
+		Summary []*message.QuestionResult `json:"summary,omitempty"`
+		Exist   bool                      `json:"exist"`
+	}
+
+	// an election with mixnet questions also waits for its mixed ballots
+	if board, mixnet := t.Boards[elecName]; ok && mixnet {
+		mixed, decrypted := t.Mixed[elecName]
+		if decrypted {
+			res = append(message.Result{}, res...)
+			if err := board.Elec.MergeMixed(res, mixed); err != nil {
+				fmt.Println(err)
+			}
+			ResultToSend.Mixed = mixed
+		}
+		ok = decrypted
 	}
 
 	if ok {
 		ResultToSend.Exist = ok
 		ResultToSend.Res = res
+
+		for _, tallyo := range t.Record[elecName] {
+			summary, err := tallyo.Elec.Summarize(res, ResultToSend.Mixed, t.Ballots[elecName])
+			if err != nil {
+				fmt.Println(err)
+			}
+			ResultToSend.Summary = summary
+			break
+		}
 	} else {
 		ResultToSend.Exist = ok
 	}
@@ -121,6 +301,131 @@ func (t *Tally) GetElectionResult(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(ResultToSend)
 }
 
+// GetMixBoard publishes the board of an election.
+func (t *Tally) GetMixBoard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("Wrong Method")
+	}
+
+	var comingElection struct {
+		Elec string `json:"elec"`
+	}
+
+	json.NewDecoder(r.Body).Decode(&comingElection)
+
+	t.Mux.Lock()
+	defer t.Mux.Unlock()
+
+	var response struct {
+		Exist bool      `json:"exist"`
+		Board *MixBoard `json:"board"`
+	}
+	response.Board, response.Exist = t.Boards[comingElection.Elec]
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// ReceiveMix adds the mix of a trustee to the board, if it shuffles the
+// output of the last mix and the trustee hasn't mixed yet.
+func (t *Tally) ReceiveMix(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("Wrong Method")
+	}
+
+	var mixObj struct {
+		Elec string       `json:"elec"`
+		Mix  *message.Mix `json:"mix"`
+	}
+
+	json.NewDecoder(r.Body).Decode(&mixObj)
+
+	t.Mux.Lock()
+	defer t.Mux.Unlock()
+
+	board, ok := t.Boards[mixObj.Elec]
+	if !ok || board.Closed || mixObj.Mix == nil {
+		t.AckPost(false, w)
+		return
+	}
+
+	for _, mix := range board.Mixes {
+		if mix.Index == mixObj.Mix.Index {
+			t.AckPost(false, w)
+			return
+		}
+	}
+
+	if _, err := board.Elec.VerifyMixes(board.Output(), []*message.Mix{mixObj.Mix}); err != nil {
+		fmt.Println(err)
+		t.AckPost(false, w)
+		return
+	}
+
+	board.Mixes = append(board.Mixes, mixObj.Mix)
+	fmt.Printf("Mix %d of %s by trustee %d\n", len(board.Mixes), mixObj.Elec, mixObj.Mix.Index)
+	t.AckPost(true, w)
+}
+
+// ReceiveMixDecryption collects the decryption factors of a trustee for the
+// output of the last mix, and decrypts the mixed ballots once enough
+// trustees sent valid factors.
+func (t *Tally) ReceiveMixDecryption(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("Wrong Method")
+	}
+
+	var decryptionObj struct {
+		Elec    string           `json:"elec"`
+		Src     string           `json:"src"`
+		Round   int              `json:"round"`
+		Trustee *message.Trustee `json:"trustee"`
+	}
+
+	json.NewDecoder(r.Body).Decode(&decryptionObj)
+
+	t.Mux.Lock()
+	defer t.Mux.Unlock()
+
+	// the factors must be for the output of the last mix
+	board, ok := t.Boards[decryptionObj.Elec]
+	if !ok || decryptionObj.Round != len(board.Mixes) || decryptionObj.Trustee == nil {
+		t.AckPost(false, w)
+		return
+	}
+
+	// a bogus decryption must not close the board
+	trustee := decryptionObj.Trustee
+	err := board.Elec.CheckTrusteeKey(trustee)
+	if err == nil {
+		err = trustee.VerifyDecryptionFactors(board.Output())
+	}
+	if err != nil {
+		fmt.Println(err)
+		t.AckPost(false, w)
+		return
+	}
+
+	board.Closed = true
+	board.Decryptions[decryptionObj.Src] = trustee
+
+	if _, done := t.Mixed[decryptionObj.Elec]; !done && len(board.Decryptions) >= board.Elec.ComputeThreshold() {
+		trustees := make([]*message.Trustee, 0, len(board.Decryptions))
+		for _, trustee := range board.Decryptions {
+			trustees = append(trustees, trustee)
+		}
+
+		mixed, err := board.Elec.DecryptMixed(board.Output(), trustees)
+		if err != nil {
+			// wait for more trustees
+			fmt.Println(err)
+		} else {
+			t.Mixed[decryptionObj.Elec] = mixed
+		}
+	}
+
+	t.AckPost(true, w)
+}
+
 func (t *Tally) AckPost(success bool, w http.ResponseWriter) {
 	var response struct {
 		Success bool `json:"success"`
@@ -133,6 +438,9 @@ func (t *Tally) ListenToGui() {
 	r := mux.NewRouter()
 	r.HandleFunc("/tally", t.ReceiveTally).Methods("POST")
 	r.HandleFunc("/getresult", t.GetElectionResult).Methods("POST")
+	r.HandleFunc("/mixes", t.GetMixBoard).Methods("POST")
+	r.HandleFunc("/mix", t.ReceiveMix).Methods("POST")
+	r.HandleFunc("/mixdecrypt", t.ReceiveMixDecryption).Methods("POST")
 	// r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("./web/frontend/dist/"))))
 	srv := &http.Server{
 		Handler:           r,
@@ -147,9 +455,13 @@ func main() {
 	res := make(map[string]message.Result)
 
 	t := Tally{
-		Record: make(map[string](map[string]TallyContainer)),
-		Mux:    &sync.Mutex{},
-		Res:    res,
+		Record:  make(map[string](map[string]TallyContainer)),
+		Mux:     &sync.Mutex{},
+		Res:     res,
+		Boards:  make(map[string]*MixBoard),
+		Mixed:   make(map[string]message.MixedResult),
+		Frozen:  make(map[string]*message.Election),
+		Ballots: make(map[string]int64),
 	}
 
 	t.ListenToGui()
@@ -4,124 +4,151 @@ package voter
 
 import (
 	"crypto/dsa"
+	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/big"
 	m "math/rand"
+	"sync"
 	"time"
+
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
 	// "github.com/golang/glog"
 )
 
 type Voter struct {
 	Port string
+
+	// ballots encrypted but neither cast nor audited yet, by tracker
+	Prepared    map[string]*PreparedBallot
+	PreparedMux sync.Mutex
+
+	// signing keys of the voters, by uuid
+	Keys    map[string]ed25519.PrivateKey
+	KeysMux sync.Mutex
+}
+
+// RegisterVoter gets the entry on the roll of the voter with the given uuid,
+// with the public key of the voter. A signing key is generated for a voter
+// the first time it is registered.
+func (v *Voter) RegisterVoter(uuid string) (*RollEntry, error) {
+	v.KeysMux.Lock()
+	defer v.KeysMux.Unlock()
+
+	key, ok := v.Keys[uuid]
+	if !ok {
+		var err error
+		if key, _, err = message.NewSigningKey(); err != nil {
+			return nil, err
+		}
+		v.Keys[uuid] = key
+	}
+
+	return &RollEntry{
+		Uuid:      uuid,
+		PublicKey: hex.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}, nil
 }
 
-// NewKeyFromParams uses a given set of parameters to generate a public key.
-func NewKeyFromParams(g *big.Int, p *big.Int, q *big.Int) (*Key, *big.Int, error) {
-	secret, err := rand.Int(rand.Reader, q)
+// SignBallot signs a ballot with the key of its voter.
+func (v *Voter) SignBallot(vote *CastBallot) error {
+	v.KeysMux.Lock()
+	key, ok := v.Keys[vote.VoterUuid]
+	v.KeysMux.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no signing key for voter %s", vote.VoterUuid)
+	}
+
+	vote.Sign(key)
+	return nil
+}
+
+// NewKeyFromParams uses a given set of parameters, such as those of a named
+// group, to generate a public key. The parameters are validated first.
+func NewKeyFromParams(params *Key) (*Key, *big.Int, error) {
+	if err := params.ValidateGroup(); err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := rand.Int(rand.Reader, params.ExponentPrime)
 	if err != nil {
 		// glog.Error("Couldn't generate a secret for the key")
 		return nil, nil, err
 	}
 
-	return &Key{g, p, q, new(big.Int).Exp(g, secret, p)}, secret, nil
-
+	return params.WithPublicValue(params.Group().Exp(params.Generator, secret)), secret, nil
 }
 
-// NewKey generates a fresh set of parameters and a public/private key pair in
-// those parameters.
-func NewKey() (*Key, *big.Int, error) {
-	// Use the DSA crypto code to generate a key pair. For testing
+// NewParameters generates a fresh set of parameters for an ElGamal group,
+// without any key pair: the PublicValue of the returned Key is nil.
+func NewParameters() (*Key, error) {
+	// Use the DSA crypto code to generate the group. For testing
 	// purposes, we'll use (2048,224) instead of (2048,160) as used by the
 	// current Helios implementation
 	params := new(dsa.Parameters)
 	if err := dsa.GenerateParameters(params, rand.Reader, dsa.L2048N224); err != nil {
 		// glog.Error("Couldn't generate DSA parameters for the ElGamal group")
-		return nil, nil, err
+		return nil, err
 	}
 
-	return NewKeyFromParams(params.G, params.P, params.Q)
+	return &Key{Generator: params.G, Prime: params.P, ExponentPrime: params.Q, GroupName: message.GroupModP}, nil
 }
 
-// MulCiphertexts multiplies an ElGamal Ciphertext value element-wise into an
-// existing Ciphertext. This has the effect of adding the value encrypted in the
-// other Ciphertext to the prod Ciphertext. The prime specifies the group in
-// which these multiplication operations are to be performed.
-func (prod *Ciphertext) MulCiphertexts(other *Ciphertext, prime *big.Int) *Ciphertext {
-	prod.Alpha.Mul(prod.Alpha, other.Alpha)
-	prod.Alpha.Mod(prod.Alpha, prime)
-	prod.Beta.Mul(prod.Beta, other.Beta)
-	prod.Beta.Mod(prod.Beta, prime)
-	return prod
-}
-
-// Encrypt encrypts the selection for an answer: either this value is
-// selected or not. It also generates a DisjunctiveZKProof to show that
-// the value is either selected or not. It returns the randomness it
-// generated; this is useful for computing the OverallProof for a Question.
-func Encrypt(selected bool, pk *Key) (*Ciphertext, *big.Int) {
-	// If this value is selected, then use g^1; otherwise, use g^0.
-	var plaintext *big.Int
-	//var realExp, fakeExp int64
-	if selected {
-		plaintext = pk.Generator
-		//realExp = 1
-		//fakeExp = 0
-	} else {
-		plaintext = big.NewInt(1)
-		//realExp = 0
-		//fakeExp = 1
+// NewGroupParameters returns the parameters of the named group, without any
+// key pair. For GroupModP, parameters are generated afresh.
+func NewGroupParameters(group string) (*Key, error) {
+	if params, ok := message.NamedGroupParameters(group); ok {
+		return params, nil
 	}
 
-	randomness, err := rand.Int(rand.Reader, pk.ExponentPrime)
-	if err != nil {
-		// glog.Error("Couldn't get randomness for an encryption")
-		return nil, nil
+	switch group {
+	case message.GroupModP, "":
+		return NewParameters()
+	default:
+		return nil, fmt.Errorf("unknown group %q", group)
 	}
+}
 
-	a := new(big.Int).Exp(pk.Generator, randomness, pk.Prime)
-	b := new(big.Int).Exp(pk.PublicValue, randomness, pk.Prime)
-	b.Mul(b, plaintext)
-	b.Mod(b, pk.Prime)
-	c := &Ciphertext{a, b}
-
-	//// Real proof of selected and a simulated proof of !selected
-	//var proof DisjunctiveZKProof
-	//proof = make([]*ZKProof, 2)
-	//
-	//if err = proof.CreateFakeProof(fakeExp, fakeExp, c, pk); err != nil {
-	//	glog.Error("Couldn't create a simulated proof")
-	//	return nil, nil, nil, err
-	//}
-	//
-	//if err = proof.CreateRealProof(realExp, c, randomness, pk); err != nil {
-	//	glog.Error("Couldn't create a real proof")
-	//	return nil, nil, nil, err
-	//}
-
-	return c, randomness
+// NewKey generates a public/private key pair in the default Helios group.
+func NewKey() (*Key, *big.Int, error) {
+	params, _ := message.NamedGroupParameters(message.GroupHelios)
+	return NewKeyFromParams(params)
 }
 
 // Create instantiates a question with the given answer set and other information.
-func NewQuestion(answers []string, max int, min int, question string, resultType string, shortName string) (*Question, error) {
-	if max < 0 || min < 0 || min > max {
-		return nil, errors.New("invalid question min and max")
-	}
-
-	if resultType != "absolute" && resultType != "relative" {
-		return nil, errors.New("invalid result type")
+// Approval and score questions are tallied homomorphically, while ranked and
+// write-in questions are mixed; use SetSeats to elect more than one answer of
+// a ranked question, and SetMaxScore to change the highest score of a score
+// question.
+func NewQuestion(answers []string, choiceType string, max int, min int, question string, resultType string, shortName string) (*Question, error) {
+	tallyType := message.TallyMixnet
+	if choiceType == message.ChoiceApproval || choiceType == message.ChoiceScore {
+		tallyType = message.TallyHomomorphic
 	}
 
 	ansURLs := make([]string, len(answers))
 	ans := make([]string, len(answers))
 	copy(ans, answers)
 
-	// The only possible choice type is "approval", and the only possible
-	// tally type is "homomorphic".
-	return &Question{ansURLs, ans, "approval", max, min, question, resultType, shortName, "homomorphic"}, nil
+	q := &Question{
+		AnswerUrls: ansURLs,
+		Answers:    ans,
+		ChoiceType: choiceType,
+		Max:        max,
+		Min:        min,
+		Question:   question,
+		ResultType: resultType,
+		ShortName:  shortName,
+		TallyType:  tallyType,
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
 }
 
 // NewBallot takes an Election and a set of responses as input and fills in a Ballot
@@ -131,74 +158,94 @@ func NewBallot(election *Election, answers [][]int64) (*Ballot, error) {
 	}
 
 	pk := election.PublicKey
+	if err := pk.ValidateGroup(); err != nil {
+		return nil, err
+	}
+	g := pk.Group()
 
-	//vote.ElectionHash = election.ElectionHash
-	//vote.ElectionUuid = election.Uuid
+	// bind the ballot to the election it is encrypted for
+	hash, err := election.Hash()
+	if err != nil {
+		return nil, err
+	}
 
 	ans := make([]*EncryptedAnswer, len(election.Questions))
 
 	for i, q := range election.Questions {
+		if q.IsMixnet() {
+			if ans[i], err = message.EncryptMixed(q, answers[i], pk); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if q.ChoiceType == message.ChoiceScore {
+			if ans[i], err = message.EncryptScores(q, answers[i], pk); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		a := answers[i]
 		results := make([]bool, len(q.Answers))
-		//sum := int64(len(a))
+		sum := int64(len(a))
 
-		//min := q.Min
-		//max := q.ComputeMax()
-		//if sum < int64(min) || sum > int64(max) {
-		//	glog.Errorf("Sum was %d, min was %d, and max was %d\n", sum, min, max)
-		//	return nil, errors.New("invalid answers: sum must lie between min and max")
-		//}
+		min := q.Min
+		max := q.ComputeMax()
+		if sum < int64(min) || sum > int64(max) {
+			return nil, fmt.Errorf("invalid answers: %d selections, must lie between min %d and max %d", sum, min, max)
+		}
 
 		ch := make([]*Ciphertext, len(results))
-		//ip := make([]DisjunctiveZKProof, len(results))
+		ip := make([]DisjunctiveZKProof, len(results))
 		rs := make([]*big.Int, len(results))
 		as := make([]int64, len(a))
 		copy(as, a)
 
 		// Mark each selected value as being voted for.
 		for _, index := range a {
+			if index < 0 || index >= int64(len(results)) || results[index] {
+				return nil, errors.New("invalid answers: each selection must be a distinct answer")
+			}
 			results[index] = true
 		}
 
 		// Encrypt and create proofs for the answers, then create an overall proof if required
-		tally := &Ciphertext{big.NewInt(1), big.NewInt(1)}
+		tally := &Ciphertext{Alpha: g.Identity(), Beta: g.Identity()}
 		randTally := big.NewInt(0)
 		for j := range q.Answers {
 			var err error
-			if ch[j], rs[j] = Encrypt(results[j], pk); err != nil {
+			if ch[j], ip[j], rs[j], err = message.Encrypt(results[j], pk); err != nil {
 				// glog.Errorf("Couldn't encrypt choice %d for question %d\n", j, i)
 				return nil, err
 			}
 
-			tally.MulCiphertexts(ch[j], pk.Prime)
+			tally.MulCiphertexts(ch[j], g)
 			randTally.Add(randTally, rs[j])
 			randTally.Mod(randTally, pk.ExponentPrime)
 		}
 
-		//var op DisjunctiveZKProof
-		//if q.Max != 0 {
-		//	op = make([]*ZKProof, q.Max-q.Min+1)
-		//	for j := q.Min; j <= q.Max; j++ {
-		//		if int64(j) != sum {
-		//			// Create a simulated proof for the case where the
-		//			// tally actually encrypts the value j.
-		//			if err := op.CreateFakeProof(int64(j-q.Min), int64(j), tally, pk); err != nil {
-		//				glog.Errorf("Couldn't create fake proof %d\n", j)
-		//				return nil, err
-		//			}
-		//		}
-		//	}
-		//
-		//	if err := op.CreateRealProof(sum-int64(q.Min), tally, randTally, pk); err != nil {
-		//		glog.Errorf("Couldn't create the real proof")
-		//		return nil, err
-		//	}
-		//}
-
-		ans[i] = &EncryptedAnswer{ch, as, rs}
+		// The overall proof shows that the product of the choices
+		// encrypts a value between min and max.
+		op := make(DisjunctiveZKProof, max-min+1)
+		for j := min; j <= max; j++ {
+			if int64(j) != sum {
+				// Create a simulated proof for the case where the
+				// tally actually encrypts the value j.
+				if err := op.CreateFakeProof(int64(j-min), int64(j), tally, pk); err != nil {
+					return nil, fmt.Errorf("couldn't create fake proof %d: %s", j, err)
+				}
+			}
+		}
+
+		if err := op.CreateRealProof(sum-int64(min), tally, randTally, pk); err != nil {
+			return nil, fmt.Errorf("couldn't create the real proof: %s", err)
+		}
+
+		ans[i] = &EncryptedAnswer{Choices: ch, IndividualProofs: ip, OverallProof: op, Answer: as, Randomness: rs}
 	}
 
-	return &Ballot{ans, election.ElectionHash, election.Uuid}, nil
+	return &Ballot{Answers: ans, ElectionHash: hash, ElectionUuid: election.Uuid}, nil
 }
 
 // GenUUID creates RFC 4122-compliant UUIDs.
@@ -237,7 +284,7 @@ func NewElection(url string, desc string, frozenAt string, name string,
 	// 	}
 	// } else {
 	// 	// Take the public params from k to generate the key.
-	// 	if pk, secret, err = NewKeyFromParams(k.Generator, k.Prime, k.ExponentPrime); err != nil {
+	// 	if pk, secret, err = NewKeyFromParams(k); err != nil {
 	// 		// glog.Error("Couldn't generate a new key for the election")
 	// 		return nil, nil, err
 	// 	}
@@ -260,201 +307,64 @@ func NewElection(url string, desc string, frozenAt string, name string,
 	}
 
 	// Compute the JSON of the election and compute its hash
-	//json, err := MarshalJSON(e)
-	//if err != nil {
-	//	glog.Error("Couldn't marshal the election as JSON")
-	//	return nil, nil, err
-	//}
-	//
-	//h := sha256.Sum256(json)
-	//encodedHash := base64.StdEncoding.EncodeToString(h[:])
-	//e.ElectionHash = encodedHash[:len(encodedHash)-1]
-	//e.JSON = json
+	if err := e.ComputeHash(); err != nil {
+		// glog.Error("Couldn't marshal the election as JSON")
+		return nil, nil, err
+	}
 	return e, nil, nil
 	// return e, secret, nil
 }
 
-// SplitKey performs an (n,n)-secret sharing of privateKey over addition mod
-// publicKey.ExponentPrime.
-func SplitKey(privateKey *big.Int, publicKey *Key, n int) ([]*Trustee, []*big.Int, error) {
-	// Choose n-1 random private keys and compute the nth as privateKey -
-	// (key_1 + key_2 + ... + key_{n-1}). This computation must be
-	// performed in the exponent group of g, which is
-	// Z_{Key.ExponentPrime}.
-	trustees := make([]*Trustee, n)
-	keys := make([]*big.Int, n)
-	sum := big.NewInt(0)
+// SplitKey performs a (t,n)-Shamir secret sharing of privateKey in
+// Z_{publicKey.ExponentPrime}: any t of the n trustees can decrypt together,
+// and fewer than t learn nothing about the key. Trustee i gets the share f(i)
+// of a random polynomial f of degree t-1 with f(0) = privateKey. The
+// threshold t must be at least MinThreshold(n), see package message.
+func SplitKey(privateKey *big.Int, publicKey *Key, t int, n int) ([]*Trustee, []*big.Int, error) {
+	if t < message.MinThreshold(n) || t > n {
+		return nil, nil, errors.New("invalid threshold")
+	}
+
+	// coefficients[0] is the secret itself.
+	coefficients := make([]*big.Int, t)
+	coefficients[0] = new(big.Int).Mod(privateKey, publicKey.ExponentPrime)
 	var err error
-	for i := 0; i < n-1; i++ {
-		keys[i], err = rand.Int(rand.Reader, publicKey.ExponentPrime)
+	for k := 1; k < t; k++ {
+		coefficients[k], err = rand.Int(rand.Reader, publicKey.ExponentPrime)
 		if err != nil {
 			return nil, nil, err
 		}
+	}
 
+	trustees := make([]*Trustee, n)
+	keys := make([]*big.Int, n)
+	for i := 0; i < n; i++ {
+		// Shares are evaluated at 1..n, since f(0) is the secret.
+		keys[i] = EvalPolynomial(coefficients, int64(i+1), publicKey.ExponentPrime)
+		pok, err := message.NewSchnorrProof(keys[i], publicKey)
 		if err != nil {
 			return nil, nil, err
 		}
 
-		tpk := &Key{
-			Generator:     new(big.Int).Set(publicKey.Generator),
-			Prime:         new(big.Int).Set(publicKey.Prime),
-			ExponentPrime: new(big.Int).Set(publicKey.ExponentPrime),
-			PublicValue:   new(big.Int).Exp(publicKey.Generator, keys[i], publicKey.Prime),
-		}
-
-		trustees[i] = &Trustee{PublicKey: tpk}
-		sum.Add(sum, keys[i])
-		sum.Mod(sum, publicKey.ExponentPrime)
-	}
-
-	// The choice of random private keys in the loop fully determines the
-	// final key.
-	keys[n-1] = new(big.Int).Sub(privateKey, sum)
-	keys[n-1].Mod(keys[n-1], publicKey.ExponentPrime)
-	//npok, err := NewSchnorrProof(keys[n-1], publicKey)
-	if err != nil {
-		return nil, nil, err
-	}
+		tpk := publicKey.WithPublicValue(publicKey.Group().Exp(publicKey.Generator, keys[i]))
 
-	ntpk := &Key{
-		Generator:     new(big.Int).Set(publicKey.Generator),
-		Prime:         new(big.Int).Set(publicKey.Prime),
-		ExponentPrime: new(big.Int).Set(publicKey.ExponentPrime),
-		PublicValue:   new(big.Int).Exp(publicKey.Generator, keys[n-1], publicKey.Prime),
+		trustees[i] = &Trustee{PublicKey: tpk, PoK: pok, Index: i + 1}
 	}
 
-	//trustees[n-1] = &Trustee{PoK: npok, PublicKey: ntpk}
-	trustees[n-1] = &Trustee{PublicKey: ntpk}
-
 	return trustees, keys, nil
 }
 
-// AccumulateTallies combines the ballots homomorphically for each question and answer
-// to get an encrypted tally for each. It also compute the ballot tracking numbers for
-// each of the votes.
-func (election *Election) AccumulateTallies(votes []*CastBallot) ([][]*Ciphertext, []string) {
-	// Initialize the tally structures for homomorphic accumulation.
-
-	tallies := make([][]*Ciphertext, len(election.Questions))
-	fingerprints := make([]string, len(votes))
-	for i := range tallies {
-		tallies[i] = make([]*Ciphertext, len(election.Questions[i].Answers))
-		for j := range tallies[i] {
-			// Each tally must start at 1 for the multiplicative
-			// homomorphism to work.
-			tallies[i][j] = &Ciphertext{big.NewInt(1), big.NewInt(1)}
-		}
-	}
-
-	// Verify the votes and accumulate the tallies.
-	//resp := make(chan bool)
-	for i := range votes {
-		// Shadow i as a new variable for the goroutine.
-		i := i
-		//go func(c chan bool) {
-		//	glog.Infof("Verifying vote from %s\n", votes[i].VoterUuid)
-		//	c <- votes[i].Vote.Verify(election)
-		//	return
-		//}(resp)
-
-		h := sha256.Sum256(votes[i].JSON)
-		encodedHash := base64.StdEncoding.EncodeToString(h[:])
-		fingerprint := encodedHash[:len(encodedHash)-1]
-		fingerprints = append(fingerprints, fingerprint)
-
-		for j, q := range election.Questions {
-			for k := range q.Answers {
-				// tally_j_k = (tally_j_k * ballot_i_j_k) mod p
-				tallies[j][k].MulCiphertexts(votes[i].Vote.Answers[j].Choices[k], election.PublicKey.Prime)
-			}
-		}
+// EvalPolynomial computes f(x) mod q using Horner's rule, where
+// coefficients[k] is the coefficient of x^k.
+func EvalPolynomial(coefficients []*big.Int, x int64, q *big.Int) *big.Int {
+	bx := big.NewInt(x)
+	result := big.NewInt(0)
+	for k := len(coefficients) - 1; k >= 0; k-- {
+		result.Mul(result, bx)
+		result.Add(result, coefficients[k])
+		result.Mod(result, q)
 	}
-
-	// Make sure all the votes passed verification.
-	//for _ = range votes {
-	//	if !<-resp {
-	//		glog.Error("Vote verification failed")
-	//		return nil, nil
-	//	}
-	//}
-
-	return tallies, fingerprints
-}
-
-// A Result is a list of tally lists, one tally list per Question. Each tally
-// list consists of one integer per choice in the Question.
-type Result [][]int64
-
-// Tally computes the tally of an election and returns the result.
-// In the process, it generates partial decryption proofs for each of
-// the partial decryptions computed by the trustee.
-func (e *Election) Tally(votes []*CastBallot, trustees []*Trustee, trusteeSecrets []*big.Int) (Result, error) {
-	tallies, _ := e.AccumulateTallies(votes)
-	// TODO(tmroeder): maybe we should just skip votes that don't pass verification?
-	// What does the spec say?
-	//if len(voteFingerprints) == 0 {
-	//	glog.Error("Couldn't tally the votes")
-	//	return nil, errors.New("couldn't tally the votes")
-	//}
-
-	for k, t := range trustees {
-		df := make([][]*big.Int, len(e.Questions))
-		//dp := make([][]*ZKProof, len(e.Questions))
-		for i, q := range e.Questions {
-			df[i] = make([]*big.Int, len(q.Answers))
-			//dp[i] = make([]*ZKProof, len(q.Answers))
-			for j := range q.Answers {
-				df[i][j] = new(big.Int).Exp(tallies[i][j].Alpha, trusteeSecrets[k], t.PublicKey.Prime)
-				//if dp[i][j], err = NewPartialDecryptionProof(tallies[i][j], df[i][j], trusteeSecrets[k], t.PublicKey); err != nil {
-				//	glog.Errorf("Couldn't create a proof for (%d, %d) for trustee %d\n", i, j, k)
-				//	return nil, err
-				//}
-			}
-		}
-
-		t.DecryptionFactors = df
-		//t.DecryptionProofs = dp
-	}
-
-	// For each question and each answer, reassemble the tally and search for its value.
-	// Then put this in the results.
-	maxValue := len(votes)
-	result := make([][]int64, len(e.Questions))
-	for i, q := range e.Questions {
-		result[i] = make([]int64, len(q.Answers))
-		for j := range q.Answers {
-			alpha := big.NewInt(1)
-			for k := range trustees {
-				alpha.Mul(alpha, trustees[k].DecryptionFactors[i][j])
-				alpha.Mod(alpha, trustees[k].PublicKey.Prime)
-			}
-
-			beta := new(big.Int).ModInverse(alpha, e.PublicKey.Prime)
-			beta.Mul(beta, tallies[i][j].Beta)
-			beta.Mod(beta, e.PublicKey.Prime)
-
-			// This decrypted value can be anything between g^0 and g^maxValue.
-			// Try all values until we find it.
-			temp := new(big.Int)
-			val := new(big.Int)
-			var v int
-			for v = 0; v <= maxValue; v++ {
-				val.SetInt64(int64(v))
-				temp.Exp(e.PublicKey.Generator, val, e.PublicKey.Prime)
-				if temp.Cmp(beta) == 0 {
-					result[i][j] = int64(v)
-					break
-				}
-			}
-
-			if v > maxValue {
-				// glog.Errorf("Couldn't decrypt value (%d, %d)\n", i, j)
-				return nil, errors.New("couldn't decrypt part of the tally")
-			}
-		}
-	}
-
-	return result, nil
+	return result
 }
 
 // NewCastBallot instantiates a CastBallot for a given set of answers for a Voter.
@@ -466,7 +376,12 @@ func NewCastBallot(election *Election, answers [][]int64) (*CastBallot, error) {
 		return nil, err
 	}
 
-	cb := &CastBallot{nil, "", vote, "", "", ""}
+	cb := &CastBallot{Vote: vote}
+
+	// The tracker lets the voter find the ballot once it is cast.
+	if err := cb.ComputeTracker(); err != nil {
+		return nil, err
+	}
 
 	return cb, nil
 }
@@ -497,8 +412,8 @@ func main() {
 	answers[0] = "yes"
 	answers[1] = "no"
 	answers[2] = "maybe so"
-	q, _ := NewQuestion(answers, 3, 0, "Which is it?", "absolute", "Test Q")
-	q2, _ := NewQuestion(answers, 3, 0, "Which is it?", "absolute", "Test Q")
+	q, _ := NewQuestion(answers, message.ChoiceApproval, 3, 0, "Which is it?", "absolute", "Test Q")
+	q2, _ := NewQuestion(answers, message.ChoiceApproval, 3, 0, "Which is it?", "absolute", "Test Q")
 
 	questions := []*Question{q, q2}
 	election, secret, _ := NewElection("https://example.com", "Fake Election", time.Now().String(),
@@ -510,7 +425,7 @@ func main() {
 	// glog.Infof("There are %d trustees\n", trusteeCount)
 	var trustees []*Trustee
 	var trusteeSecrets []*big.Int
-	trustees, trusteeSecrets, _ = SplitKey(secret, election.PublicKey, trusteeCount)
+	trustees, trusteeSecrets, _ = SplitKey(secret, election.PublicKey, trusteeCount-1, trusteeCount)
 
 	// First, create the encrypted vote.
 
@@ -535,7 +450,10 @@ func main() {
 	vote2, _ := NewCastBallot(election, answers_voter2)
 
 	votes := []*CastBallot{vote1, vote2}
-	results, _ := election.Tally(votes, trustees, trusteeSecrets)
+	for k, t := range trustees {
+		election.Tally(votes, t, trusteeSecrets[k])
+	}
+	results, _, _ := election.Tallier(votes, trustees)
 
 	fmt.Println(results)
 
@@ -0,0 +1,86 @@
+package voter
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
+)
+
+// interpolate computes f(0) from the shares of the trustees at indices.
+func interpolate(shares []*big.Int, indices []int, q *big.Int) *big.Int {
+	secret := big.NewInt(0)
+	for _, index := range indices {
+		lambda := message.LagrangeCoefficient(index, indices, q)
+		secret.Add(secret, new(big.Int).Mul(lambda, shares[index-1]))
+	}
+	return secret.Mod(secret, q)
+}
+
+// subsets lists the subsets of size k of 1..n.
+func subsets(n int, k int) [][]int {
+	if k == 0 {
+		return [][]int{{}}
+	}
+
+	out := make([][]int, 0)
+	for last := k; last <= n; last++ {
+		for _, s := range subsets(last-1, k-1) {
+			out = append(out, append(s, last))
+		}
+	}
+	return out
+}
+
+func TestSplitKey(t *testing.T) {
+	pk, secret, err := NewKeyFromParams(message.NewEd25519Parameters())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := pk.ExponentPrime
+
+	const threshold, n = 3, 5
+	trustees, shares, err := SplitKey(secret, pk, threshold, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trustees) != n || len(shares) != n {
+		t.Fatalf("%d trustees and %d shares for %d", len(trustees), len(shares), n)
+	}
+
+	for i, trustee := range trustees {
+		if trustee.Index != i+1 {
+			t.Fatalf("trustee %d has index %d", i, trustee.Index)
+		}
+		if pk.Group().Exp(pk.Generator, shares[i]).Cmp(trustee.PublicKey.PublicValue) != 0 {
+			t.Fatalf("public key of trustee %d is not the one of its share", trustee.Index)
+		}
+		if err := trustee.VerifyPoK(); err != nil {
+			t.Fatalf("trustee %d: %s", trustee.Index, err)
+		}
+	}
+
+	for _, indices := range subsets(n, threshold) {
+		if got := interpolate(shares, indices, q); got.Cmp(secret) != 0 {
+			t.Fatalf("trustees %v don't recover the key", indices)
+		}
+	}
+	for _, indices := range subsets(n, threshold-1) {
+		if got := interpolate(shares, indices, q); got.Cmp(secret) == 0 {
+			t.Fatalf("trustees %v recover the key below the threshold", indices)
+		}
+	}
+}
+
+func TestSplitKeyThreshold(t *testing.T) {
+	pk, secret, err := NewKeyFromParams(message.NewEd25519Parameters())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct{ t, n int }{{0, 3}, {1, 3}, {2, 4}, {4, 3}, {1, 1}} {
+		if _, _, err := SplitKey(secret, pk, c.t, c.n); err == nil {
+			t.Errorf("%d of %d trustees accepted", c.t, c.n)
+		}
+	}
+}
@@ -5,6 +5,7 @@ package voter
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
@@ -12,6 +13,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/TRUMANCFY/DSEProject/Peerster/message"
 	"github.com/gorilla/mux"
 )
 
@@ -29,11 +31,41 @@ type KeyStr struct {
 
 	// PublicValue is the public-key value y used to encrypt.
 	PublicValue string `json:"y"`
+
+	// Group is the name of the group of the key, see Group.
+	Group string `json:"group"`
 }
 
+// A QAndA is a question as shown to the voter. The fields left out are not
+// checked against the election.
 type QAndA struct {
-	Question string   `json:"question"`
-	Answers  []string `json:"choices"`
+	Question   string   `json:"question"`
+	Answers    []string `json:"choices"`
+	ChoiceType string   `json:"choice_type,omitempty"`
+	ResultType string   `json:"result_type,omitempty"`
+	Min        *int     `json:"min,omitempty"`
+	Max        *int     `json:"max,omitempty"`
+}
+
+// check makes sure the question shown to the voter is the one of the
+// election, so that the answers are encrypted for what the voter read.
+func (qa *QAndA) check(q *Question) error {
+	if qa.Question != q.Question || len(qa.Answers) != len(q.Answers) {
+		return fmt.Errorf("question %q differs from the election", qa.Question)
+	}
+	for j := range qa.Answers {
+		if qa.Answers[j] != q.Answers[j] {
+			return fmt.Errorf("choice %d of question %q differs from the election", j, qa.Question)
+		}
+	}
+
+	if (qa.ChoiceType != "" && qa.ChoiceType != q.ChoiceType) ||
+		(qa.ResultType != "" && qa.ResultType != q.ResultType) ||
+		(qa.Min != nil && *qa.Min != q.Min) || (qa.Max != nil && *qa.Max != q.Max) {
+		return fmt.Errorf("definition of question %q differs from the election", qa.Question)
+	}
+
+	return nil
 }
 
 func (v *Voter) ConvertStrToBigInt(s string) *big.Int {
@@ -46,75 +78,267 @@ func (v *Voter) ConvertStrToBigInt(s string) *big.Int {
 	return n
 }
 
+type voteRequest struct {
+	Voter      int       `json:"voter"`
+	Election   string    `json:"election"`
+	Answers    [][]int64 `json:"answers"`
+	PublicKey  KeyStr    `json:"publickey"`
+	QuesAndAns []QAndA   `json:"qanda"`
+}
+
+// A PreparedBallot is encrypted but neither cast nor audited yet.
+type PreparedBallot struct {
+	Ballot   *CastBallot
+	Election *Election
+}
+
+// PrepareBallot encrypts the answers of a vote request.
+func (v *Voter) PrepareBallot(r *http.Request) (*PreparedBallot, error) {
+	var answers voteRequest
+
+	json.NewDecoder(r.Body).Decode(&answers)
+
+	fmt.Println(answers.Voter, answers.Election)
+
+	// Encrypt against the election frozen by the independent server, so
+	// that the ballot is bound to the same election as the trustees hold.
+	election, err := v.GetFrozenElection(answers.Election)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("=====election=====")
+	fmt.Println(election)
+
+	// the trustees only take ballots while the voting is open
+	if err := election.CheckWindow(time.Now()); err != nil {
+		return nil, err
+	}
+
+	if len(answers.QuesAndAns) > 0 {
+		if len(answers.QuesAndAns) != len(election.Questions) {
+			return nil, errors.New("the questions differ from the election")
+		}
+		for i := range answers.QuesAndAns {
+			if err := answers.QuesAndAns[i].check(election.Questions[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// encode
+	vote, err := NewCastBallot(election, answers.Answers)
+	if err != nil {
+		return nil, err
+	}
+
+	// who vote it. election, vote
+
+	// VoteHash is the tracker set by NewCastBallot
+	vote.VoterUuid = strconv.Itoa(answers.Voter)
+	vote.VoterHash = (&RollEntry{Uuid: vote.VoterUuid}).Hash()
+
+	// the trustees only take ballots of voters on the roll, signed with
+	// the key of their entry
+	if !election.Openreg {
+		if vote.Eligibility, err = v.GetRollProof(answers.Election, vote.VoterUuid); err != nil {
+			return nil, err
+		}
+		vote.VoterHash = vote.Eligibility.Voter.Hash()
+		if err := v.SignBallot(vote); err != nil {
+			return nil, err
+		}
+		if err := election.CheckEligibility(vote); err != nil {
+			return nil, err
+		}
+	}
+
+	return &PreparedBallot{vote, election}, nil
+}
+
+// CollectVote encrypts a vote and casts it at once.
 func (v *Voter) CollectVote(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		panic("Wrong Methods")
 	}
 
-	var answers struct {
-		Voter      int       `json:"voter"`
-		Election   string    `json:"election"`
-		Answers    [][]int64 `json:"answers"`
-		PublicKey  KeyStr    `json:"publickey"`
-		QuesAndAns []QAndA   `json:"qanda"`
+	prepared, err := v.PrepareBallot(r)
+	if err != nil {
+		fmt.Println(err)
+		v.AckPost(false, w)
+		return
 	}
 
-	json.NewDecoder(r.Body).Decode(&answers)
+	v.Cast(prepared, w)
+}
 
-	fmt.Println(answers)
+// EncryptVote encrypts a vote and returns its tracker. The ballot is kept
+// until the voter either casts it or audits it.
+func (v *Voter) EncryptVote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("Wrong Methods")
+	}
 
-	pk := &Key{
-		Generator:     v.ConvertStrToBigInt(answers.PublicKey.Generator),
-		Prime:         v.ConvertStrToBigInt(answers.PublicKey.Prime),
-		ExponentPrime: v.ConvertStrToBigInt(answers.PublicKey.ExponentPrime),
-		PublicValue:   v.ConvertStrToBigInt(answers.PublicKey.PublicValue),
+	prepared, err := v.PrepareBallot(r)
+	if err != nil {
+		fmt.Println(err)
+		v.AckPost(false, w)
+		return
 	}
 
-	// we need to get the election with the corresponding name
+	v.PreparedMux.Lock()
+	v.Prepared[prepared.Ballot.VoteHash] = prepared
+	v.PreparedMux.Unlock()
 
-	electionPk := &Election{}
+	v.AckVote(prepared.Ballot.VoteHash, w)
+}
 
-	electionPk.PublicKey = pk
+// TakePrepared removes the prepared ballot with the tracker of the request.
+func (v *Voter) TakePrepared(r *http.Request) (*PreparedBallot, error) {
+	var request struct {
+		Tracker string `json:"tracker"`
+	}
 
-	electionPk.Name = answers.Election
+	json.NewDecoder(r.Body).Decode(&request)
 
-	electionPk.Questions = make([]*Question, 0)
+	v.PreparedMux.Lock()
+	defer v.PreparedMux.Unlock()
 
-	fmt.Println("====Q&A====")
-	fmt.Println(answers.QuesAndAns)
+	prepared, ok := v.Prepared[request.Tracker]
+	if !ok {
+		return nil, fmt.Errorf("no prepared ballot with tracker %s", request.Tracker)
+	}
+	delete(v.Prepared, request.Tracker)
+	return prepared, nil
+}
 
-	for _, q := range answers.QuesAndAns {
-		electionPk.Questions = append(electionPk.Questions, &Question{
-			Answers:  q.Answers,
-			Question: q.Question,
-		})
+// CastVote casts a prepared ballot.
+func (v *Voter) CastVote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("Wrong Methods")
 	}
 
-	fmt.Println("=====election=====")
-	fmt.Println(electionPk)
+	prepared, err := v.TakePrepared(r)
+	if err != nil {
+		fmt.Println(err)
+		v.AckPost(false, w)
+		return
+	}
 
-	fmt.Println("======answers=====")
-	fmt.Println(answers.Answers)
+	v.Cast(prepared, w)
+}
 
-	// encode
-	vote, _ := NewCastBallot(electionPk, answers.Answers)
+// Cast seals a prepared ballot, so that its plaintext and randomness never
+// leave the voter service, and sends it to the trustees.
+func (v *Voter) Cast(prepared *PreparedBallot, w http.ResponseWriter) {
+	prepared.Ballot.Vote.Seal()
 
-	// who vote it. election, vote
+	if err := v.SendEncrypted(prepared.Ballot); err != nil {
+		fmt.Println(err)
+		v.AckPost(false, w)
+		return
+	}
 
-	vote.VoterUuid = strconv.Itoa(answers.Voter)
-	vote.VoterHash = vote.VoterUuid
-	vote.VoteHash = answers.Election + vote.VoterUuid
+	v.AckVote(prepared.Ballot.VoteHash, w)
+}
 
-	vote.Vote.ElectionUuid = answers.Election
+// AuditVote opens a prepared ballot to the voter instead of casting it. The
+// response carries the plaintext and the randomness, so that the voter can
+// check the encryption on another device; the ballot is discarded.
+func (v *Voter) AuditVote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("Wrong Methods")
+	}
 
-	fmt.Println(vote.Vote.Answers[0].Answer)
+	prepared, err := v.TakePrepared(r)
+	if err != nil {
+		fmt.Println(err)
+		v.AckPost(false, w)
+		return
+	}
 
-	v.SendEncrypted(vote)
+	var response struct {
+		Success bool        `json:"success"`
+		Tracker string      `json:"tracker"`
+		Ballot  *CastBallot `json:"ballot"`
+		Error   string      `json:"error,omitempty"`
+	}
+	response.Tracker = prepared.Ballot.VoteHash
+	response.Ballot = prepared.Ballot
 
-	v.AckPost(true, w)
+	if err := prepared.Ballot.Vote.Audit(prepared.Election); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Success = true
+	}
+
+	json.NewEncoder(w).Encode(response)
 }
 
-func (v *Voter) SendEncrypted(vote *CastBallot) {
+// GetFrozenElection asks the independent server for the election with the
+// given name.
+func (v *Voter) GetFrozenElection(name string) (*Election, error) {
+	values := map[string]string{"elec": name}
+	jsonValue, _ := json.Marshal(values)
+	resp, err := http.Post("http://127.0.0.1:8081/frozenelection", "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var frozen struct {
+		Elec  Election `json:"elec"`
+		Exist bool     `json:"exist"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&frozen); err != nil {
+		return nil, err
+	}
+
+	if !frozen.Exist {
+		return nil, fmt.Errorf("election %s has not been frozen", name)
+	}
+
+	if err := frozen.Elec.ComputeHash(); err != nil {
+		return nil, err
+	}
+
+	return &frozen.Elec, nil
+}
+
+// GetRollProof gets the proof that a voter is on the roll of an election from
+// the independent server.
+func (v *Voter) GetRollProof(name string, voter string) (*RollProof, error) {
+	values := map[string]string{"elec": name, "voter": voter}
+	jsonValue, _ := json.Marshal(values)
+	resp, err := http.Post("http://127.0.0.1:8081/roll", "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var roll struct {
+		Proof *RollProof `json:"proof"`
+		Exist bool       `json:"exist"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&roll); err != nil {
+		return nil, err
+	}
+
+	if !roll.Exist {
+		return nil, fmt.Errorf("voter %s is not on the roll of election %s", voter, name)
+	}
+
+	return roll.Proof, nil
+}
+
+// SendEncrypted sends a sealed ballot to the trustees.
+func (v *Voter) SendEncrypted(vote *CastBallot) error {
+	if err := vote.Vote.CheckSealed(); err != nil {
+		return err
+	}
+
 	trustees := make([]string, 3)
 
 	trustees[0] = "http://127.0.0.1:8000/vote"
@@ -131,12 +355,34 @@ func (v *Voter) SendEncrypted(vote *CastBallot) {
 		resp, _ := http.Post(t, "application/json", bytes.NewBuffer(jsonVal))
 		fmt.Println(resp)
 	}
+	return nil
 }
 
 func (v *Voter) CreateElection(w http.ResponseWriter, r *http.Request) {
 	type Qlist struct {
 		Question string   `json:"question"`
 		Choices  []string `json:"choices"`
+
+		// "approval" by default, "score", "ranked" or "write-in"
+		ChoiceType string `json:"choice_type"`
+
+		// "homomorphic" by default, or "mixnet" to mix the ballots of
+		// an approval question
+		TallyType string `json:"tally_type"`
+
+		// "absolute" by default, or "relative"
+		ResultType string `json:"result_type"`
+
+		// Min and Max bound the number of selections, one by default,
+		// or the length of a ranking or a write-in
+		Min *int `json:"min"`
+		Max *int `json:"max"`
+
+		// Seats is the number of answers a "ranked" question elects
+		Seats int `json:"seats"`
+
+		// MaxScore is the highest score of a "score" question
+		MaxScore int `json:"max_score"`
 	}
 
 	var election struct {
@@ -144,6 +390,25 @@ func (v *Voter) CreateElection(w http.ResponseWriter, r *http.Request) {
 		Description string  `json:"description"`
 		Questions   []Qlist `json:"questions"`
 		Creator     string  `json:"creator"`
+
+		// Weights are the weights of the voters, for a weighted
+		// election
+		Weights map[string]int64 `json:"weights"`
+
+		// Revote is "first" by default, "last" or "reject", see
+		// ComputeRevote
+		Revote string `json:"revote"`
+
+		// VotingStartsAt and VotingEndsAt are the window of the voting,
+		// in RFC 3339. It starts now and lasts DefaultVotingPeriod by
+		// default.
+		VotingStartsAt string `json:"voting_starts_at"`
+		VotingEndsAt   string `json:"voting_ends_at"`
+
+		// Voters are the uuids of the voters on the roll of the
+		// election, anyone can vote if there are none. Each voter is
+		// registered with its signing key.
+		Voters []string `json:"voters"`
 	}
 
 	json.NewDecoder(r.Body).Decode(&election)
@@ -152,20 +417,107 @@ func (v *Voter) CreateElection(w http.ResponseWriter, r *http.Request) {
 	questionList := make([]*Question, 0)
 
 	for _, d := range election.Questions {
-		q := &Question{
-			Max:      1,
-			Min:      1,
-			Question: d.Question,
-			Answers:  d.Choices,
+		if d.ChoiceType == "" {
+			d.ChoiceType = message.ChoiceApproval
+		}
+		if d.ResultType == "" {
+			d.ResultType = message.ResultAbsolute
+		}
+
+		// the bounds a question of this choice type has by default
+		min, max := 1, 1
+		switch d.ChoiceType {
+		case message.ChoiceScore:
+			min, max = 0, 0
+		case message.ChoiceRanked:
+			max = len(d.Choices)
+		case message.ChoiceWriteIn:
+			min, max = 0, message.DefaultWriteInLength
+		}
+		if d.Min != nil {
+			min = *d.Min
+		}
+		if d.Max != nil {
+			max = *d.Max
 		}
+
+		q, err := NewQuestion(d.Choices, d.ChoiceType, max, min, d.Question, d.ResultType, "")
+		if err == nil && d.TallyType != "" && d.TallyType != q.TallyType {
+			q.TallyType = d.TallyType
+			err = q.Validate()
+		}
+		if err == nil && d.Seats != 0 {
+			err = q.SetSeats(d.Seats)
+		}
+		if err == nil && d.MaxScore != 0 {
+			err = q.SetMaxScore(d.MaxScore)
+		}
+		if err != nil {
+			fmt.Printf("Invalid question %q: %s\n", d.Question, err)
+			v.AckPost(false, w)
+			return
+		}
+
 		questionList = append(questionList, q)
 	}
 
-	newElection, _, _ := NewElection("https://example.com", election.Description, time.Now().String(),
+	start := time.Now()
+	var err error
+	if election.VotingStartsAt != "" {
+		if start, err = time.Parse(time.RFC3339, election.VotingStartsAt); err != nil {
+			fmt.Println(err)
+			v.AckPost(false, w)
+			return
+		}
+	}
+	end := start.Add(message.DefaultVotingPeriod)
+	if election.VotingEndsAt != "" {
+		if end, err = time.Parse(time.RFC3339, election.VotingEndsAt); err != nil {
+			fmt.Println(err)
+			v.AckPost(false, w)
+			return
+		}
+	}
+
+	// the election is frozen by the independent server
+	newElection, _, _ := NewElection("https://example.com", election.Description, "",
 		election.Name, false, questionList, "Fake",
-		false, "Fake hash", time.Now().String(), time.Now().String(), nil)
+		false, "Fake hash", "", "", nil)
+
+	if err := newElection.SetVotingWindow(start, end); err != nil {
+		fmt.Println(err)
+		v.AckPost(false, w)
+		return
+	}
+
+	if len(election.Weights) > 0 {
+		if err := newElection.SetWeights(election.Weights); err != nil {
+			fmt.Println(err)
+			v.AckPost(false, w)
+			return
+		}
+	}
+
+	if election.Revote != "" {
+		if err := newElection.SetRevote(election.Revote); err != nil {
+			fmt.Println(err)
+			v.AckPost(false, w)
+			return
+		}
+	}
 
-	values := map[string]Election{"elec": *newElection}
+	roll := make([]*RollEntry, len(election.Voters))
+	for i, uuid := range election.Voters {
+		entry, err := v.RegisterVoter(uuid)
+		if err != nil {
+			fmt.Println(err)
+			v.AckPost(false, w)
+			return
+		}
+		roll[i] = entry
+	}
+
+	values := map[string]interface{}{"elec": *newElection, "voters": roll}
 	jsonValue, _ := json.Marshal(values)
 	// target, _ := url.Parse("127.0.0.1:8081/election")
 	resp, err := http.Post("http://127.0.0.1:8081/election", "application/json", bytes.NewBuffer(jsonValue))
@@ -214,9 +566,24 @@ func (v *Voter) AckPost(success bool, w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// AckVote acknowledges a cast vote with its tracker, which the voter can look
+// up on the ballot board of any trustee.
+func (v *Voter) AckVote(tracker string, w http.ResponseWriter) {
+	var response struct {
+		Success bool   `json:"success"`
+		Tracker string `json:"tracker"`
+	}
+	response.Success = true
+	response.Tracker = tracker
+	json.NewEncoder(w).Encode(response)
+}
+
 func (v *Voter) ListenToGui() {
 	r := mux.NewRouter()
 	r.HandleFunc("/vote", v.CollectVote).Methods("POST")
+	r.HandleFunc("/encrypt", v.EncryptVote).Methods("POST")
+	r.HandleFunc("/cast", v.CastVote).Methods("POST")
+	r.HandleFunc("/audit", v.AuditVote).Methods("POST")
 	r.HandleFunc("/createElection", v.CreateElection).Methods("POST")
 	r.HandleFunc("/endvote", v.EndVote).Methods("POST")
 	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("./web/frontend/dist/"))))